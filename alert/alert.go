@@ -0,0 +1,128 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/pkg/errors"
+)
+
+const Measurement = "alerts"
+
+type Alert struct {
+	Device  string    `json:"device"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	// Key identifies the situation the alert is about, alerts raised again
+	// for the same situation have the same key
+	Key string `json:"key,omitempty"`
+	// Date is the date the alert is about, e.g. the forecasted starvation
+	// date
+	Date *time.Time `json:"date,omitempty"`
+}
+
+// Raise stores the alert in the alerts measurement if the influx sink is
+// configured and forwards it to the alert webhook if one is configured
+func Raise(ctx context.Context, a Alert) error {
+	log := logger.Get(ctx).WithField("alert", a.Type).WithField("device", a.Device)
+	config := config.Get()
+	log.Warn(a.Message)
+
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+
+	// The alerts are only stored in InfluxDB
+	if sink.Configured(sink.TypeInflux) {
+		err := store(config.InfluxUrl, a)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.AlertWebhookURL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "fail to encode alert")
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(config.AlertWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "fail to send alert")
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook answered %v", res.StatusCode)
+	}
+	return nil
+}
+
+func store(influxURL string, a Alert) error {
+	bp, err := influx.Start(influxURL)
+	if err != nil {
+		return errors.Wrap(err, "fail to open influx connection")
+	}
+	values := map[string]interface{}{
+		"message": a.Message,
+	}
+	if a.Key != "" {
+		values["key"] = a.Key
+	}
+	if a.Date != nil {
+		values["date"] = a.Date.UTC().Format(time.RFC3339)
+	}
+	err = influx.Add(Measurement, values, map[string]string{
+		"stream_id": a.Device,
+		"type":      a.Type,
+	}, bp, a.Time)
+	if err != nil {
+		return errors.Wrap(err, "fail to add alert point")
+	}
+	err = influx.Write(influxURL, bp)
+	if err != nil {
+		return errors.Wrap(err, "fail to write alert")
+	}
+	return nil
+}
+
+// Last returns the last alert of the type with the key raised for the device
+// since the time, nil if there is none
+func Last(device, alertType, key string, since time.Time) (*Alert, error) {
+	config := config.Get()
+	query := fmt.Sprintf(
+		`SELECT "message", "key", "date" FROM "%s" WHERE "stream_id" = %s AND "type" = %s AND "key" = %s AND time >= %s ORDER BY time DESC LIMIT 1`,
+		Measurement, influx.Quote(device), influx.Quote(alertType), influx.Quote(key), influx.Time(since),
+	)
+	rows, err := influx.QueryRows(config.InfluxUrl, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query alerts")
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	row := rows[0]
+	a := &Alert{Device: device, Type: alertType, Key: key, Time: row.Time}
+	if message, ok := row.Values["message"].(string); ok {
+		a.Message = message
+	}
+	if date, ok := row.Values["date"].(string); ok {
+		t, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid alert date")
+		}
+		a.Date = &t
+	}
+	return a, nil
+}
@@ -0,0 +1,181 @@
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	filePrefix = "uplinks-"
+	fileExt    = ".jsonl"
+	gzipExt    = ".gz"
+)
+
+// Record is a request received by ruche, the body is stored verbatim
+type Record struct {
+	ReceivedAt time.Time `json:"received_at"`
+	SourceIP   string    `json:"source_ip"`
+	Route      string    `json:"route"`
+	Body       string    `json:"body"`
+}
+
+// Writer appends records to JSON lines files in a directory. A new file is
+// started every day (UTC) or when the current one exceeds the maximum size,
+// the closed files are gzipped.
+type Writer struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	file    *os.File
+	day     string
+	written int64
+}
+
+func NewWriter(dir string, maxSize int64) (*Writer, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create archive directory")
+	}
+
+	// Files left open by a previous process are closed for good
+	err = compressAll(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to compress previous archives")
+	}
+
+	return &Writer{dir: dir, maxSize: maxSize}, nil
+}
+
+func (w *Writer) Append(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "fail to encode record")
+	}
+	line = append(line, '\n')
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	day := r.ReceivedAt.UTC().Format("2006-01-02")
+	if w.file == nil || day != w.day || (w.maxSize > 0 && w.written+int64(len(line)) > w.maxSize) {
+		err = w.rotate(r.ReceivedAt.UTC())
+		if err != nil {
+			return errors.Wrap(err, "fail to rotate archive")
+		}
+	}
+
+	n, err := w.file.Write(line)
+	w.written += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "fail to write record")
+	}
+	return nil
+}
+
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.closeFile()
+}
+
+func (w *Writer) rotate(now time.Time) error {
+	err := w.closeFile()
+	if err != nil {
+		return err
+	}
+
+	// Several files can be started within the same second when they are small,
+	// the sequence keeps the names unique and ordered
+	var file *os.File
+	for seq := 0; file == nil; seq++ {
+		name := filepath.Join(w.dir, fmt.Sprintf("%s%s-%04d%s", filePrefix, now.Format("20060102T150405"), seq, fileExt))
+		if _, err := os.Stat(name + gzipExt); err == nil {
+			continue
+		}
+		file, err = os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "fail to open archive file")
+		}
+	}
+	w.file = file
+	w.day = now.Format("2006-01-02")
+	w.written = 0
+	return nil
+}
+
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	name := w.file.Name()
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return errors.Wrap(err, "fail to close archive file")
+	}
+	return compress(name)
+}
+
+func compressAll(dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"+fileExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = compress(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compress replaces a file by its gzipped version
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "fail to open archive file")
+	}
+	defer src.Close()
+
+	tmp := name + gzipExt + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return errors.Wrap(err, "fail to create compressed file")
+	}
+	defer dst.Close()
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err != nil {
+		return errors.Wrap(err, "fail to compress archive file")
+	}
+	err = gz.Close()
+	if err != nil {
+		return errors.Wrap(err, "fail to compress archive file")
+	}
+	err = dst.Close()
+	if err != nil {
+		return errors.Wrap(err, "fail to close compressed file")
+	}
+
+	err = os.Rename(tmp, strings.TrimSuffix(tmp, ".tmp"))
+	if err != nil {
+		return errors.Wrap(err, "fail to rename compressed file")
+	}
+	return os.Remove(name)
+}
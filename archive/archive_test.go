@@ -0,0 +1,78 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_WriteRead(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		err = w.Append(Record{ReceivedAt: now, Route: "/webhooks", Body: `{"streamId":"dev"}`})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The last file is still open and not compressed yet
+	count := 0
+	err = Read(dir, func(r Record) error {
+		count++
+		if r.Body != `{"streamId":"dev"}` {
+			t.Errorf("body not kept verbatim: %v", r.Body)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 records, got %v", count)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ReadLiveFile(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, filePrefix+"2022-06-01-1"+fileExt)
+	err := os.WriteFile(live, []byte(`{"route":"/webhooks","body":"complete"}`+"\n"+`{"route":"/webh`), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := filepath.Join(dir, filePrefix+"2022-05-31-1"+fileExt)
+	err = os.WriteFile(closed, []byte(`{"route":"/webhooks","body":"compressed"}`+"\n"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compress(closed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The partial line being written is skipped and a file compressed after
+	// it was listed is read from its gzipped version
+	bodies := []string{}
+	for _, name := range []string{closed, live} {
+		err = readFile(name, func(r Record) error {
+			bodies = append(bodies, r.Body)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(bodies) != 2 || bodies[0] != "compressed" || bodies[1] != "complete" {
+		t.Fatalf("unexpected records %v", bodies)
+	}
+}
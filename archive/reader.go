@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Read calls fn for every archived record, oldest file first. The file
+// currently written by a running server is read as well.
+func Read(dir string, fn func(Record) error) error {
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil {
+		return errors.Wrap(err, "fail to list archive files")
+	}
+	sort.Strings(names)
+	listed := make(map[string]bool)
+	for _, name := range names {
+		listed[name] = true
+	}
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, fileExt) && !strings.HasSuffix(name, fileExt+gzipExt) {
+			continue
+		}
+		// A file being compressed is listed twice until the original is
+		// removed
+		if listed[name+gzipExt] {
+			continue
+		}
+		err = readFile(name, fn)
+		if err != nil {
+			return errors.Wrapf(err, "fail to read %v", name)
+		}
+	}
+	return nil
+}
+
+func readFile(name string, fn func(Record) error) error {
+	file, err := os.Open(name)
+	// The file has been compressed since it was listed
+	if os.IsNotExist(err) && !strings.HasSuffix(name, gzipExt) {
+		name += gzipExt
+		file, err = os.Open(name)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(name, gzipExt) {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadBytes('\n')
+		// The last line of the file written by a running server may not be
+		// complete yet
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var r Record
+		err = json.Unmarshal(line, &r)
+		if err != nil {
+			return errors.Wrap(err, "invalid record")
+		}
+		err = fn(r)
+		if err != nil {
+			return err
+		}
+	}
+}
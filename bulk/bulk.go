@@ -0,0 +1,354 @@
+package bulk
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/fragment"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/johnsudaar/ruche/uplink"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FormatHex files have a timestamp and a raw hex frame per line
+	FormatHex = "hex"
+	// FormatCSV files have a header with time and the field names
+	FormatCSV = "csv"
+
+	batchSize = 1000
+	maxErrors = 100
+)
+
+// Entry is a reading read from a file, either a raw frame or named fields
+type Entry struct {
+	Line    int
+	Time    time.Time
+	Payload []byte
+	Fields  map[string]interface{}
+}
+
+type Report struct {
+	Lines      int      `json:"lines"`
+	Imported   int      `json:"imported"`
+	Duplicates int      `json:"duplicates"`
+	Events     int      `json:"events"`
+	Errors     []string `json:"errors"`
+}
+
+// Import decodes the readings logged on the SD card of a device and stores
+// those which are not stored yet. The frames of the fragmented models are
+// reassembled as they are on the webhook.
+func Import(ctx context.Context, streamID string, r io.Reader, format string) (Report, error) {
+	log := logger.Get(ctx).WithField("stream_id", streamID)
+	config := config.Get()
+	report := Report{Errors: []string{}}
+	err := sink.RequireInflux()
+	if err != nil {
+		return report, err
+	}
+
+	model := decoder.DefaultModel
+	if device, ok := registry.Get().Device(streamID); ok && device.Model != "" {
+		model = device.Model
+	}
+
+	entries, errs, err := Parse(r, format)
+	if err != nil {
+		return report, errors.Wrap(err, "fail to parse file")
+	}
+	report.Lines = len(entries) + len(errs)
+	report.addErrors(errs...)
+	if len(entries) == 0 {
+		return report, nil
+	}
+
+	from, to := entries[0].Time, entries[0].Time
+	for _, e := range entries {
+		if e.Time.Before(from) {
+			from = e.Time
+		}
+		if e.Time.After(to) {
+			to = e.Time
+		}
+	}
+
+	schema, hasSchema := decoder.SchemaOf(model)
+	stored := make(map[string]map[int64]bool)
+	fragments := fragment.NewBuffer(config.FragmentTimeout)
+
+	batch, err := influx.Start(config.InfluxUrl)
+	if err != nil {
+		return report, errors.Wrap(err, "fail to open influx connection")
+	}
+	pending := 0
+	// The values conflicting with the stored field types are dropped and
+	// reported, the others are imported
+	write := func(batch *influxclient.BatchPoints) error {
+		err := influx.Write(config.InfluxUrl, batch)
+		if conflicts, ok := err.(*influx.ConflictsError); ok {
+			report.addErrors(conflicts.Error())
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "fail to write points")
+		}
+		return nil
+	}
+
+	for _, e := range entries {
+		var points []uplink.Point
+		created := e.Time
+		if e.Fields != nil {
+			if !hasSchema {
+				report.addErrors(fmt.Sprintf("line %v: no schema for model %v", e.Line, model))
+				continue
+			}
+			if fieldErrs := schema.Validate(e.Fields); len(fieldErrs) > 0 {
+				report.addErrors(fmt.Sprintf("line %v: invalid fields %v", e.Line, fieldErrs))
+				continue
+			}
+			var err error
+			points, err = uplink.FieldPoints(streamID, model, e.Fields)
+			if err != nil {
+				report.addErrors(fmt.Sprintf("line %v: %v", e.Line, err))
+				continue
+			}
+		} else {
+			body := uplink.Input{StreamID: streamID, Model: model, Created: e.Time}
+			body, payload, complete, err := uplink.Reassemble(fragments, body, e.Payload)
+			if err != nil {
+				report.addErrors(fmt.Sprintf("line %v: %v", e.Line, err))
+				continue
+			}
+			if !complete {
+				continue
+			}
+			if _, ok := uplink.Event(model, payload); ok {
+				report.Events++
+				continue
+			}
+			created = body.Created
+			points, err = uplink.Points(body, payload)
+			if err != nil {
+				report.addErrors(fmt.Sprintf("line %v: %v", e.Line, err))
+				continue
+			}
+		}
+
+		duplicate := false
+		for _, point := range points {
+			times, ok := stored[point.Measurement]
+			if !ok {
+				times, err = storedTimes(config.InfluxUrl, point.Measurement, streamID, from, to)
+				if err != nil {
+					return report, errors.Wrap(err, "fail to query stored readings")
+				}
+				stored[point.Measurement] = times
+			}
+			if times[influx.Truncate(created).UnixNano()] {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			report.Duplicates++
+			continue
+		}
+
+		for _, point := range points {
+			err = influx.Add(point.Measurement, point.Values, point.Tags, batch, created)
+			if err != nil {
+				return report, errors.Wrap(err, "fail to add batch point")
+			}
+			stored[point.Measurement][influx.Truncate(created).UnixNano()] = true
+		}
+		report.Imported++
+		pending++
+
+		if pending >= batchSize {
+			err = write(batch)
+			if err != nil {
+				return report, err
+			}
+			batch, err = influx.Start(config.InfluxUrl)
+			if err != nil {
+				return report, errors.Wrap(err, "fail to open influx connection")
+			}
+			pending = 0
+		}
+	}
+
+	if incomplete := fragments.Pending(); incomplete > 0 {
+		report.addErrors(fmt.Sprintf("%v incomplete fragmented messages", incomplete))
+	}
+	if pending > 0 {
+		err = write(batch)
+		if err != nil {
+			return report, err
+		}
+	}
+	log.WithField("imported", report.Imported).WithField("duplicates", report.Duplicates).Info("SD card data imported")
+	return report, nil
+}
+
+// storedTimes returns the timestamps (in nanoseconds, truncated to the write
+// precision) of the readings already stored for the device
+func storedTimes(influxURL, measurement, streamID string, from, to time.Time) (map[int64]bool, error) {
+	query := fmt.Sprintf(`SELECT * FROM "%s" WHERE "stream_id" = %s AND time >= %s AND time <= %s`,
+		measurement, influx.Quote(streamID), influx.Time(from), influx.Time(to))
+	rows, err := influx.QueryRows(influxURL, query)
+	if err != nil {
+		return nil, err
+	}
+	times := make(map[int64]bool)
+	for _, row := range rows {
+		times[influx.Truncate(row.Time).UnixNano()] = true
+	}
+	return times, nil
+}
+
+func (r *Report) addErrors(errs ...string) {
+	for _, err := range errs {
+		if len(r.Errors) >= maxErrors {
+			return
+		}
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+// Parse reads the entries of a file, the format is detected from the first
+// line if empty. Invalid lines are returned as errors.
+func Parse(r io.Reader, format string) ([]Entry, []string, error) {
+	reader := bufio.NewReader(r)
+	if format == "" {
+		first, err := reader.Peek(64)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return nil, nil, err
+		}
+		format = FormatHex
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(string(first))), "time,") {
+			format = FormatCSV
+		}
+	}
+
+	switch format {
+	case FormatHex:
+		return parseHex(reader)
+	case FormatCSV:
+		return parseCSV(reader)
+	}
+	return nil, nil, fmt.Errorf("unknown format %q", format)
+}
+
+// parseHex reads lines of "<time>,<hex>" or "<time> <hex>"
+func parseHex(r io.Reader) ([]Entry, []string, error) {
+	entries := []Entry{}
+	errs := []string{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.FieldsFunc(text, func(c rune) bool { return c == ',' || c == ' ' || c == '\t' || c == ';' })
+		if len(parts) != 2 {
+			errs = append(errs, fmt.Sprintf("line %v: expected a time and a hex frame", line))
+			continue
+		}
+		t, err := parseTime(parts[0])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %v: invalid time %q", line, parts[0]))
+			continue
+		}
+		payload, err := hex.DecodeString(parts[1])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %v: invalid hex frame", line))
+			continue
+		}
+		entries = append(entries, Entry{Line: line, Time: t, Payload: payload})
+	}
+	return entries, errs, scanner.Err()
+}
+
+// parseCSV reads a CSV file whose first column is the time and the others
+// named fields
+func parseCSV(r io.Reader) ([]Entry, []string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fail to read header")
+	}
+
+	entries := []Entry{}
+	errs := []string{}
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %v: %v", line, err))
+			continue
+		}
+		if len(record) != len(header) {
+			errs = append(errs, fmt.Sprintf("line %v: expected %v columns", line, len(header)))
+			continue
+		}
+		t, err := parseTime(record[0])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %v: invalid time %q", line, record[0]))
+			continue
+		}
+		fields := make(map[string]interface{})
+		for i := 1; i < len(header); i++ {
+			if record[i] == "" {
+				continue
+			}
+			fields[strings.TrimSpace(header[i])] = parseValue(record[i])
+		}
+		// A point without field is rejected by InfluxDB with its whole batch
+		if len(fields) == 0 {
+			errs = append(errs, fmt.Sprintf("line %v: no value", line))
+			continue
+		}
+		entries = append(entries, Entry{Line: line, Time: t, Fields: fields})
+	}
+	return entries, errs, nil
+}
+
+// parseTime accepts RFC3339 times and unix timestamps
+func parseTime(value string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func parseValue(value string) interface{} {
+	value = strings.TrimSpace(value)
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b
+	}
+	return value
+}
@@ -0,0 +1,92 @@
+package bulk
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/config/configtest"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/influx/influxtest"
+)
+
+func Test_ParseHex(t *testing.T) {
+	file := "# sd card\n1700000000,002008301100003a01150038f010e8044340e8\n2023-11-14T22:15:00Z 002008\nbad line here\n"
+	entries, errs, err := Parse(strings.NewReader(file), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || len(errs) != 1 {
+		t.Fatalf("expected 2 entries and 1 error, got %v and %v", len(entries), errs)
+	}
+	if entries[0].Time.Unix() != 1700000000 || len(entries[0].Payload) != 19 {
+		t.Fatalf("unexpected entry %+v", entries[0])
+	}
+}
+
+func Test_ParseCSV(t *testing.T) {
+	file := "time,temp,mass_r1\n2023-11-14T22:15:00Z,21.5,42.3\n2023-11-14T22:30:00Z,,42.1\n2023-11-14T22:45:00Z,,\n"
+	entries, errs, err := Parse(strings.NewReader(file), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || len(errs) != 1 || errs[0] != "line 4: no value" {
+		t.Fatalf("expected 2 entries and the empty row in error, got %v and %v", len(entries), errs)
+	}
+	if entries[1].Fields["mass_r1"] != 42.1 || len(entries[1].Fields) != 1 {
+		t.Fatalf("unexpected fields %+v", entries[1].Fields)
+	}
+}
+
+func Test_Import(t *testing.T) {
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		if !strings.HasPrefix(q, "SELECT") {
+			return nil
+		}
+		return []influxtest.Serie{{Name: "raw", Columns: []string{"time", "temp"}, Values: [][]interface{}{
+			{"2023-11-14T11:00:00.25Z", 20.8},
+		}}}
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL(), "FRAGMENTED_MODELS": "hive"})
+	err := influx.SetPrecision("ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer influx.SetPrecision("s")
+
+	// A message in two fragments, then two readings within the same second
+	// of which the first one is stored already
+	file := strings.Join([]string{
+		"2023-11-14T10:00:00Z,0102002008301100003a0115",
+		"2023-11-14T10:00:00.1Z,01120038f010e8044340e8",
+		"2023-11-14T11:00:00.25Z,0201002008301100003a01150038f010e8044340e8",
+		"2023-11-14T11:00:00.5Z,0301002008301100003a01150038f010e8044340e8",
+	}, "\n")
+	report, err := Import(context.Background(), "1A2B3C", strings.NewReader(file), FormatHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 || report.Duplicates != 1 || len(report.Errors) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	points := server.Points("raw")
+	if len(points) != 2 {
+		t.Fatalf("expected 2 points, got %+v", points)
+	}
+	for i, expected := range []string{"2023-11-14T10:00:00Z", "2023-11-14T11:00:00.5Z"} {
+		if points[i].Time.Format(time.RFC3339Nano) != expected || points[i].Fields["temp"] != "20.8" {
+			t.Errorf("expected a reading at %v, got %+v", expected, points[i])
+		}
+	}
+}
+
+func Test_ImportWithoutInflux(t *testing.T) {
+	configtest.Setenv(t, map[string]string{"SINKS": "remote_write,files"})
+	_, err := Import(context.Background(), "1A2B3C", strings.NewReader("1700000000,002008301100003a01150038f010e8044340e8"), FormatHex)
+	if err == nil || !strings.Contains(err.Error(), "influx sink is required") {
+		t.Fatalf("expected the influx sink to be required, got %v", err)
+	}
+}
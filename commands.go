@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/johnsudaar/ruche/bulk"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/export"
+	"github.com/johnsudaar/ruche/importer"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/reprocess"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/pkg/errors"
+)
+
+func reprocessCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	device := flags.String("device", "", "stream ID of the device to reprocess")
+	from := flags.String("from", "", "start of the period (RFC3339 or YYYY-MM-DD)")
+	to := flags.String("to", "", "end of the period (RFC3339 or YYYY-MM-DD), defaults to now")
+	dryRun := flags.Bool("dry-run", false, "print the changes instead of writing them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *device == "" {
+		return errors.New("--device is required")
+	}
+	opts := reprocess.Options{
+		Device: *device,
+		To:     time.Now(),
+		DryRun: *dryRun,
+		Out:    os.Stdout,
+	}
+	if *from != "" {
+		opts.From, err = parseTime(*from)
+		if err != nil {
+			return errors.Wrap(err, "invalid --from")
+		}
+	}
+	if *to != "" {
+		opts.To, err = parseTime(*to)
+		if err != nil {
+			return errors.Wrap(err, "invalid --to")
+		}
+	}
+
+	summary, err := reprocess.Run(ctx, opts)
+	if err != nil {
+		return errors.Wrap(err, "fail to reprocess")
+	}
+	fmt.Printf("%v archived uplinks, %v points rewritten, %v unchanged, %v skipped\n",
+		summary.Records, summary.Points, summary.Unchanged, summary.Skipped)
+	return nil
+}
+
+func uploadCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+	device := flags.String("device", "", "stream ID of the device which logged the file")
+	format := flags.String("format", "", "hex or csv, detected from the first line by default")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *device == "" || flags.NArg() != 1 {
+		return errors.New("usage: ruche upload --device X [--format hex|csv] FILE")
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return errors.Wrap(err, "fail to open file")
+	}
+	defer file.Close()
+
+	report, err := bulk.Import(ctx, *device, file, *format)
+	if err != nil {
+		return errors.Wrap(err, "fail to import file")
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	fmt.Printf("%v lines, %v points imported, %v already stored, %v events skipped, %v errors\n",
+		report.Lines, report.Imported, report.Duplicates, report.Events, len(report.Errors))
+	return nil
+}
+
+func importCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", importer.FormatRuche, "format of the file: ruche, broodminder, beep or a format of IMPORT_FORMATS_FILE")
+	device := flags.String("device", "", "hive name or stream ID of the rows without device column")
+	state := flags.String("state", "", "progress file used to resume an interrupted import, defaults to FILE.import-state")
+	batchSize := flags.Int("batch-size", 1000, "number of rows written at once")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: ruche import --format F [--device X] [--state S] FILE")
+	}
+	path := flags.Arg(0)
+	if *state == "" {
+		*state = path + ".import-state"
+	}
+
+	if config.Get().ImportFormatsFile != "" {
+		err = importer.LoadFile(config.Get().ImportFormatsFile)
+		if err != nil {
+			return errors.Wrap(err, "fail to load import formats")
+		}
+	}
+	err = sink.Init(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fail to init sinks")
+	}
+
+	report, err := importer.Run(ctx, path, importer.Options{
+		Format:    *format,
+		Device:    *device,
+		BatchSize: *batchSize,
+		StateFile: *state,
+		Progress:  os.Stderr,
+	})
+	closeErr := sink.Close()
+	if err != nil {
+		return errors.Wrap(err, "fail to import file")
+	}
+	if closeErr != nil {
+		return errors.Wrap(closeErr, "fail to flush sinks")
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	fmt.Printf("%v rows, %v imported, %v already imported, %v errors\n",
+		report.Lines, report.Imported, report.Skipped, len(report.Errors))
+	return nil
+}
+
+func exportCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	apiary := flags.String("apiary", "", "ID of the apiary to export")
+	hive := flags.String("hive", "", "name of the hive to export, instead of an apiary")
+	from := flags.String("from", "", "start of the period (RFC3339 or YYYY-MM-DD), defaults to a year ago")
+	to := flags.String("to", "", "end of the period (RFC3339 or YYYY-MM-DD), defaults to now")
+	out := flags.String("out", "", "path of the ZIP file, defaults to APIARY.zip or HIVE.zip")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if (*apiary == "") == (*hive == "") {
+		return errors.New("either --apiary or --hive is required")
+	}
+	var device registry.Device
+	if *hive != "" {
+		var ok bool
+		device, ok = registry.Get().DeviceByHive(*hive)
+		if !ok {
+			return fmt.Errorf("unknown hive %q", *hive)
+		}
+	}
+	end := time.Now()
+	if *to != "" {
+		end, err = parseTime(*to)
+		if err != nil {
+			return errors.Wrap(err, "invalid --to")
+		}
+	}
+	start := end.AddDate(-1, 0, 0)
+	if *from != "" {
+		start, err = parseTime(*from)
+		if err != nil {
+			return errors.Wrap(err, "invalid --from")
+		}
+	}
+	if *out == "" {
+		*out = *apiary + *hive + ".zip"
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return errors.Wrap(err, "fail to create file")
+	}
+	defer file.Close()
+
+	// The downlinks are only known by the running server
+	var manifest export.Manifest
+	if *hive != "" {
+		manifest, err = export.BundleDevice(ctx, file, device.StreamID, start, end, nil)
+	} else {
+		manifest, err = export.Bundle(ctx, file, *apiary, start, end, nil)
+	}
+	if err != nil {
+		os.Remove(*out)
+		return errors.Wrap(err, "fail to export")
+	}
+	err = file.Close()
+	if err != nil {
+		return errors.Wrap(err, "fail to write file")
+	}
+	for name, rows := range manifest.Files {
+		fmt.Printf("%v: %v rows\n", name, rows)
+	}
+	for _, name := range manifest.Unavailable {
+		if name == "calibration_history" {
+			fmt.Printf("%v: not available, export through the API\n", name)
+			continue
+		}
+		fmt.Printf("%v: not available\n", name)
+	}
+	fmt.Printf("Written to %v\n", *out)
+	return nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 )
@@ -10,6 +12,93 @@ var config Config
 type Config struct {
 	Port      int    `envconfig:"PORT" default:"8081"`
 	InfluxUrl string `envconfig:"SCALINGO_INFLUX_URL"`
+	// Precision of the written times: ns, u, ms, s, m or h
+	InfluxPrecision string `envconfig:"INFLUX_PRECISION" default:"s"`
+	// Create the database, its retention policies and the continuous queries
+	// of the rollups (name:interval:duration) on startup
+	InfluxBootstrap    bool     `envconfig:"INFLUX_BOOTSTRAP"`
+	InfluxRawPolicy    string   `envconfig:"INFLUX_RAW_POLICY" default:"autogen"`
+	InfluxRawRetention string   `envconfig:"INFLUX_RAW_RETENTION" default:"INF"`
+	InfluxRollups      []string `envconfig:"INFLUX_ROLLUPS" default:"hourly:1h:365d,daily:1d:INF"`
+	// Number of values of the network sequence counter before it wraps (4096 on Sigfox)
+	SeqNumberModulus uint32 `envconfig:"SEQ_NUMBER_MODULUS" default:"4096"`
+	// Timezone of the apiaries, used to split readings into local days
+	Timezone string `envconfig:"TIMEZONE" default:"UTC"`
+	// Basic auth credentials of the API, the API is open if no username is set
+	APIUsername string `envconfig:"API_USERNAME"`
+	APIPassword string `envconfig:"API_PASSWORD"`
+	// Alerts are POSTed as JSON to this URL
+	AlertWebhookURL string `envconfig:"ALERT_WEBHOOK_URL"`
+	// Alert when a device reboots RebootAlertCount times within RebootAlertWindow
+	RebootAlertCount  int           `envconfig:"REBOOT_ALERT_COUNT" default:"3"`
+	RebootAlertWindow time.Duration `envconfig:"REBOOT_ALERT_WINDOW" default:"1h"`
+	// Every received request is archived in this directory if set
+	ArchiveDir     string `envconfig:"ARCHIVE_DIR"`
+	ArchiveMaxSize int64  `envconfig:"ARCHIVE_MAX_SIZE" default:"104857600"`
+	// JSON file keeping the downlink queue across restarts, the queue is only
+	// kept in memory if not set
+	DownlinkStateFile string `envconfig:"DOWNLINK_STATE_FILE"`
+	// JSON file describing the apiaries and the devices
+	RegistryFile string `envconfig:"REGISTRY_FILE"`
+	// JSON file describing the decoder of every device model
+	DecodersFile string `envconfig:"DECODERS_FILE"`
+	// JSON file describing the column mappings of the import formats
+	ImportFormatsFile string `envconfig:"IMPORT_FORMATS_FILE"`
+	// Limits of the JavaScript payload formatters, the memory limit is the
+	// growth of the heap of the whole process while a formatter runs
+	JSTimeout     time.Duration `envconfig:"JS_TIMEOUT" default:"100ms"`
+	JSMemoryLimit uint64        `envconfig:"JS_MEMORY_LIMIT" default:"33554432"`
+	// Uplinks of these models are fragments to reassemble before decoding
+	FragmentedModels []string      `envconfig:"FRAGMENTED_MODELS"`
+	FragmentTimeout  time.Duration `envconfig:"FRAGMENT_TIMEOUT" default:"15m"`
+	// Policy applied to the readings whose time is missing, in the future or
+	// too old: reject, clamp (to the receive time) or flag (time_suspect)
+	TimestampPolicy    string        `envconfig:"TIMESTAMP_POLICY" default:"flag"`
+	TimestampMaxFuture time.Duration `envconfig:"TIMESTAMP_MAX_FUTURE" default:"5m"`
+	TimestampMaxAge    time.Duration `envconfig:"TIMESTAMP_MAX_AGE" default:"168h"`
+	// Interval of the flight activity job
+	FlightJobInterval time.Duration `envconfig:"FLIGHT_JOB_INTERVAL" default:"1h"`
+	// Interval of the daily weight change job and local daytime of the hives,
+	// the rest of the day is the nighttime
+	NectarJobInterval  time.Duration `envconfig:"NECTAR_JOB_INTERVAL" default:"1h"`
+	NectarDaytimeStart string        `envconfig:"NECTAR_DAYTIME_START" default:"06:00"`
+	NectarDaytimeEnd   string        `envconfig:"NECTAR_DAYTIME_END" default:"21:00"`
+	// Weight changes of at least StepThreshold kg between two readings at most
+	// StepMaxGap apart are manipulation candidates, steps of the same sign
+	// within StepMergeWindow are merged
+	StepJobInterval time.Duration `envconfig:"STEP_JOB_INTERVAL" default:"1h"`
+	StepThreshold   float64       `envconfig:"STEP_THRESHOLD" default:"2"`
+	StepMaxGap      time.Duration `envconfig:"STEP_MAX_GAP" default:"1h"`
+	StepMergeWindow time.Duration `envconfig:"STEP_MERGE_WINDOW" default:"30m"`
+	// Month the beekeeping seasons start on, from 1 to 12
+	SeasonStartMonth int `envconfig:"SEASON_START_MONTH" default:"1"`
+	// Food-store forecast from ForecastStartMonth to ForecastEndMonth: the
+	// consumption is the weight trend over ForecastWindow, a hive starves when
+	// its weight reaches its empty weight (ForecastEmptyWeight if not set in
+	// the registry) plus ForecastMinStores kg. Alerts are raised
+	// ForecastAlertDays in advance, once per hive and wintering season unless
+	// the starvation date moves earlier by more than ForecastAlertMargin.
+	ForecastJobInterval time.Duration `envconfig:"FORECAST_JOB_INTERVAL" default:"24h"`
+	ForecastStartMonth  int           `envconfig:"FORECAST_START_MONTH" default:"10"`
+	ForecastEndMonth    int           `envconfig:"FORECAST_END_MONTH" default:"3"`
+	ForecastWindow      time.Duration `envconfig:"FORECAST_WINDOW" default:"336h"`
+	ForecastEmptyWeight float64       `envconfig:"FORECAST_EMPTY_WEIGHT" default:"20"`
+	ForecastMinStores   float64       `envconfig:"FORECAST_MIN_STORES" default:"5"`
+	ForecastAlertDays   int           `envconfig:"FORECAST_ALERT_DAYS" default:"21"`
+	ForecastAlertMargin time.Duration `envconfig:"FORECAST_ALERT_MARGIN" default:"72h"`
+	// Storage sinks of the readings: influx, remote_write, files
+	Sinks []string `envconfig:"SINKS" default:"influx"`
+	// Prometheus remote write endpoint of the remote_write sink
+	RemoteWriteURL           string        `envconfig:"REMOTE_WRITE_URL"`
+	RemoteWriteUsername      string        `envconfig:"REMOTE_WRITE_USERNAME"`
+	RemoteWritePassword      string        `envconfig:"REMOTE_WRITE_PASSWORD"`
+	RemoteWriteBatchSize     int           `envconfig:"REMOTE_WRITE_BATCH_SIZE" default:"500"`
+	RemoteWriteFlushInterval time.Duration `envconfig:"REMOTE_WRITE_FLUSH_INTERVAL" default:"10s"`
+	RemoteWriteMaxRetries    int           `envconfig:"REMOTE_WRITE_MAX_RETRIES" default:"5"`
+	// Directory of the daily CSV files of the files sink, the closed days are
+	// also converted to Parquet if FilesParquet is set
+	FilesDir     string `envconfig:"FILES_DIR"`
+	FilesParquet bool   `envconfig:"FILES_PARQUET"`
 }
 
 func Init() error {
@@ -0,0 +1,29 @@
+// Package configtest sets the configuration of the tests
+package configtest
+
+import (
+	"testing"
+
+	"github.com/johnsudaar/ruche/config"
+)
+
+// Setenv sets the environment variables and reloads the configuration. The
+// variables are restored and the configuration reloaded at the end of the
+// test.
+func Setenv(t *testing.T, env map[string]string) {
+	// Cleanups run last in first out, the configuration is reloaded once the
+	// variables are restored
+	t.Cleanup(func() {
+		err := config.Init()
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	err := config.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,116 @@
+package decoder
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	MeasurementBrood = "brood"
+
+	// The brood is assessed on the central half of the string, which only
+	// excludes the outer frames from 4 probes
+	broodMinProbes = 4
+	broodMaxProbes = 8
+	// The brood nest is kept between 34 and 36°C by the workers
+	broodMinTemp = 34.0
+	broodMaxTemp = 36.0
+)
+
+// Reading is a set of fields stored with tags of its own, for decoders which
+// produce several points per frame
+type Reading struct {
+	Measurement string
+	Tags        map[string]string
+	Values      map[string]interface{}
+}
+
+// MultiDecoder is implemented by decoders producing several points per frame
+type MultiDecoder interface {
+	DecodeReadings(payload []byte) ([]Reading, error)
+}
+
+// Brood decodes the frames of a string of temperature probes laid across the
+// frames: the number of probes then the temperature of every probe, in
+// hundredths of degree on a signed little endian int16, ordered by position.
+type Brood struct{}
+
+func (Brood) Measurement() string {
+	return MeasurementBrood
+}
+
+// Schema lists the fields of the summary and the temp field of the probe
+// points
+func (Brood) Schema() Schema {
+	return Schema{
+		"probes":        between(broodMinProbes, broodMaxProbes),
+		"central_temp":  between(-40, 85),
+		"brood_present": {Type: TypeBoolean},
+		"temp":          between(-40, 85),
+	}
+}
+
+// Decode returns the summary of the probe string: brood is considered present
+// when all the central probes are within the brood nest temperature range
+func (d Brood) Decode(payload []byte) (map[string]interface{}, error) {
+	temps, err := d.temperatures(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	values["probes"] = float64(len(temps))
+
+	central := temps[len(temps)/4 : len(temps)-len(temps)/4]
+	present := true
+	sum := 0.0
+	for _, t := range central {
+		sum += t
+		if t < broodMinTemp || t > broodMaxTemp {
+			present = false
+		}
+	}
+	values["central_temp"] = sum / float64(len(central))
+	values["brood_present"] = present
+
+	return values, nil
+}
+
+// DecodeReadings returns the summary and a point per probe tagged by its
+// position
+func (d Brood) DecodeReadings(payload []byte) ([]Reading, error) {
+	summary, err := d.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	temps, _ := d.temperatures(payload)
+
+	readings := []Reading{{Measurement: MeasurementBrood, Values: summary}}
+	for i, t := range temps {
+		readings = append(readings, Reading{
+			Measurement: MeasurementBrood,
+			Tags:        map[string]string{"probe": strconv.Itoa(i)},
+			Values:      map[string]interface{}{"temp": t},
+		})
+	}
+	return readings, nil
+}
+
+func (Brood) temperatures(payload []byte) ([]float64, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("empty payload")
+	}
+	count := int(payload[0])
+	if count < broodMinProbes || count > broodMaxProbes {
+		return nil, fmt.Errorf("invalid probe count %v", count)
+	}
+	if len(payload) < 1+count*2 {
+		return nil, fmt.Errorf("payload too short for %v probes: %v bytes", count, len(payload))
+	}
+
+	temps := make([]float64, count)
+	for i := range temps {
+		temps[i] = float64(readInt(payload[1+i*2:3+i*2], true, true)) / 100.0
+	}
+	return temps, nil
+}
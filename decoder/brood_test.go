@@ -0,0 +1,40 @@
+package decoder
+
+import (
+	"testing"
+)
+
+func Test_Brood(t *testing.T) {
+	// 6 probes: 25.00, 30.00, 34.50, 35.20, 35.00, 24.00
+	payload := []byte{6, 0xc4, 0x09, 0xb8, 0x0b, 0x7a, 0x0d, 0xc0, 0x0d, 0xac, 0x0d, 0x60, 0x09}
+
+	readings, err := Brood{}.DecodeReadings(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 7 {
+		t.Fatalf("expected a summary and 6 probes, got %v readings", len(readings))
+	}
+	if readings[3].Tags["probe"] != "2" || readings[3].Values["temp"] != 34.5 {
+		t.Fatalf("unexpected probe reading %+v", readings[3])
+	}
+	// The central probes are 1 to 4, 30°C is out of the brood range
+	if readings[0].Values["brood_present"] != false {
+		t.Fatalf("unexpected summary %+v", readings[0].Values)
+	}
+
+	payload[3], payload[4] = 0x7a, 0x0d
+	values, err := Brood{}.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["brood_present"] != true {
+		t.Fatalf("expected brood, got %+v", values)
+	}
+
+	// The outer probes cannot be told from the central ones on shorter strings
+	_, err = Brood{}.Decode([]byte{3, 0x7a, 0x0d, 0x7a, 0x0d, 0x7a, 0x0d})
+	if err == nil {
+		t.Fatal("expected a string of 3 probes to be rejected")
+	}
+}
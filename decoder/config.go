@@ -0,0 +1,191 @@
+package decoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/johnsudaar/ruche/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	FormatHive  = "hive"
+	FormatLPP   = "lpp"
+	FormatTLV   = "tlv"
+	FormatJS    = "js"
+	FormatSound = "sound"
+	FormatBrood = "brood"
+	// FormatJSON is the format of the devices posting their fields directly
+	FormatJSON = "json"
+)
+
+// ModelConfig is the decoder configuration of a device model in the decoders
+// file, a JSON object indexed by model:
+//
+//	{
+//	  "diy-scale": {"format": "lpp", "channels": {"1": "temp", "5": "mass_r1"}, "text_events": true,
+//	    "schema": {"temp": {"type": "float"}, "mass_r1": {"type": "float"}}},
+//	  "probe": {"format": "tlv", "types": {"1": {"name": "temp", "signed": true, "scale": 0.01}},
+//	    "schema": {"temp": {"type": "float"}}},
+//	  "vendor-sensor": {"format": "js", "script": "formatters/vendor-sensor.js",
+//	    "schema": {"mass": {"type": "float"}, "battery": {"type": "integer"}}},
+//	  "hive-sound": {"format": "sound", "sound": {"bins": 8, "min_freq": 100, "max_freq": 600}},
+//	  "brood-probes": {"format": "brood"},
+//	  "esp32-scale": {"format": "json", "schema": {"mass_r1": {"type": "float", "min": 0}}}
+//	}
+type ModelConfig struct {
+	Format string `json:"format"`
+	// Channels maps the LPP channels to field names
+	Channels map[string]string `json:"channels"`
+	// Types maps the TLV types to fields
+	Types        map[string]TLVField `json:"types"`
+	LittleEndian bool                `json:"little_endian"`
+	// Script is the path of the JavaScript formatter, relative to the
+	// decoders file
+	Script string `json:"script"`
+	// Sound overrides the default settings of the acoustic sensor
+	Sound *SoundConfig `json:"sound"`
+	// Schema lists the fields of the model and their type, it is required for
+	// the formats whose fields are not known in advance: json, lpp, tlv and
+	// js
+	Schema Schema `json:"schema"`
+	// TextEvents is set for the models sending their events as ASCII frames
+	TextEvents bool `json:"text_events"`
+}
+
+type SoundConfig struct {
+	MinFreq         float64    `json:"min_freq"`
+	MaxFreq         float64    `json:"max_freq"`
+	Bins            int        `json:"bins"`
+	BytesPerBand    int        `json:"bytes_per_band"`
+	Scale           float64    `json:"scale"`
+	PipingRange     [2]float64 `json:"piping_range"`
+	HumRange        [2]float64 `json:"hum_range"`
+	PipingThreshold float64    `json:"piping_threshold"`
+}
+
+// LoadFile registers the decoders of the models described in the file
+func LoadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "fail to read decoders file")
+	}
+
+	var models map[string]ModelConfig
+	err = json.Unmarshal(content, &models)
+	if err != nil {
+		return errors.Wrap(err, "invalid decoders file")
+	}
+
+	dir := filepath.Dir(path)
+	for model, cfg := range models {
+		switch cfg.Format {
+		case FormatJSON, FormatLPP, FormatTLV, FormatJS:
+			if cfg.Schema == nil {
+				return errors.Errorf("model %v has no schema, it is required for the %v format", model, cfg.Format)
+			}
+		}
+		if cfg.Schema != nil {
+			err := cfg.Schema.check()
+			if err != nil {
+				return errors.Wrapf(err, "invalid schema for model %v", model)
+			}
+			RegisterSchema(model, cfg.Schema)
+		}
+		textEvents[model] = cfg.TextEvents
+		if cfg.Format == FormatJSON {
+			continue
+		}
+		d, err := cfg.decoder(dir)
+		if err != nil {
+			return errors.Wrapf(err, "invalid decoder for model %v", model)
+		}
+		Register(model, d)
+	}
+	return nil
+}
+
+func (cfg ModelConfig) decoder(dir string) (Decoder, error) {
+	switch cfg.Format {
+	case FormatHive, "":
+		return Hive{}, nil
+	case FormatLPP:
+		channels := make(map[byte]string)
+		for channel, name := range cfg.Channels {
+			id, err := parseByte(channel)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid channel")
+			}
+			channels[id] = name
+		}
+		return LPP{Channels: channels}, nil
+	case FormatTLV:
+		types := make(map[byte]TLVField)
+		for t, field := range cfg.Types {
+			id, err := parseByte(t)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid type")
+			}
+			types[id] = field
+		}
+		return TLV{Types: types, LittleEndian: cfg.LittleEndian}, nil
+	case FormatJS:
+		script := cfg.Script
+		if !filepath.IsAbs(script) {
+			script = filepath.Join(dir, script)
+		}
+		config := config.Get()
+		return NewJavaScript(script, config.JSTimeout, config.JSMemoryLimit)
+	case FormatSound:
+		return cfg.Sound.decoder()
+	case FormatBrood:
+		return Brood{}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", cfg.Format)
+	}
+}
+
+func parseByte(value string) (byte, error) {
+	res, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return 0, err
+	}
+	return byte(res), nil
+}
+
+// decoder applies the values set in the configuration on top of the default
+// acoustic sensor, the bands are set together
+func (cfg *SoundConfig) decoder() (Sound, error) {
+	d := DefaultSound
+	if cfg == nil {
+		return d, nil
+	}
+	if cfg.Bins != 0 || cfg.MinFreq != 0 || cfg.MaxFreq != 0 {
+		d.Bins = cfg.Bins
+		d.MinFreq = cfg.MinFreq
+		d.MaxFreq = cfg.MaxFreq
+	}
+	if cfg.BytesPerBand != 0 {
+		d.BytesPerBand = cfg.BytesPerBand
+	}
+	if cfg.Scale > 0 {
+		d.Scale = cfg.Scale
+	}
+	if cfg.PipingRange != [2]float64{} {
+		d.PipingRange = cfg.PipingRange
+	}
+	if cfg.HumRange != [2]float64{} {
+		d.HumRange = cfg.HumRange
+	}
+	if cfg.PipingThreshold > 0 {
+		d.PipingThreshold = cfg.PipingThreshold
+	}
+	err := d.validate()
+	if err != nil {
+		return d, errors.Wrap(err, "invalid sound settings")
+	}
+	return d, nil
+}
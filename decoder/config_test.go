@@ -0,0 +1,67 @@
+package decoder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_LoadFile(t *testing.T) {
+	examples := map[string]struct {
+		Content string
+		Error   string
+	}{
+		"lpp with schema": {
+			Content: `{"test-lpp": {"format": "lpp", "channels": {"1": "temp"}, "schema": {"temp": {"type": "float"}}}}`,
+		},
+		"lpp without schema": {
+			Content: `{"test-lpp": {"format": "lpp", "channels": {"1": "temp"}}}`,
+			Error:   "model test-lpp has no schema",
+		},
+		"tlv without schema": {
+			Content: `{"test-tlv": {"format": "tlv", "types": {"1": {"name": "temp"}}}}`,
+			Error:   "model test-tlv has no schema",
+		},
+		"js without schema": {
+			Content: `{"test-js": {"format": "js", "script": "formatter.js"}}`,
+			Error:   "model test-js has no schema",
+		},
+		"unknown field type": {
+			Content: `{"test-json": {"format": "json", "schema": {"mass": {"type": "double"}}}}`,
+			Error:   `field mass has an unknown type "double"`,
+		},
+		"missing field type": {
+			Content: `{"test-json": {"format": "json", "schema": {"mass": {"min": 0}}}}`,
+			Error:   `field mass has an unknown type ""`,
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "decoders.json")
+			err := os.WriteFile(path, []byte(example.Content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				for _, model := range []string{"test-lpp", "test-tlv", "test-js", "test-json"} {
+					delete(decoders, model)
+					delete(schemas, model)
+					delete(textEvents, model)
+				}
+			})
+
+			err = LoadFile(path)
+			if example.Error == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), example.Error) {
+				t.Fatalf("expected %q, got %v", example.Error, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package decoder
+
+import (
+	"sort"
+
+	"github.com/johnsudaar/ruche/downlink"
+)
+
+// DefaultModel is the native format of our hive boards
+const DefaultModel = "hive"
+
+// MeasurementRaw stores the hive readings
+const MeasurementRaw = "raw"
+
+// Decoder turns the raw payload of an uplink into fields
+type Decoder interface {
+	Decode(payload []byte) (map[string]interface{}, error)
+}
+
+// DownlinkEncoder is implemented by the decoders of devices accepting
+// configuration commands
+type DownlinkEncoder interface {
+	EncodeDownlink(cmd downlink.Command) ([]byte, error)
+}
+
+// Measurer is implemented by the decoders of sensors whose readings are not
+// stored in the raw measurement
+type Measurer interface {
+	Measurement() string
+}
+
+// EventSender is implemented by the decoders of devices sending their events
+// (restart, boot reason, firmware version) as ASCII frames
+type EventSender interface {
+	TextEvents() bool
+}
+
+// MeasurementOf returns the measurement the fields of the decoder go to
+func MeasurementOf(d Decoder) string {
+	if m, ok := d.(Measurer); ok {
+		return m.Measurement()
+	}
+	return MeasurementRaw
+}
+
+var decoders = map[string]Decoder{
+	DefaultModel: Hive{},
+}
+
+// textEvents are the configured models sending ASCII event frames
+var textEvents = map[string]bool{}
+
+// Register must be called before the web server starts
+func Register(model string, d Decoder) {
+	decoders[model] = d
+}
+
+// Get returns the decoder of a device model, unknown models use the native
+// hive format
+func Get(model string) Decoder {
+	d, ok := decoders[model]
+	if !ok {
+		return decoders[DefaultModel]
+	}
+	return d
+}
+
+// Models returns the models with a decoder or a schema, sorted
+func Models() []string {
+	set := make(map[string]bool)
+	for model := range decoders {
+		set[model] = true
+	}
+	for model := range schemas {
+		set[model] = true
+	}
+	models := make([]string, 0, len(set))
+	for model := range set {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// SendsTextEvents returns true if the ASCII frames of the model are events.
+// The ASCII frames of the other models are measurements, e.g. sound bands in
+// the printable range.
+func SendsTextEvents(model string) bool {
+	if textEvents[model] {
+		return true
+	}
+	s, ok := Get(model).(EventSender)
+	return ok && s.TextEvents()
+}
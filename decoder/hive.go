@@ -0,0 +1,123 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/johnsudaar/ruche/downlink"
+)
+
+const (
+	hivePayloadLength = 19
+	// Boards with an entrance bee counter append the in and out counts of
+	// the interval
+	hiveCounterPayloadLength = 23
+	hiveDownlinkLength       = 8
+
+	hiveOpSetInterval = 0x01
+	hiveOpSetSensor   = 0x02
+	hiveOpTare        = 0x03
+)
+
+// Sensor identifiers used by the hive board in downlinks, 0 means all sensors
+var hiveSensors = map[string]byte{
+	"temp":    1,
+	"hum":     2,
+	"lum":     3,
+	"mass_r1": 4,
+	"mass_r2": 5,
+	"mass_r3": 6,
+	"mass_r4": 7,
+}
+
+type Hive struct{}
+
+func (Hive) Schema() Schema {
+	zero := 0.0
+	positive := Field{Type: TypeFloat, Min: &zero}
+	return Schema{
+		"rucher_id":   {Type: TypeInteger, Min: &zero, Tag: true},
+		"temp":        between(-40, 85),
+		"hum":         between(0, 100),
+		"lum":         positive,
+		"bat_tension": between(0, 15),
+		"sol_tension": between(0, 30),
+		"mass_r1":     positive,
+		"mass_r2":     positive,
+		"mass_r3":     positive,
+		"mass_r4":     positive,
+		"bees_in":     positive,
+		"bees_out":    positive,
+	}
+}
+
+// TextEvents is true, the hive boards announce their restarts in ASCII
+func (Hive) TextEvents() bool {
+	return true
+}
+
+func (Hive) Decode(payload []byte) (map[string]interface{}, error) {
+	if len(payload) < hivePayloadLength {
+		return nil, fmt.Errorf("payload too short: %v bytes, expected %v", len(payload), hivePayloadLength)
+	}
+
+	values := make(map[string]interface{})
+
+	values["rucher_id"] = payload[0]
+
+	values["temp"] = float64(getUInt16(payload[1:3])) / 100.0
+	values["hum"] = float64(getUInt16(payload[3:5])) / 100.0
+	values["lum"] = float64(getUInt16(payload[5:7]))
+	values["bat_tension"] = float64(getUInt16(payload[7:9])) / 100.0
+	values["sol_tension"] = float64(getUInt16(payload[9:11])) / 100.0
+	values["mass_r1"] = float64(getUInt16(payload[11:13])) / 100.0
+	values["mass_r2"] = float64(getUInt16(payload[13:15])) / 100.0
+	values["mass_r3"] = float64(getUInt16(payload[15:17])) / 100.0
+	values["mass_r4"] = float64(getUInt16(payload[17:19])) / 100.0
+
+	if len(payload) >= hiveCounterPayloadLength {
+		values["bees_in"] = float64(getUInt16(payload[19:21]))
+		values["bees_out"] = float64(getUInt16(payload[21:23]))
+	}
+
+	return values, nil
+}
+
+// EncodeDownlink encodes a command in the 8 bytes downlink of the hive board:
+// the first byte is the operation, the following ones its arguments.
+func (Hive) EncodeDownlink(cmd downlink.Command) ([]byte, error) {
+	res := make([]byte, hiveDownlinkLength)
+	switch cmd.Type {
+	case downlink.CommandSetInterval:
+		res[0] = hiveOpSetInterval
+		binary.LittleEndian.PutUint16(res[1:3], uint16(cmd.Interval))
+	case downlink.CommandSetSensor:
+		sensor, ok := hiveSensors[cmd.Sensor]
+		if !ok {
+			return nil, fmt.Errorf("unknown sensor %q", cmd.Sensor)
+		}
+		res[0] = hiveOpSetSensor
+		res[1] = sensor
+		if cmd.Enabled {
+			res[2] = 1
+		}
+	case downlink.CommandTare:
+		res[0] = hiveOpTare
+		if cmd.Sensor != "" {
+			sensor, ok := hiveSensors[cmd.Sensor]
+			if !ok {
+				return nil, fmt.Errorf("unknown sensor %q", cmd.Sensor)
+			}
+			res[1] = sensor
+		}
+	default:
+		return nil, fmt.Errorf("unsupported command %q", cmd.Type)
+	}
+	return res, nil
+}
+
+func getUInt16(value []byte) uint16 {
+	res := uint16(value[1])<<8 | uint16(value[0])
+
+	return res
+}
@@ -0,0 +1,40 @@
+package decoder
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/johnsudaar/ruche/downlink"
+)
+
+func Test_Parser(t *testing.T) {
+	payload, _ := hex.DecodeString("002008301100003a01150038f010e8044340e8")
+	values, err := Hive{}.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("%+v\n", values)
+}
+
+func Test_EncodeDownlink(t *testing.T) {
+	data, err := Hive{}.EncodeDownlink(downlink.Command{Type: downlink.CommandSetInterval, Interval: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(data) != "010f000000000000" {
+		t.Fatalf("unexpected downlink %x", data)
+	}
+}
+
+func Test_ParserBeeCounter(t *testing.T) {
+	payload, _ := hex.DecodeString("002008301100003a01150038f010e8044340e8e803d007")
+	values, err := Hive{}.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["bees_in"] != 1000.0 || values["bees_out"] != 2000.0 {
+		t.Fatalf("unexpected bee counts %v %v", values["bees_in"], values["bees_out"])
+	}
+}
@@ -0,0 +1,201 @@
+package decoder
+
+import (
+	"fmt"
+	"os"
+	"runtime/metrics"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/pkg/errors"
+)
+
+const (
+	jsMaxCallStackSize = 256
+	// The heap is sampled without stopping the world, a few times during the
+	// default timeout
+	jsMemoryCheckInterval = 25 * time.Millisecond
+	jsHeapMetric          = "/memory/classes/heap/objects:bytes"
+	// Limits of the decoded data, a formatter returning more is an error
+	jsMaxFields       = 256
+	jsMaxStringLength = 1024
+)
+
+// jsLock serializes the formatter runs, the heap growth sampled by the
+// watchdog is then only caused by one formatter
+var jsLock sync.Mutex
+
+// JavaScript runs a TTN style payload formatter exposing a
+// decodeUplink(input) function. Every uplink is decoded in a fresh runtime
+// which has no access to the file system or the network. Formatters run one
+// at a time, the runtime is interrupted when it runs longer than Timeout or
+// when the heap grows by more than MemoryLimit bytes while it runs. The heap is
+// shared by the whole process and sampled every 25ms: the memory limit is a
+// safeguard against runaway scripts rather than a precise accounting, the
+// allocations of the rest of the process count as well and a short burst can
+// go unnoticed. It must be set well above the needs of a formatter. The data
+// is limited to 256 fields and strings of 1024 bytes.
+type JavaScript struct {
+	program     *goja.Program
+	Timeout     time.Duration
+	MemoryLimit uint64
+}
+
+func NewJavaScript(path string, timeout time.Duration, memoryLimit uint64) (*JavaScript, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to read formatter")
+	}
+	program, err := goja.Compile(path, string(src), false)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to compile formatter")
+	}
+	return &JavaScript{
+		program:     program,
+		Timeout:     timeout,
+		MemoryLimit: memoryLimit,
+	}, nil
+}
+
+func (d *JavaScript) Decode(payload []byte) (map[string]interface{}, error) {
+	jsLock.Lock()
+	defer jsLock.Unlock()
+
+	vm := goja.New()
+	vm.SetMaxCallStackSize(jsMaxCallStackSize)
+
+	done := make(chan struct{})
+	defer close(done)
+	go d.watchdog(vm, done)
+
+	_, err := vm.RunProgram(d.program)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to run formatter")
+	}
+	decodeUplink, ok := goja.AssertFunction(vm.Get("decodeUplink"))
+	if !ok {
+		return nil, errors.New("formatter does not define decodeUplink")
+	}
+
+	bytes := make([]interface{}, len(payload))
+	for i, b := range payload {
+		bytes[i] = int(b)
+	}
+	input := map[string]interface{}{
+		"bytes": bytes,
+		"fPort": 1,
+	}
+	res, err := decodeUplink(goja.Undefined(), vm.ToValue(input))
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to run decodeUplink")
+	}
+
+	output, ok := res.Export().(map[string]interface{})
+	if !ok {
+		return nil, errors.New("decodeUplink must return an object")
+	}
+	if errs, ok := output["errors"].([]interface{}); ok && len(errs) > 0 {
+		return nil, fmt.Errorf("formatter errors: %v", errs)
+	}
+	data, ok := output["data"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("decodeUplink result has no data object")
+	}
+
+	values := make(map[string]interface{})
+	err = flatten(values, "", data)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid decodeUplink data")
+	}
+	return values, nil
+}
+
+func (d *JavaScript) watchdog(vm *goja.Runtime, done chan struct{}) {
+	var timeout <-chan time.Time
+	if d.Timeout > 0 {
+		timer := time.NewTimer(d.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var memoryCheck <-chan time.Time
+	baseline := heapObjects()
+	if d.MemoryLimit > 0 {
+		ticker := time.NewTicker(jsMemoryCheckInterval)
+		defer ticker.Stop()
+		memoryCheck = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			vm.Interrupt("formatter timeout")
+			return
+		case <-memoryCheck:
+			heap := heapObjects()
+			if heap > baseline && heap-baseline > d.MemoryLimit {
+				vm.Interrupt("formatter memory limit exceeded")
+				return
+			}
+		}
+	}
+}
+
+// heapObjects returns the bytes of the live and not yet swept heap objects of
+// the process
+func heapObjects() uint64 {
+	sample := []metrics.Sample{{Name: jsHeapMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// flatten converts the data object into fields, nested objects and arrays
+// are joined with underscores (e.g. {"scale": [12.3]} gives scale_0)
+func flatten(values map[string]interface{}, prefix string, data interface{}) error {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for k, sub := range v {
+			err := flatten(values, joinName(prefix, k), sub)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		for i, sub := range v {
+			err := flatten(values, joinName(prefix, strconv.Itoa(i)), sub)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case int64:
+		values[prefix] = float64(v)
+	case string:
+		if len(v) > jsMaxStringLength {
+			return fmt.Errorf("%v is longer than %v bytes", prefix, jsMaxStringLength)
+		}
+		values[prefix] = v
+	case float64, bool:
+		values[prefix] = v
+	default:
+		return nil
+	}
+	if len(values) > jsMaxFields {
+		return fmt.Errorf("more than %v fields", jsMaxFields)
+	}
+	return nil
+}
+
+func joinName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
@@ -0,0 +1,79 @@
+package decoder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFormatter(t *testing.T, src string) string {
+	path := filepath.Join(t.TempDir(), "formatter.js")
+	err := os.WriteFile(path, []byte(src), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_JavaScript(t *testing.T) {
+	path := writeFormatter(t, `
+function decodeUplink(input) {
+  return {
+    data: {
+      temp: ((input.bytes[1] << 8) | input.bytes[0]) / 100,
+      scales: [input.bytes[2], input.bytes[3]],
+    },
+  };
+}`)
+	d, err := NewJavaScript(path, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := d.Decode([]byte{0x20, 0x08, 12, 13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["temp"] != 20.8 || values["scales_0"] != 12.0 || values["scales_1"] != 13.0 {
+		t.Fatalf("unexpected values %+v", values)
+	}
+}
+
+func Test_JavaScriptTimeout(t *testing.T) {
+	path := writeFormatter(t, `function decodeUplink(input) { while (true) {} }`)
+	d, err := NewJavaScript(path, 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.Decode([]byte{0x00})
+	if err == nil {
+		t.Fatal("expected the formatter to be interrupted")
+	}
+}
+
+func Test_JavaScriptLimits(t *testing.T) {
+	examples := map[string]string{
+		"too many fields": `function decodeUplink(input) {
+  var data = {};
+  for (var i = 0; i < 1000; i++) { data["f" + i] = i; }
+  return { data: data };
+}`,
+		"string too long": `function decodeUplink(input) {
+  return { data: { label: "x".repeat(2000) } };
+}`,
+	}
+	for name, src := range examples {
+		t.Run(name, func(t *testing.T) {
+			d, err := NewJavaScript(writeFormatter(t, src), time.Second, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = d.Decode([]byte{0x00})
+			if err == nil {
+				t.Fatal("expected the data to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package decoder
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type lppType struct {
+	name   string
+	size   int
+	signed bool
+	// scale is the divisor applied to the raw value
+	scale float64
+	// values is the number of values of the type, suffixed with suffixes
+	suffixes []string
+}
+
+// Cayenne LPP data types (IPSO object ID - 3200). Scales usually send the
+// load as an analog input or a generic sensor, its channel is mapped to a
+// mass field in the configuration.
+var lppTypes = map[byte]lppType{
+	0:   {name: "digital_input", size: 1, scale: 1},
+	1:   {name: "digital_output", size: 1, scale: 1},
+	2:   {name: "analog_input", size: 2, signed: true, scale: 100},
+	3:   {name: "analog_output", size: 2, signed: true, scale: 100},
+	100: {name: "generic", size: 4, scale: 1},
+	101: {name: "illuminance", size: 2, scale: 1},
+	102: {name: "presence", size: 1, scale: 1},
+	103: {name: "temperature", size: 2, signed: true, scale: 10},
+	104: {name: "humidity", size: 1, scale: 2},
+	113: {name: "accelerometer", size: 2, signed: true, scale: 1000, suffixes: []string{"x", "y", "z"}},
+	115: {name: "barometer", size: 2, scale: 10},
+	116: {name: "voltage", size: 2, scale: 100},
+	117: {name: "current", size: 2, scale: 1000},
+	120: {name: "percentage", size: 1, scale: 1},
+	134: {name: "gyrometer", size: 2, signed: true, scale: 100, suffixes: []string{"x", "y", "z"}},
+	136: {name: "gps", size: 3, signed: true, suffixes: []string{"lat", "lon", "alt"}},
+}
+
+// LPP decodes Cayenne Low Power Payload frames: a list of channel, type,
+// value triplets. Channels maps a channel number to a field name, unmapped
+// channels are stored as <type>_<channel>.
+type LPP struct {
+	Channels map[byte]string
+}
+
+func (d LPP) Decode(payload []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+
+	for i := 0; i < len(payload); {
+		if i+2 > len(payload) {
+			return nil, fmt.Errorf("truncated LPP header at byte %v", i)
+		}
+		channel := payload[i]
+		t, ok := lppTypes[payload[i+1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown LPP type %v on channel %v", payload[i+1], channel)
+		}
+		i += 2
+
+		count := len(t.suffixes)
+		if count == 0 {
+			count = 1
+		}
+		if i+t.size*count > len(payload) {
+			return nil, fmt.Errorf("truncated LPP value on channel %v", channel)
+		}
+
+		name, ok := d.Channels[channel]
+		if !ok {
+			name = t.name + "_" + strconv.Itoa(int(channel))
+		}
+
+		for n := 0; n < count; n++ {
+			raw := readInt(payload[i:i+t.size], t.signed, false)
+			value := float64(raw) / lppScale(t, n)
+			i += t.size
+
+			if len(t.suffixes) == 0 {
+				values[name] = value
+			} else {
+				values[name+"_"+t.suffixes[n]] = value
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// GPS coordinates are in 0.0001° and the altitude in 0.01m
+func lppScale(t lppType, n int) float64 {
+	if t.scale != 0 {
+		return t.scale
+	}
+	if n < 2 {
+		return 10000
+	}
+	return 100
+}
+
+// readInt reads an integer of 1 to 8 bytes, big endian unless specified
+func readInt(value []byte, signed bool, littleEndian bool) int64 {
+	var res uint64
+	for i := range value {
+		b := value[i]
+		if littleEndian {
+			b = value[len(value)-1-i]
+		}
+		res = res<<8 | uint64(b)
+	}
+	bits := uint(len(value) * 8)
+	if signed && bits < 64 && res&(1<<(bits-1)) != 0 {
+		return int64(res) - int64(1)<<bits
+	}
+	return int64(res)
+}
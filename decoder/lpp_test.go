@@ -0,0 +1,31 @@
+package decoder
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func Test_LPP(t *testing.T) {
+	// Channel 1 temperature 27.2°C, channel 2 humidity 41%, channel 3 analog
+	// input 42.31, channel 4 GPS
+	payload, _ := hex.DecodeString("0167011002685203021087048806765ff2960a0003e8")
+	d := LPP{Channels: map[byte]string{1: "temp", 2: "hum", 3: "mass_r1"}}
+
+	values, err := d.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		"temp":      27.2,
+		"hum":       41,
+		"mass_r1":   42.31,
+		"gps_4_lat": 42.3519,
+		"gps_4_lon": -87.9094,
+		"gps_4_alt": 10,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("%v: expected %v, got %v", name, value, values[name])
+		}
+	}
+}
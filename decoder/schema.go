@@ -0,0 +1,170 @@
+package decoder
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/johnsudaar/ruche/metrics"
+)
+
+const (
+	TypeFloat   = "float"
+	TypeInteger = "integer"
+	TypeBoolean = "boolean"
+	TypeString  = "string"
+)
+
+// Field describes a field produced by a decoder
+type Field struct {
+	Type string   `json:"type"`
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+	// Tag is set for the identifiers sent by the device which are stored as
+	// tags rather than measured, e.g. rucher_id
+	Tag bool `json:"tag,omitempty"`
+}
+
+// Schema lists the fields of a model
+type Schema map[string]Field
+
+// Schemer is implemented by decoders with a fixed set of fields
+type Schemer interface {
+	Schema() Schema
+}
+
+var schemas = map[string]Schema{}
+
+// RegisterSchema sets the schema of a model, it takes precedence over the
+// schema of its decoder
+func RegisterSchema(model string, s Schema) {
+	schemas[model] = s
+}
+
+// SchemaOf returns the schema of a model, false if its fields are not known
+func SchemaOf(model string) (Schema, bool) {
+	if s, ok := schemas[model]; ok {
+		return s, true
+	}
+	d, ok := decoders[model]
+	if !ok {
+		d = decoders[DefaultModel]
+	}
+	if s, ok := d.(Schemer); ok {
+		return s.Schema(), true
+	}
+	return nil, false
+}
+
+// Validate checks values decoded from JSON against the schema and returns the
+// errors indexed by field
+func (s Schema) Validate(values map[string]interface{}) map[string]string {
+	errs := make(map[string]string)
+	for _, name := range sortedNames(values) {
+		field, ok := s[name]
+		if !ok {
+			errs[name] = "unknown field"
+			continue
+		}
+		err := field.validate(values[name])
+		if err != nil {
+			errs[name] = err.Error()
+		}
+	}
+	return errs
+}
+
+func (f Field) validate(value interface{}) error {
+	switch f.Type {
+	case TypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("must be a boolean")
+		}
+		return nil
+	case TypeString:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("must be a string")
+		}
+		return nil
+	}
+
+	number, ok := value.(float64)
+	if !ok {
+		return fmt.Errorf("must be a number")
+	}
+	if f.Type == TypeInteger && number != math.Trunc(number) {
+		return fmt.Errorf("must be an integer")
+	}
+	if f.Min != nil && number < *f.Min {
+		return fmt.Errorf("must be greater than or equal to %v", *f.Min)
+	}
+	if f.Max != nil && number > *f.Max {
+		return fmt.Errorf("must be less than or equal to %v", *f.Max)
+	}
+	return nil
+}
+
+// Coerce converts the numbers to the type of their field so that a field is
+// always written with the same type: float64 for float fields, int64 for
+// integer fields. The other values are left untouched. The numbers which are
+// not whole for an integer field are not rounded, they are returned as errors
+// indexed by field and left untouched.
+func (s Schema) Coerce(values map[string]interface{}) map[string]string {
+	errs := make(map[string]string)
+	for name, value := range values {
+		field, ok := s[name]
+		if !ok {
+			continue
+		}
+		number, ok := metrics.Number(value)
+		if !ok {
+			continue
+		}
+		switch field.Type {
+		case TypeFloat:
+			values[name] = number
+		case TypeInteger:
+			if number != math.Trunc(number) {
+				errs[name] = "must be an integer"
+				continue
+			}
+			values[name] = int64(number)
+		}
+	}
+	return errs
+}
+
+// check returns an error if a field of the schema has an unknown type
+func (s Schema) check() error {
+	for _, name := range sortedFields(s) {
+		switch s[name].Type {
+		case TypeFloat, TypeInteger, TypeBoolean, TypeString:
+		default:
+			return fmt.Errorf("field %v has an unknown type %q, expected %v, %v, %v or %v",
+				name, s[name].Type, TypeFloat, TypeInteger, TypeBoolean, TypeString)
+		}
+	}
+	return nil
+}
+
+func sortedNames(values map[string]interface{}) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedFields(s Schema) []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func between(min, max float64) Field {
+	return Field{Type: TypeFloat, Min: &min, Max: &max}
+}
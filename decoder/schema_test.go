@@ -0,0 +1,88 @@
+package decoder
+
+import (
+	"testing"
+)
+
+func Test_SchemaValidate(t *testing.T) {
+	errs := Hive{}.Schema().Validate(map[string]interface{}{
+		"temp":      21.5,
+		"hum":       120.0,
+		"rucher_id": 1.5,
+		"mass_r1":   "heavy",
+		"weight":    12.0,
+	})
+
+	expected := []string{"hum", "rucher_id", "mass_r1", "weight"}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected errors %+v", errs)
+	}
+	for _, name := range expected {
+		if _, ok := errs[name]; !ok {
+			t.Errorf("expected an error on %v", name)
+		}
+	}
+}
+
+func Test_SchemaCoerce(t *testing.T) {
+	values := map[string]interface{}{
+		"rucher_id": uint8(3),
+		"lum":       120,
+		"mass_r1":   12.5,
+		"other":     uint8(1),
+	}
+	errs := Hive{}.Schema().Coerce(values)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+
+	if v, ok := values["rucher_id"].(int64); !ok || v != 3 {
+		t.Errorf("expected rucher_id to be an int64, got %T", values["rucher_id"])
+	}
+	if v, ok := values["lum"].(float64); !ok || v != 120 {
+		t.Errorf("expected lum to be a float64, got %T", values["lum"])
+	}
+	if _, ok := values["other"].(uint8); !ok {
+		t.Errorf("expected fields outside of the schema to be untouched, got %T", values["other"])
+	}
+}
+
+func Test_SchemaCoerceNotWhole(t *testing.T) {
+	values := map[string]interface{}{"rucher_id": 2.5, "temp": 21}
+	errs := Hive{}.Schema().Coerce(values)
+
+	// The value is reported rather than rounded
+	if len(errs) != 1 || errs["rucher_id"] == "" {
+		t.Fatalf("expected an error on rucher_id, got %v", errs)
+	}
+	if values["rucher_id"] != 2.5 {
+		t.Fatalf("expected rucher_id to be untouched, got %v", values["rucher_id"])
+	}
+	if values["temp"] != 21.0 {
+		t.Fatalf("expected temp to be coerced, got %T", values["temp"])
+	}
+}
+
+func Test_SchemaDecoders(t *testing.T) {
+	for name, d := range map[string]Decoder{"sound": DefaultSound, "brood": Brood{}} {
+		var payload []byte
+		switch name {
+		case "sound":
+			payload = []byte{10, 12, 30, 5, 2, 9, 40, 8}
+		case "brood":
+			payload = []byte{4, 0x88, 0x0d, 0x10, 0x0e, 0x2a, 0x0e, 0x88, 0x0d}
+		}
+		values, err := d.Decode(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := d.(Schemer).Schema().Validate(values); len(errs) > 0 {
+			t.Errorf("%v: decoded values do not match the schema: %v", name, errs)
+		}
+	}
+
+	schema := DefaultSound.Schema()
+	if _, ok := schema["band_100_162"]; !ok || len(schema) != 10 {
+		t.Fatalf("unexpected sound schema %v", schema)
+	}
+}
@@ -0,0 +1,120 @@
+package decoder
+
+import (
+	"fmt"
+)
+
+const MeasurementSound = "sound"
+
+// Sound decodes the frames of the acoustic sensor: the energy of Bins
+// frequency bands evenly spread between MinFreq and MaxFreq, on BytesPerBand
+// little endian bytes each. The piping ratio is the energy in the piping
+// range over the energy in the colony hum range, a high ratio is a sign of
+// queen loss or of swarming preparation.
+type Sound struct {
+	MinFreq         float64
+	MaxFreq         float64
+	Bins            int
+	BytesPerBand    int
+	Scale           float64
+	PipingRange     [2]float64
+	HumRange        [2]float64
+	PipingThreshold float64
+}
+
+// DefaultSound is the 8 bands 100-600Hz microphone of the research hives
+var DefaultSound = Sound{
+	MinFreq:         100,
+	MaxFreq:         600,
+	Bins:            8,
+	BytesPerBand:    1,
+	Scale:           1,
+	PipingRange:     [2]float64{400, 600},
+	HumRange:        [2]float64{100, 300},
+	PipingThreshold: 1.5,
+}
+
+// validate checks the bands, and that the piping and hum ranges are within
+// them
+func (d Sound) validate() error {
+	if d.Bins <= 0 {
+		return fmt.Errorf("bins must be positive, got %v", d.Bins)
+	}
+	if d.MinFreq < 0 || d.MaxFreq <= d.MinFreq {
+		return fmt.Errorf("invalid frequencies %v-%vHz", d.MinFreq, d.MaxFreq)
+	}
+	if d.BytesPerBand <= 0 || d.BytesPerBand > 8 {
+		return fmt.Errorf("bytes_per_band must be between 1 and 8, got %v", d.BytesPerBand)
+	}
+	ranges := map[string][2]float64{"piping_range": d.PipingRange, "hum_range": d.HumRange}
+	for name, r := range ranges {
+		if r[1] <= r[0] || r[0] < d.MinFreq || r[1] > d.MaxFreq {
+			return fmt.Errorf("%v %v-%vHz is not within %v-%vHz", name, r[0], r[1], d.MinFreq, d.MaxFreq)
+		}
+	}
+	return nil
+}
+
+func (d Sound) Measurement() string {
+	return MeasurementSound
+}
+
+func (d Sound) Schema() Schema {
+	zero := 0.0
+	positive := Field{Type: TypeFloat, Min: &zero}
+	schema := Schema{
+		"piping_ratio": positive,
+		"queen_loss":   {Type: TypeBoolean},
+	}
+	for i := 0; i < d.Bins; i++ {
+		schema[d.band(i)] = positive
+	}
+	return schema
+}
+
+func (d Sound) Decode(payload []byte) (map[string]interface{}, error) {
+	if d.Bins <= 0 || d.BytesPerBand <= 0 || d.BytesPerBand > 8 {
+		return nil, fmt.Errorf("invalid sound decoder: %v bins of %v bytes", d.Bins, d.BytesPerBand)
+	}
+	if len(payload) < d.Bins*d.BytesPerBand {
+		return nil, fmt.Errorf("payload too short: %v bytes, expected %v", len(payload), d.Bins*d.BytesPerBand)
+	}
+
+	values := make(map[string]interface{})
+	var piping, hum float64
+	for i := 0; i < d.Bins; i++ {
+		raw := readInt(payload[i*d.BytesPerBand:(i+1)*d.BytesPerBand], false, true)
+		energy := float64(raw) * d.Scale
+		values[d.band(i)] = energy
+
+		low, high := d.bounds(i)
+		center := (low + high) / 2
+		if center >= d.PipingRange[0] && center < d.PipingRange[1] {
+			piping += energy
+		}
+		if center >= d.HumRange[0] && center < d.HumRange[1] {
+			hum += energy
+		}
+	}
+
+	if hum > 0 {
+		ratio := piping / hum
+		values["piping_ratio"] = ratio
+		values["queen_loss"] = d.PipingThreshold > 0 && ratio >= d.PipingThreshold
+	}
+
+	return values, nil
+}
+
+// bounds returns the frequency range of the band i
+func (d Sound) bounds(i int) (float64, float64) {
+	width := (d.MaxFreq - d.MinFreq) / float64(d.Bins)
+	low := d.MinFreq + float64(i)*width
+	return low, low + width
+}
+
+// band returns the field of the energy of the band i
+func (d Sound) band(i int) string {
+	low, high := d.bounds(i)
+	return fmt.Sprintf("band_%d_%d", int(low), int(high))
+}
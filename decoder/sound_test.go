@@ -0,0 +1,47 @@
+package decoder
+
+import (
+	"testing"
+)
+
+func Test_Sound(t *testing.T) {
+	values, err := DefaultSound.Decode([]byte{10, 10, 10, 10, 5, 5, 30, 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if values["band_100_162"] != 10.0 || values["band_537_600"] != 30.0 {
+		t.Fatalf("unexpected bands %+v", values)
+	}
+	// Piping range: 5 + 30 + 30, hum range: 10 + 10 + 10
+	if values["piping_ratio"] != 65.0/30.0 || values["queen_loss"] != true {
+		t.Fatalf("unexpected indicator %v %v", values["piping_ratio"], values["queen_loss"])
+	}
+}
+
+func Test_SoundConfig(t *testing.T) {
+	examples := map[string]struct {
+		Config SoundConfig
+		Valid  bool
+	}{
+		"default":        {Config: SoundConfig{}, Valid: true},
+		"custom bands":   {Config: SoundConfig{Bins: 16, MinFreq: 100, MaxFreq: 900, PipingRange: [2]float64{400, 700}}, Valid: true},
+		"no bins":        {Config: SoundConfig{MinFreq: 100, MaxFreq: 600}},
+		"negative bins":  {Config: SoundConfig{Bins: -8, MinFreq: 100, MaxFreq: 600}},
+		"inverted bands": {Config: SoundConfig{Bins: 8, MinFreq: 600, MaxFreq: 100}},
+		"inverted range": {Config: SoundConfig{PipingRange: [2]float64{600, 400}}},
+		"range outside":  {Config: SoundConfig{HumRange: [2]float64{50, 300}}},
+		"too many bytes": {Config: SoundConfig{BytesPerBand: 9}},
+	}
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			_, err := example.Config.decoder()
+			if example.Valid && err != nil {
+				t.Fatal(err)
+			}
+			if !example.Valid && err == nil {
+				t.Fatal("expected the settings to be rejected")
+			}
+		})
+	}
+}
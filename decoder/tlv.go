@@ -0,0 +1,49 @@
+package decoder
+
+import (
+	"fmt"
+)
+
+// TLVField describes how the value of a TLV type is converted into a field
+type TLVField struct {
+	Name   string  `json:"name"`
+	Signed bool    `json:"signed"`
+	Scale  float64 `json:"scale"`
+}
+
+// TLV decodes generic type, length, value frames. The length is the number
+// of bytes of the value, unknown types are stored as type_<id>.
+type TLV struct {
+	Types        map[byte]TLVField
+	LittleEndian bool
+}
+
+func (d TLV) Decode(payload []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+
+	for i := 0; i < len(payload); {
+		if i+2 > len(payload) {
+			return nil, fmt.Errorf("truncated TLV header at byte %v", i)
+		}
+		id := payload[i]
+		length := int(payload[i+1])
+		i += 2
+		if length == 0 || length > 8 || i+length > len(payload) {
+			return nil, fmt.Errorf("invalid TLV length %v for type %v", length, id)
+		}
+
+		field, ok := d.Types[id]
+		if !ok {
+			field = TLVField{Name: fmt.Sprintf("type_%v", id)}
+		}
+		scale := field.Scale
+		if scale == 0 {
+			scale = 1
+		}
+
+		values[field.Name] = float64(readInt(payload[i:i+length], field.Signed, d.LittleEndian)) * scale
+		i += length
+	}
+
+	return values, nil
+}
@@ -0,0 +1,260 @@
+package downlink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CommandSetInterval = "set_interval"
+	CommandSetSensor   = "set_sensor"
+	CommandTare        = "tare"
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusSent      Status = "sent"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+var ErrNotFound = errors.New("downlink not found")
+
+// SaveError is returned when the queue has changed but could not be saved in
+// its state file
+type SaveError struct {
+	err error
+}
+
+func (e *SaveError) Error() string {
+	return "fail to save downlink queue: " + e.err.Error()
+}
+
+// Command is a configuration change sent to a device
+type Command struct {
+	Type string `json:"type"`
+	// Interval is the sampling interval in minutes (set_interval)
+	Interval int `json:"interval,omitempty"`
+	// Sensor is the field of the sensor targeted by set_sensor and tare, an
+	// empty sensor on tare means every scale
+	Sensor  string `json:"sensor,omitempty"`
+	Enabled bool   `json:"enabled,omitempty"`
+}
+
+func (c Command) Validate() error {
+	switch c.Type {
+	case CommandSetInterval:
+		if c.Interval <= 0 || c.Interval > 0xffff {
+			return fmt.Errorf("invalid interval %v", c.Interval)
+		}
+	case CommandSetSensor:
+		if c.Sensor == "" {
+			return errors.New("sensor is required")
+		}
+	case CommandTare:
+	default:
+		return fmt.Errorf("unknown command type %q", c.Type)
+	}
+	return nil
+}
+
+type Downlink struct {
+	ID          int        `json:"id"`
+	Device      string     `json:"device"`
+	Command     Command    `json:"command"`
+	Status      Status     `json:"status"`
+	Data        string     `json:"data,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Queue keeps the downlinks of every device in memory, and in a state file if
+// opened with Open. Downlinks are sent one at a time, oldest first, and a sent
+// downlink is considered delivered when the next uplink of the device is
+// received.
+type Queue struct {
+	lock      sync.Mutex
+	lastID    int
+	downlinks map[string][]*Downlink
+	// path of the state file, empty if the queue is only kept in memory
+	path string
+}
+
+type state struct {
+	LastID    int         `json:"last_id"`
+	Downlinks []*Downlink `json:"downlinks"`
+}
+
+func NewQueue() *Queue {
+	return &Queue{
+		downlinks: make(map[string][]*Downlink),
+	}
+}
+
+// Open loads the queue saved in the state file, every change of the queue is
+// then saved in this file
+func Open(path string) (*Queue, error) {
+	q := NewQueue()
+	q.path = path
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to read state file")
+	}
+	var s state
+	err = json.Unmarshal(content, &s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid state file")
+	}
+	q.lastID = s.LastID
+	for _, d := range s.Downlinks {
+		q.downlinks[d.Device] = append(q.downlinks[d.Device], d)
+	}
+	return q, nil
+}
+
+func (q *Queue) Push(device string, cmd Command) (Downlink, error) {
+	err := cmd.Validate()
+	if err != nil {
+		return Downlink{}, errors.Wrap(err, "invalid command")
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.lastID++
+	d := &Downlink{
+		ID:        q.lastID,
+		Device:    device,
+		Command:   cmd,
+		Status:    StatusPending,
+		CreatedAt: time.Now(),
+	}
+	q.downlinks[device] = append(q.downlinks[device], d)
+	return *d, q.save()
+}
+
+func (q *Queue) List(device string) []Downlink {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	res := make([]Downlink, 0, len(q.downlinks[device]))
+	for _, d := range q.downlinks[device] {
+		res = append(res, *d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Cancel cancels a downlink which has not been sent yet
+func (q *Queue) Cancel(device string, id int) (Downlink, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, d := range q.downlinks[device] {
+		if d.ID != id {
+			continue
+		}
+		if d.Status != StatusPending {
+			return *d, fmt.Errorf("downlink is %v", d.Status)
+		}
+		d.Status = StatusCancelled
+		return *d, q.save()
+	}
+	return Downlink{}, ErrNotFound
+}
+
+// Confirm marks the sent downlinks of the device as delivered
+func (q *Queue) Confirm(device string, at time.Time) ([]Downlink, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var res []Downlink
+	for _, d := range q.downlinks[device] {
+		if d.Status != StatusSent {
+			continue
+		}
+		d.Status = StatusDelivered
+		d.DeliveredAt = &at
+		res = append(res, *d)
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res, q.save()
+}
+
+// Send takes the oldest pending downlink of the device and encodes it. It
+// returns nil if there is nothing to send.
+func (q *Queue) Send(device string, encode func(Command) ([]byte, error)) (*Downlink, []byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, d := range q.downlinks[device] {
+		if d.Status != StatusPending {
+			continue
+		}
+		data, err := encode(d.Command)
+		if err != nil {
+			d.Status = StatusFailed
+			d.Error = err.Error()
+			saveErr := q.save()
+			if saveErr != nil {
+				return nil, nil, saveErr
+			}
+			return nil, nil, errors.Wrapf(err, "fail to encode downlink %v", d.ID)
+		}
+		now := time.Now()
+		d.Status = StatusSent
+		d.SentAt = &now
+		d.Data = fmt.Sprintf("%x", data)
+		// A downlink which could not be saved as sent would be sent again
+		// after a restart
+		err = q.save()
+		if err != nil {
+			return nil, nil, err
+		}
+		res := *d
+		return &res, data, nil
+	}
+	return nil, nil, nil
+}
+
+// save replaces the state file atomically, the lock must be held
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	s := state{LastID: q.lastID, Downlinks: []*Downlink{}}
+	for _, downlinks := range q.downlinks {
+		s.Downlinks = append(s.Downlinks, downlinks...)
+	}
+	sort.Slice(s.Downlinks, func(i, j int) bool { return s.Downlinks[i].ID < s.Downlinks[j].ID })
+	content, err := json.Marshal(s)
+	if err != nil {
+		return &SaveError{err: err}
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", q.path, time.Now().UnixNano())
+	err = os.WriteFile(tmp, content, 0640)
+	if err == nil {
+		err = os.Rename(tmp, q.path)
+	}
+	if err != nil {
+		return &SaveError{err: err}
+	}
+	return nil
+}
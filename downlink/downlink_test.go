@@ -0,0 +1,134 @@
+package downlink
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func encode(cmd Command) ([]byte, error) {
+	return []byte(cmd.Type), nil
+}
+
+func Test_Queue(t *testing.T) {
+	q := NewQueue()
+
+	_, err := q.Push("dev", Command{Type: "reboot"})
+	if err == nil {
+		t.Fatal("expected an invalid command error")
+	}
+	first, err := q.Push("dev", Command{Type: CommandSetInterval, Interval: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := q.Push("dev", Command{Type: CommandTare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := q.Push("dev", Command{Type: CommandSetSensor, Sensor: "mass_r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != StatusPending || second.ID != first.ID+1 {
+		t.Fatalf("unexpected downlinks: %+v %+v", first, second)
+	}
+
+	cancelled, err := q.Cancel("dev", third.ID)
+	if err != nil || cancelled.Status != StatusCancelled {
+		t.Fatalf("expected a cancelled downlink, got %+v %v", cancelled, err)
+	}
+	_, err = q.Cancel("dev", 42)
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// Downlinks are sent one at a time, oldest first
+	d, data, err := q.Send("dev", encode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.ID != first.ID || d.Status != StatusSent || d.SentAt == nil || string(data) != CommandSetInterval {
+		t.Fatalf("expected the first downlink to be sent, got %+v %q", d, data)
+	}
+	_, err = q.Cancel("dev", first.ID)
+	if err == nil {
+		t.Fatal("expected a sent downlink not to be cancellable")
+	}
+
+	delivered, err := q.Confirm("dev", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 || delivered[0].ID != first.ID || delivered[0].Status != StatusDelivered {
+		t.Fatalf("expected the first downlink to be delivered, got %+v", delivered)
+	}
+
+	_, _, err = q.Send("dev", func(Command) ([]byte, error) { return nil, errors.New("unsupported") })
+	if err == nil {
+		t.Fatal("expected an encoding error")
+	}
+	d, _, err = q.Send("dev", encode)
+	if err != nil || d != nil {
+		t.Fatalf("expected nothing to send, got %+v %v", d, err)
+	}
+
+	statuses := []Status{}
+	for _, d := range q.List("dev") {
+		statuses = append(statuses, d.Status)
+	}
+	expected := []Status{StatusDelivered, StatusFailed, StatusCancelled}
+	if len(statuses) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, statuses)
+	}
+	for i := range expected {
+		if statuses[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, statuses)
+		}
+	}
+}
+
+func Test_Open(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "downlinks.json")
+	q, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := q.Push("dev", Command{Type: CommandTare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.Push("dev", Command{Type: CommandSetInterval, Interval: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = q.Send("dev", encode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sent downlink is not sent again after a restart, and the ids keep
+	// increasing
+	q, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downlinks := q.List("dev")
+	if len(downlinks) != 2 || downlinks[0].ID != first.ID || downlinks[0].Status != StatusSent || downlinks[1].Status != StatusPending {
+		t.Fatalf("unexpected downlinks after restart: %+v", downlinks)
+	}
+	third, err := q.Push("dev", Command{Type: CommandTare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.ID != first.ID+2 {
+		t.Fatalf("expected id %v, got %v", first.ID+2, third.ID)
+	}
+	d, _, err := q.Send("dev", encode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.ID != downlinks[1].ID {
+		t.Fatalf("expected the pending downlink to be sent, got %+v", d)
+	}
+}
@@ -0,0 +1,111 @@
+package event
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeRestart    = "restart"
+	TypeBoot       = "boot"
+	TypeLowBattery = "low_battery"
+	TypeFirmware   = "firmware"
+	TypeMessage    = "message"
+)
+
+// Event is a non-measurement frame sent by a device
+type Event struct {
+	Type    string
+	Message string
+	// Detail is the boot reason or the firmware version
+	Detail string
+}
+
+// Classify returns the event sent in an ASCII payload. It returns false if the
+// payload is not printable text, in which case it is a measurement frame.
+func Classify(payload []byte) (Event, bool) {
+	if len(payload) == 0 {
+		return Event{}, false
+	}
+	for _, b := range payload {
+		if b < 0x20 || b > 0x7e {
+			return Event{}, false
+		}
+	}
+
+	msg := strings.TrimSpace(string(payload))
+	ev := Event{Type: TypeMessage, Message: msg}
+	lower := strings.ToLower(msg)
+
+	switch {
+	case lower == "restart" || lower == "reboot":
+		ev.Type = TypeRestart
+	case strings.HasPrefix(lower, "boot"):
+		ev.Type = TypeBoot
+		ev.Detail = detail(msg, len("boot"))
+	case strings.HasPrefix(lower, "lowbat") || strings.HasPrefix(lower, "low bat"):
+		ev.Type = TypeLowBattery
+	case strings.HasPrefix(lower, "fw"):
+		ev.Type = TypeFirmware
+		ev.Detail = detail(msg, len("fw"))
+	case strings.HasPrefix(lower, "version"):
+		ev.Type = TypeFirmware
+		ev.Detail = detail(msg, len("version"))
+	}
+	return ev, true
+}
+
+// IsReboot is true for the events sent by a device when it starts
+func (e Event) IsReboot() bool {
+	return e.Type == TypeRestart || e.Type == TypeBoot
+}
+
+func detail(msg string, prefix int) string {
+	return strings.Trim(msg[prefix:], " :=-")
+}
+
+// Tracker counts the events of every device and remembers the recent reboots
+type Tracker struct {
+	window  time.Duration
+	lock    sync.Mutex
+	counts  map[string]map[string]uint64
+	reboots map[string][]time.Time
+}
+
+func NewTracker(window time.Duration) *Tracker {
+	return &Tracker{
+		window:  window,
+		counts:  make(map[string]map[string]uint64),
+		reboots: make(map[string][]time.Time),
+	}
+}
+
+// Record returns the number of events of this type received from the device
+// and the number of reboots within the window
+func (t *Tracker) Record(device string, ev Event, at time.Time) (uint64, int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	counts, ok := t.counts[device]
+	if !ok {
+		counts = make(map[string]uint64)
+		t.counts[device] = counts
+	}
+	counts[ev.Type]++
+
+	if !ev.IsReboot() {
+		return counts[ev.Type], 0
+	}
+
+	reboots := []time.Time{}
+	for _, r := range t.reboots[device] {
+		if at.Sub(r) < t.window {
+			reboots = append(reboots, r)
+		}
+	}
+	reboots = append(reboots, at)
+	t.reboots[device] = reboots
+
+	return counts[ev.Type], len(reboots)
+}
@@ -0,0 +1,40 @@
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Classify(t *testing.T) {
+	cases := map[string]Event{
+		"Restart":     {Type: TypeRestart, Message: "Restart"},
+		"Boot:WDT":    {Type: TypeBoot, Message: "Boot:WDT", Detail: "WDT"},
+		"LowBat":      {Type: TypeLowBattery, Message: "LowBat"},
+		"FW 1.2.0":    {Type: TypeFirmware, Message: "FW 1.2.0", Detail: "1.2.0"},
+		"Hello queen": {Type: TypeMessage, Message: "Hello queen"},
+	}
+	for payload, expected := range cases {
+		ev, ok := Classify([]byte(payload))
+		if !ok || ev != expected {
+			t.Errorf("%q: expected %+v, got %+v", payload, expected, ev)
+		}
+	}
+
+	_, ok := Classify([]byte{0x00, 0x20, 0x08})
+	if ok {
+		t.Error("binary payload classified as an event")
+	}
+}
+
+func Test_TrackerReboots(t *testing.T) {
+	tracker := NewTracker(time.Hour)
+	now := time.Now()
+	restart := Event{Type: TypeRestart}
+
+	tracker.Record("dev", restart, now.Add(-2*time.Hour))
+	tracker.Record("dev", restart, now.Add(-30*time.Minute))
+	count, reboots := tracker.Record("dev", restart, now)
+	if count != 3 || reboots != 2 {
+		t.Fatalf("expected 3 restarts and 2 recent reboots, got %v and %v", count, reboots)
+	}
+}
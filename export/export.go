@@ -0,0 +1,384 @@
+package export
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/downlink"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/step"
+	"github.com/pkg/errors"
+)
+
+const (
+	measurementEvents = "device_events"
+	measurementAlerts = "alerts"
+)
+
+var (
+	ErrUnknownApiary = errors.New("unknown apiary")
+	ErrUnknownDevice = errors.New("unknown device")
+)
+
+// Manifest describes the content of a bundle
+type Manifest struct {
+	Apiary registry.Apiary `json:"apiary"`
+	// Device is set for the bundle of a hive
+	Device      *registry.Device `json:"device,omitempty"`
+	From        time.Time        `json:"from"`
+	To          time.Time        `json:"to"`
+	GeneratedAt time.Time        `json:"generated_at"`
+	// Files are the CSV files with their number of rows
+	Files map[string]int `json:"files"`
+	// Unavailable lists the data which could not be exported. The inspection
+	// notes are never available, they are not recorded: notes.csv only holds
+	// the classification of the weight steps.
+	Unavailable []string `json:"unavailable,omitempty"`
+}
+
+// Bundle writes a ZIP with the data of an apiary between from and to:
+//
+//	manifest.json
+//	devices.json        the apiary and its devices from the registry
+//	readings/<m>.csv    the readings and the derived data of every measurement
+//	events.csv          the non-measurement frames of the devices
+//	alerts.csv
+//	notes.csv           the weight steps classified by the beekeeper
+//	calibration.csv     the tare commands sent to the scales
+//
+// The readings are those tagged with the apiary and those of its devices sent
+// without apiary, including the relay devices forwarding the apiary. The
+// calibration history is kept by the downlink queue of the running server,
+// it is unavailable if downlinks is nil.
+func Bundle(ctx context.Context, w io.Writer, apiaryID string, from, to time.Time, downlinks *downlink.Queue) (Manifest, error) {
+	apiary, ok := registry.Get().Apiary(apiaryID)
+	if !ok {
+		return Manifest{}, ErrUnknownApiary
+	}
+	var devices []registry.Device
+	for _, d := range registry.Get().Devices {
+		if d.Apiary == apiaryID || mapsTo(d, apiaryID) {
+			devices = append(devices, d)
+		}
+	}
+
+	manifest := Manifest{Apiary: apiary}
+	log := logger.Get(ctx).WithField("apiary", apiaryID)
+	return bundle(logger.ToCtx(ctx, log), w, manifest, devices, filter(apiaryID, devices), from, to, downlinks)
+}
+
+// BundleDevice writes the same ZIP as Bundle with the data of a single
+// device, the readings are those tagged with its stream ID
+func BundleDevice(ctx context.Context, w io.Writer, streamID string, from, to time.Time, downlinks *downlink.Queue) (Manifest, error) {
+	device, ok := registry.Get().Device(streamID)
+	if !ok {
+		return Manifest{}, ErrUnknownDevice
+	}
+	apiary, _ := registry.Get().Apiary(device.Apiary)
+
+	redacted := redact([]registry.Device{device})[0]
+	manifest := Manifest{Apiary: apiary, Device: &redacted}
+	log := logger.Get(ctx).WithField("stream_id", streamID)
+	condition := `"stream_id" = ` + influx.Quote(streamID)
+	return bundle(logger.ToCtx(ctx, log), w, manifest, []registry.Device{device}, condition, from, to, downlinks)
+}
+
+// bundle writes the data of the devices, the readings are selected by the
+// condition
+func bundle(ctx context.Context, w io.Writer, manifest Manifest, devices []registry.Device, condition string, from, to time.Time, downlinks *downlink.Queue) (Manifest, error) {
+	log := logger.Get(ctx)
+	config := config.Get()
+
+	manifest.From = from
+	manifest.To = to
+	manifest.GeneratedAt = time.Now()
+	manifest.Files = make(map[string]int)
+	manifest.Unavailable = []string{"inspection_notes"}
+
+	results, err := influx.Query(config.InfluxUrl, "SHOW MEASUREMENTS")
+	if err != nil {
+		return manifest, errors.Wrap(err, "fail to list measurements")
+	}
+	var measurements []string
+	for _, result := range results {
+		for _, serie := range result.Series {
+			for _, values := range serie.Values {
+				measurements = append(measurements, fmt.Sprint(values[0]))
+			}
+		}
+	}
+	sort.Strings(measurements)
+
+	archive := zip.NewWriter(w)
+	for _, measurement := range measurements {
+		name := "readings/" + measurement + ".csv"
+		switch measurement {
+		case measurementEvents:
+			name = "events.csv"
+		case measurementAlerts:
+			name = "alerts.csv"
+		}
+
+		rows, err := writeMeasurement(archive, name, config.InfluxUrl, measurement, condition, from, to)
+		if err != nil {
+			return manifest, errors.Wrapf(err, "fail to export %v", measurement)
+		}
+		if rows > 0 {
+			manifest.Files[name] = rows
+		}
+	}
+
+	notes, err := stepNotes(devices, from, to)
+	if err != nil {
+		return manifest, errors.Wrap(err, "fail to list notes")
+	}
+	err = writeRecords(archive, "notes.csv", []string{"time", "stream_id", "hive", "type", "magnitude"}, notes)
+	if err != nil {
+		return manifest, errors.Wrap(err, "fail to write notes")
+	}
+	manifest.Files["notes.csv"] = len(notes)
+
+	if downlinks == nil {
+		manifest.Unavailable = append(manifest.Unavailable, "calibration_history")
+	} else {
+		calibrations := tareCommands(downlinks, devices, from, to)
+		err = writeRecords(archive, "calibration.csv", []string{"created_at", "stream_id", "hive", "sensor", "status", "sent_at", "delivered_at"}, calibrations)
+		if err != nil {
+			return manifest, errors.Wrap(err, "fail to write calibration history")
+		}
+		manifest.Files["calibration.csv"] = len(calibrations)
+	}
+
+	err = writeJSON(archive, "devices.json", map[string]interface{}{
+		"apiary":  manifest.Apiary,
+		"devices": redact(devices),
+	})
+	if err != nil {
+		return manifest, errors.Wrap(err, "fail to write devices")
+	}
+	err = writeJSON(archive, "manifest.json", manifest)
+	if err != nil {
+		return manifest, errors.Wrap(err, "fail to write manifest")
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return manifest, errors.Wrap(err, "fail to close zip")
+	}
+	log.WithField("files", len(manifest.Files)).Info("Export bundle written")
+	return manifest, nil
+}
+
+// stepNotes returns the steps classified by the beekeeper, the only notes
+// recorded on the hives
+func stepNotes(devices []registry.Device, from, to time.Time) ([][]string, error) {
+	var notes [][]string
+	for _, d := range devices {
+		events, err := step.List(d.StreamID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			if e.Type == "" {
+				continue
+			}
+			notes = append(notes, []string{
+				e.Time.UTC().Format(time.RFC3339), d.StreamID, d.Hive, e.Type, formatValue(e.Magnitude),
+			})
+		}
+	}
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i][0] < notes[j][0] })
+	return notes, nil
+}
+
+// tareCommands returns the tare commands created during the period
+func tareCommands(downlinks *downlink.Queue, devices []registry.Device, from, to time.Time) [][]string {
+	var commands [][]string
+	for _, d := range devices {
+		for _, l := range downlinks.List(d.StreamID) {
+			if l.Command.Type != downlink.CommandTare || l.CreatedAt.Before(from) || l.CreatedAt.After(to) {
+				continue
+			}
+			commands = append(commands, []string{
+				formatTime(&l.CreatedAt), d.StreamID, d.Hive, l.Command.Sensor, string(l.Status), formatTime(l.SentAt), formatTime(l.DeliveredAt),
+			})
+		}
+	}
+	sort.SliceStable(commands, func(i, j int) bool { return commands[i][0] < commands[j][0] })
+	return commands
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func mapsTo(d registry.Device, apiaryID string) bool {
+	for _, id := range d.RucherIDs {
+		if id == apiaryID {
+			return true
+		}
+	}
+	return false
+}
+
+// redact removes the device tokens
+func redact(devices []registry.Device) []registry.Device {
+	redacted := make([]registry.Device, 0, len(devices))
+	for _, d := range devices {
+		d.Token = ""
+		redacted = append(redacted, d)
+	}
+	return redacted
+}
+
+func filter(apiaryID string, devices []registry.Device) string {
+	condition := `"apiary" = ` + influx.Quote(apiaryID)
+	var streams []string
+	for _, d := range devices {
+		streams = append(streams, `"stream_id" = `+influx.Quote(d.StreamID))
+	}
+	if len(streams) > 0 {
+		condition = fmt.Sprintf(`(%s OR ("apiary" = '' AND (%s)))`, condition, strings.Join(streams, " OR "))
+	}
+	return condition
+}
+
+// writeMeasurement writes the rows of a measurement with their time, the tags
+// then the fields. The rows are queried one month at a time and written as
+// they come, sorted by time. The file is only created if there are rows.
+func writeMeasurement(archive *zip.Writer, name, influxURL, measurement, condition string, from, to time.Time) (int, error) {
+	tagRows, err := influx.QueryRows(influxURL, "SHOW TAG KEYS FROM "+influx.QuoteIdent(measurement))
+	if err != nil {
+		return 0, errors.Wrap(err, "fail to list tags")
+	}
+	tagSet := make(map[string]bool)
+	for _, row := range tagRows {
+		tagSet[fmt.Sprint(row.Values["tagKey"])] = true
+	}
+	fieldTypes, err := influx.FieldTypes(influxURL, measurement)
+	if err != nil {
+		return 0, errors.Wrap(err, "fail to list fields")
+	}
+	fieldSet := make(map[string]bool)
+	for field := range fieldTypes {
+		fieldSet[field] = true
+	}
+	tags := sortedKeys(tagSet)
+	fields := sortedKeys(fieldSet)
+
+	var w *csv.Writer
+	count := 0
+	for start := from; ; {
+		end := start.AddDate(0, 1, 0)
+		last := !end.Before(to)
+		bound := "<"
+		if last {
+			end, bound = to, "<="
+		}
+		rows, err := influx.QueryRows(influxURL, fmt.Sprintf(
+			`SELECT * FROM %s WHERE %s AND time >= %s AND time %s %s GROUP BY *`,
+			influx.QuoteIdent(measurement), condition, influx.Time(start), bound, influx.Time(end),
+		))
+		if err != nil {
+			return count, errors.Wrap(err, "fail to query rows")
+		}
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].Time.Before(rows[j].Time) })
+
+		if w == nil && len(rows) > 0 {
+			f, err := archive.Create(name)
+			if err != nil {
+				return count, err
+			}
+			w = csv.NewWriter(f)
+			err = w.Write(append(append([]string{"time"}, tags...), fields...))
+			if err != nil {
+				return count, err
+			}
+		}
+		for _, row := range rows {
+			record := []string{row.Time.UTC().Format(time.RFC3339)}
+			for _, tag := range tags {
+				record = append(record, row.Tags[tag])
+			}
+			for _, field := range fields {
+				record = append(record, formatValue(row.Values[field]))
+			}
+			err = w.Write(record)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+		if w != nil {
+			w.Flush()
+			if err := w.Error(); err != nil {
+				return count, err
+			}
+		}
+
+		if last {
+			return count, nil
+		}
+		start = end
+	}
+}
+
+func writeRecords(archive *zip.Writer, name string, header []string, records [][]string) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	err = w.Write(header)
+	if err != nil {
+		return err
+	}
+	err = w.WriteAll(records)
+	if err != nil {
+		return err
+	}
+	return w.Error()
+}
+
+func writeJSON(archive *zip.Writer, name string, v interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func formatValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if f, ok := influx.Float(value); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,232 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/config/configtest"
+	"github.com/johnsudaar/ruche/downlink"
+	"github.com/johnsudaar/ruche/influx/influxtest"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+)
+
+func Test_Bundle(t *testing.T) {
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		switch {
+		case q == "SHOW MEASUREMENTS":
+			return []influxtest.Serie{{Name: "measurements", Columns: []string{"name"}, Values: [][]interface{}{{"raw"}, {"device_events"}}}}
+		case q == `SHOW TAG KEYS FROM "raw"`:
+			return []influxtest.Serie{{Name: "raw", Columns: []string{"tagKey"}, Values: [][]interface{}{{"stream_id"}}}}
+		case q == `SHOW FIELD KEYS FROM "raw"`:
+			return []influxtest.Serie{{Name: "raw", Columns: []string{"fieldKey", "fieldType"}, Values: [][]interface{}{{"temp", "float"}, {"hum", "float"}}}}
+		case strings.HasPrefix(q, `SELECT * FROM "raw"`) && strings.Contains(q, "time >= '2022-05-01T00:00:00Z'"):
+			return []influxtest.Serie{{Name: "raw", Tags: map[string]string{"stream_id": "1A2B3C"}, Columns: []string{"time", "temp", "hum"}, Values: [][]interface{}{
+				{"2022-05-01T12:00:00Z", 21.5, nil}, {"2022-05-01T11:00:00Z", 20, 60},
+			}}}
+		case strings.HasPrefix(q, `SELECT * FROM "raw"`) && strings.Contains(q, "time >= '2022-06-01T00:00:00Z'"):
+			return []influxtest.Serie{{Name: "raw", Tags: map[string]string{"stream_id": "relay"}, Columns: []string{"time", "temp", "hum"}, Values: [][]interface{}{
+				{"2022-06-02T08:00:00Z", 18, 70},
+			}}}
+		case strings.Contains(q, `FROM "steps"`) && strings.Contains(q, `"stream_id" = '1A2B3C'`):
+			return []influxtest.Serie{{Name: "steps", Tags: map[string]string{"stream_id": "1A2B3C"}, Columns: []string{"time", "before", "after", "magnitude", "status", "type"}, Values: [][]interface{}{
+				{"2022-05-03T10:00:00Z", 40, 30, -10, "confirmed", "harvest"},
+				{"2022-05-04T10:00:00Z", 30, 32, 2, "pending", nil},
+			}}}
+		}
+		return nil
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL()})
+
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{
+			{ID: "chenes"},
+			{ID: "pins"},
+		},
+		Devices: []registry.Device{
+			{StreamID: "1A2B3C", Apiary: "chenes", Hive: "h1", Token: "secret"},
+			{StreamID: "relay", Apiary: "pins", RucherIDs: map[string]string{"2": "chenes"}},
+			{StreamID: "other"},
+		},
+	})
+
+	var buf bytes.Buffer
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	manifest, err := Bundle(context.Background(), &buf, "chenes", from, to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Files["readings/raw.csv"] != 3 || manifest.Files["notes.csv"] != 1 || len(manifest.Files) != 2 {
+		t.Fatalf("unexpected files %v", manifest.Files)
+	}
+	if len(manifest.Unavailable) != 2 || manifest.Unavailable[0] != "inspection_notes" || manifest.Unavailable[1] != "calibration_history" {
+		t.Fatalf("unexpected unavailable data %v", manifest.Unavailable)
+	}
+
+	// The readings are queried one month at a time, with the relay devices
+	var selects []string
+	for _, q := range server.Queries() {
+		if strings.HasPrefix(q, `SELECT * FROM "raw"`) {
+			selects = append(selects, q)
+		}
+	}
+	if len(selects) != 2 {
+		t.Fatalf("expected 2 monthly queries, got %v", selects)
+	}
+	for _, expected := range []string{
+		`("apiary" = 'chenes' OR ("apiary" = '' AND ("stream_id" = '1A2B3C' OR "stream_id" = 'relay')))`,
+		`time >= '2022-05-01T00:00:00Z' AND time < '2022-06-01T00:00:00Z'`,
+	} {
+		if !strings.Contains(selects[0], expected) {
+			t.Fatalf("expected %v in %v", expected, selects[0])
+		}
+	}
+	if !strings.Contains(selects[1], `time >= '2022-06-01T00:00:00Z' AND time <= '2022-06-15T00:00:00Z'`) {
+		t.Fatalf("unexpected query %v", selects[1])
+	}
+
+	files := unzip(t, buf.Bytes())
+	expected := "time,stream_id,hum,temp\n2022-05-01T11:00:00Z,1A2B3C,60,20\n2022-05-01T12:00:00Z,1A2B3C,,21.5\n2022-06-02T08:00:00Z,relay,70,18\n"
+	if files["readings/raw.csv"] != expected {
+		t.Fatalf("unexpected readings:\n%v", files["readings/raw.csv"])
+	}
+	if _, ok := files["events.csv"]; ok {
+		t.Fatal("expected no events file without events")
+	}
+	if files["notes.csv"] != "time,stream_id,hive,type,magnitude\n2022-05-03T10:00:00Z,1A2B3C,h1,harvest,-10\n" {
+		t.Fatalf("unexpected notes:\n%v", files["notes.csv"])
+	}
+	if _, ok := files["manifest.json"]; !ok {
+		t.Fatal("expected a manifest")
+	}
+	if strings.Contains(files["devices.json"], "secret") || strings.Contains(files["devices.json"], "other") {
+		t.Fatalf("unexpected devices %v", files["devices.json"])
+	}
+
+	_, err = Bundle(context.Background(), &buf, "unknown", from, from, nil)
+	if err != ErrUnknownApiary {
+		t.Fatalf("expected an unknown apiary error, got %v", err)
+	}
+}
+
+func Test_BundleDevice(t *testing.T) {
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		switch {
+		case q == "SHOW MEASUREMENTS":
+			return []influxtest.Serie{{Name: "measurements", Columns: []string{"name"}, Values: [][]interface{}{{"raw"}}}}
+		case q == `SHOW FIELD KEYS FROM "raw"`:
+			return []influxtest.Serie{{Name: "raw", Columns: []string{"fieldKey", "fieldType"}, Values: [][]interface{}{{"temp", "float"}}}}
+		case strings.HasPrefix(q, `SELECT * FROM "raw"`):
+			return []influxtest.Serie{{Name: "raw", Columns: []string{"time", "temp"}, Values: [][]interface{}{{"2022-05-01T12:00:00Z", 21.5}}}}
+		}
+		return nil
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL()})
+
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "chenes"}},
+		Devices: []registry.Device{
+			{StreamID: "1A2B3C", Apiary: "chenes", Hive: "h1", Token: "secret"},
+			{StreamID: "4D5E6F", Apiary: "chenes", Hive: "h2"},
+		},
+	})
+
+	var buf bytes.Buffer
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 5, 15, 0, 0, 0, 0, time.UTC)
+	manifest, err := BundleDevice(context.Background(), &buf, "1A2B3C", from, to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Device == nil || manifest.Device.Hive != "h1" || manifest.Device.Token != "" || manifest.Apiary.ID != "chenes" {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	if manifest.Files["readings/raw.csv"] != 1 {
+		t.Fatalf("unexpected files %v", manifest.Files)
+	}
+
+	// Only the readings of the device are exported
+	for _, q := range server.Queries() {
+		if strings.HasPrefix(q, `SELECT * FROM "raw"`) && !strings.Contains(q, `WHERE "stream_id" = '1A2B3C' AND`) {
+			t.Fatalf("unexpected query %v", q)
+		}
+	}
+	files := unzip(t, buf.Bytes())
+	if strings.Contains(files["devices.json"], "4D5E6F") || strings.Contains(files["devices.json"], "secret") {
+		t.Fatalf("unexpected devices %v", files["devices.json"])
+	}
+
+	_, err = BundleDevice(context.Background(), &buf, "unknown", from, to, nil)
+	if err != ErrUnknownDevice {
+		t.Fatalf("expected an unknown device error, got %v", err)
+	}
+}
+
+func Test_BundleCalibration(t *testing.T) {
+	server := influxtest.New(t)
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL()})
+
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "chenes"}},
+		Devices: []registry.Device{
+			{StreamID: "1A2B3C", Apiary: "chenes", Hive: "h1"},
+			{StreamID: "other"},
+		},
+	})
+
+	queue := downlink.NewQueue()
+	tare, err := queue.Push("1A2B3C", downlink.Command{Type: downlink.CommandTare, Sensor: "weight"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = queue.Push("1A2B3C", downlink.Command{Type: downlink.CommandSetInterval, Interval: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = queue.Push("other", downlink.Command{Type: downlink.CommandTare})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	now := time.Now()
+	manifest, err := Bundle(context.Background(), &buf, "chenes", now.Add(-time.Hour), now.Add(time.Hour), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Files["calibration.csv"] != 1 || len(manifest.Unavailable) != 1 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+
+	files := unzip(t, buf.Bytes())
+	expected := "created_at,stream_id,hive,sensor,status,sent_at,delivered_at\n" +
+		tare.CreatedAt.UTC().Format(time.RFC3339) + ",1A2B3C,h1,weight,pending,,\n"
+	if files["calibration.csv"] != expected {
+		t.Fatalf("unexpected calibration history:\n%v", files["calibration.csv"])
+	}
+}
+
+func unzip(t *testing.T, content []byte) map[string]string {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(r)
+		files[f.Name] = string(content)
+	}
+	return files
+}
@@ -0,0 +1,181 @@
+package flight
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/nectar"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/pkg/errors"
+)
+
+const (
+	Measurement = "flight"
+
+	PeriodHour = "hour"
+	PeriodDay  = "day"
+)
+
+// Activity is the traffic at the entrance of a hive during a period. NetLoss
+// is the number of bees which left and did not come back.
+type Activity struct {
+	Time     time.Time `json:"time"`
+	BeesIn   float64   `json:"bees_in"`
+	BeesOut  float64   `json:"bees_out"`
+	Activity float64   `json:"activity"`
+	NetLoss  float64   `json:"net_loss"`
+}
+
+// Job recomputes the activity of the current and previous days every interval
+func Job(ctx context.Context, interval time.Duration) {
+	log := logger.Get(ctx).WithField("job", "flight")
+	err := sink.RequireInflux()
+	if err != nil {
+		log.WithError(err).Error("job disabled")
+		return
+	}
+	for {
+		now := time.Now()
+		err := Compute(ctx, now.Add(-48*time.Hour), now)
+		if err != nil {
+			log.WithError(err).Error("fail to compute flight activity")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Compute aggregates the bee counts of every device per hour (the activity
+// curve) and per local day, and stores them in the flight measurement. The
+// counts are grouped in the timezone of the apiary of every series, once per
+// timezone of the apiaries.
+func Compute(ctx context.Context, from, to time.Time) error {
+	log := logger.Get(ctx)
+	config := config.Get()
+	defaultLoc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return errors.Wrap(err, "invalid timezone")
+	}
+	locations, err := locations(defaultLoc)
+	if err != nil {
+		return err
+	}
+
+	bp, err := influx.Start(config.InfluxUrl)
+	if err != nil {
+		return errors.Wrap(err, "fail to open influx connection")
+	}
+
+	for _, loc := range locations {
+		for period, group := range map[string]string{PeriodHour: "1h", PeriodDay: "1d"} {
+			start := from.In(loc)
+			if period == PeriodDay {
+				start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+			} else {
+				start = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), 0, 0, 0, loc)
+			}
+
+			query := fmt.Sprintf(
+				`SELECT sum("bees_in") AS bees_in, sum("bees_out") AS bees_out FROM "raw" WHERE time >= %s AND time < %s GROUP BY time(%s), "stream_id", "apiary", "rucher_id" tz(%s)`,
+				influx.Time(start), influx.Time(to), group, influx.Quote(loc.String()),
+			)
+			rows, err := influx.QueryRows(config.InfluxUrl, query)
+			if err != nil {
+				return errors.Wrapf(err, "fail to query %v bee counts", period)
+			}
+
+			for _, row := range rows {
+				series := nectar.Series{StreamID: row.Tags["stream_id"], Apiary: row.Tags["apiary"], RucherID: row.Tags["rucher_id"]}
+				seriesLoc, err := series.Location(defaultLoc)
+				if err != nil {
+					return errors.Wrapf(err, "invalid timezone of %v", series.StreamID)
+				}
+				// The series is grouped in the query of its own timezone
+				if seriesLoc.String() != loc.String() {
+					continue
+				}
+				in, okIn := influx.Float(row.Values["bees_in"])
+				out, okOut := influx.Float(row.Values["bees_out"])
+				if !okIn && !okOut {
+					continue
+				}
+				values := map[string]interface{}{
+					"bees_in":  in,
+					"bees_out": out,
+					"activity": in + out,
+					"net_loss": out - in,
+				}
+				tags := map[string]string{
+					"stream_id": series.StreamID,
+					"period":    period,
+				}
+				for _, tag := range []string{"apiary", "rucher_id"} {
+					if row.Tags[tag] != "" {
+						tags[tag] = row.Tags[tag]
+					}
+				}
+				err = influx.Add(Measurement, values, tags, bp, row.Time)
+				if err != nil {
+					return errors.Wrap(err, "fail to add flight point")
+				}
+			}
+		}
+	}
+
+	log.WithField("points", len((*bp).Points())).Info("Flight activity computed")
+	err = influx.Write(config.InfluxUrl, bp)
+	if err != nil {
+		return errors.Wrap(err, "fail to write flight points")
+	}
+	return nil
+}
+
+// locations returns the default timezone and the distinct timezones of the
+// apiaries
+func locations(defaultLoc *time.Location) ([]*time.Location, error) {
+	res := []*time.Location{defaultLoc}
+	seen := map[string]bool{defaultLoc.String(): true}
+	for _, apiary := range registry.Get().Apiaries {
+		if apiary.Timezone == "" || seen[apiary.Timezone] {
+			continue
+		}
+		loc, err := apiary.Location()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid timezone of apiary %v", apiary.ID)
+		}
+		seen[apiary.Timezone] = true
+		res = append(res, loc)
+	}
+	return res, nil
+}
+
+// Get returns the activity of a device, per hour or per day
+func Get(device, period string, from, to time.Time) ([]Activity, error) {
+	if period != PeriodHour && period != PeriodDay {
+		return nil, fmt.Errorf("invalid period %q", period)
+	}
+	config := config.Get()
+	query := fmt.Sprintf(
+		`SELECT "bees_in", "bees_out", "activity", "net_loss" FROM "%s" WHERE "stream_id" = %s AND "period" = %s AND time >= %s AND time <= %s`,
+		Measurement, influx.Quote(device), influx.Quote(period), influx.Time(from), influx.Time(to),
+	)
+	rows, err := influx.QueryRows(config.InfluxUrl, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query flight activity")
+	}
+
+	res := make([]Activity, 0, len(rows))
+	for _, row := range rows {
+		a := Activity{Time: row.Time}
+		a.BeesIn, _ = influx.Float(row.Values["bees_in"])
+		a.BeesOut, _ = influx.Float(row.Values["bees_out"])
+		a.Activity, _ = influx.Float(row.Values["activity"])
+		a.NetLoss, _ = influx.Float(row.Values["net_loss"])
+		res = append(res, a)
+	}
+	return res, nil
+}
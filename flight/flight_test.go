@@ -0,0 +1,125 @@
+package flight
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/config/configtest"
+	"github.com/johnsudaar/ruche/influx/influxtest"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+)
+
+func Test_Compute(t *testing.T) {
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		paris := map[string]string{"stream_id": "1A2B3C"}
+		kolkata := map[string]string{"stream_id": "4D5E6F", "apiary": "kolkata", "rucher_id": "2"}
+		columns := []string{"time", "bees_in", "bees_out"}
+		switch {
+		case strings.Contains(q, "time(1h)") && strings.Contains(q, "Europe/Paris"):
+			return []influxtest.Serie{{Name: "raw", Tags: paris, Columns: columns, Values: [][]interface{}{
+				{"2022-06-02T08:00:00Z", 120, 150},
+				// No count during the hour
+				{"2022-06-02T09:00:00Z", nil, nil},
+				{"2022-06-02T10:00:00Z", 300, 280},
+			}}, {Name: "raw", Tags: kolkata, Columns: columns, Values: [][]interface{}{
+				// Grouped in the timezone of its apiary
+				{"2022-06-02T08:00:00Z", 1, 1},
+			}}}
+		case strings.Contains(q, "time(1d)") && strings.Contains(q, "Europe/Paris"):
+			return []influxtest.Serie{{Name: "raw", Tags: paris, Columns: columns, Values: [][]interface{}{
+				{"2022-06-01T22:00:00Z", 420, 430},
+			}}}
+		case strings.Contains(q, "time(1h)") && strings.Contains(q, "Asia/Kolkata"):
+			return []influxtest.Serie{{Name: "raw", Tags: kolkata, Columns: columns, Values: [][]interface{}{
+				{"2022-06-02T08:30:00Z", 50, 40},
+			}}}
+		case strings.Contains(q, "time(1d)") && strings.Contains(q, "Asia/Kolkata"):
+			return []influxtest.Serie{{Name: "raw", Tags: kolkata, Columns: columns, Values: [][]interface{}{
+				{"2022-06-01T18:30:00Z", 500, 400},
+			}}}
+		}
+		return nil
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL(), "TIMEZONE": "Europe/Paris"})
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "kolkata", Timezone: "Asia/Kolkata"}},
+		Devices:  []registry.Device{{StreamID: "1A2B3C"}, {StreamID: "4D5E6F", Apiary: "kolkata"}},
+	})
+
+	from := time.Date(2022, 6, 2, 8, 45, 0, 0, time.UTC)
+	err := Compute(context.Background(), from, from.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hours start on the local hour and the days at the local midnight
+	for _, expected := range []string{
+		`time >= '2022-06-02T08:00:00Z' AND time < '2022-06-02T11:45:00Z' GROUP BY time(1h), "stream_id", "apiary", "rucher_id" tz('Europe/Paris')`,
+		`time >= '2022-06-01T22:00:00Z' AND time < '2022-06-02T11:45:00Z' GROUP BY time(1d), "stream_id", "apiary", "rucher_id" tz('Europe/Paris')`,
+		`time >= '2022-06-02T08:30:00Z' AND time < '2022-06-02T11:45:00Z' GROUP BY time(1h), "stream_id", "apiary", "rucher_id" tz('Asia/Kolkata')`,
+		`time >= '2022-06-01T18:30:00Z' AND time < '2022-06-02T11:45:00Z' GROUP BY time(1d), "stream_id", "apiary", "rucher_id" tz('Asia/Kolkata')`,
+	} {
+		found := false
+		for _, q := range server.Queries() {
+			found = found || strings.Contains(q, expected)
+		}
+		if !found {
+			t.Errorf("expected a query with %v, got %v", expected, server.Queries())
+		}
+	}
+
+	activity := make(map[string]influxtest.Point)
+	for _, p := range server.Points(Measurement) {
+		activity[p.Tags["stream_id"]+" "+p.Tags["period"]+" "+p.Time.Format(time.RFC3339)] = p
+	}
+	if len(activity) != 5 {
+		t.Fatalf("expected 3 hours and 2 days, got %+v", activity)
+	}
+	for key, fields := range map[string][2]string{
+		"1A2B3C hour 2022-06-02T08:00:00Z": {"270", "30"},
+		"1A2B3C hour 2022-06-02T10:00:00Z": {"580", "-20"},
+		"1A2B3C day 2022-06-01T22:00:00Z":  {"850", "10"},
+		"4D5E6F hour 2022-06-02T08:30:00Z": {"90", "-10"},
+		"4D5E6F day 2022-06-01T18:30:00Z":  {"900", "-100"},
+	} {
+		p, ok := activity[key]
+		if !ok || p.Fields["activity"] != fields[0] || p.Fields["net_loss"] != fields[1] {
+			t.Errorf("%v: expected activity %v and net loss %v, got %+v", key, fields[0], fields[1], p)
+		}
+	}
+	if p := activity["4D5E6F day 2022-06-01T18:30:00Z"]; p.Tags["apiary"] != "kolkata" || p.Tags["rucher_id"] != "2" {
+		t.Errorf("expected the apiary tags, got %v", p.Tags)
+	}
+}
+
+func Test_Get(t *testing.T) {
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		return []influxtest.Serie{{Name: Measurement, Columns: []string{"time", "bees_in", "bees_out", "activity", "net_loss"}, Values: [][]interface{}{
+			{"2022-06-02T08:00:00Z", 120, 150, 270, 30},
+		}}}
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL()})
+
+	_, err := Get("1A2B3C", "week", time.Now(), time.Now())
+	if err == nil {
+		t.Fatal("expected an invalid period error")
+	}
+
+	from := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+	res, err := Get("1A2B3C", PeriodHour, from, from.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Activity != 270 || res[0].NetLoss != 30 || !res[0].Time.Equal(from.Add(8*time.Hour)) {
+		t.Fatalf("unexpected activity %+v", res)
+	}
+	q := server.Queries()[0]
+	if !strings.Contains(q, `"stream_id" = '1A2B3C' AND "period" = 'hour'`) {
+		t.Fatalf("unexpected query %v", q)
+	}
+}
@@ -0,0 +1,316 @@
+package forecast
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/alert"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/nectar"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/johnsudaar/ruche/step"
+	"github.com/pkg/errors"
+)
+
+const (
+	Measurement = "forecast"
+	AlertType   = "starvation_forecast"
+
+	// Minimal time covered by the readings to estimate a trend
+	minSpan = 48 * time.Hour
+)
+
+// Forecast is the projection of the food stores of a hive. Rate is the
+// daily consumption in kg, StarvationDate is nil when the weight does not
+// decrease.
+type Forecast struct {
+	StreamID       string     `json:"stream_id"`
+	Apiary         string     `json:"apiary,omitempty"`
+	RucherID       string     `json:"rucher_id,omitempty"`
+	Time           time.Time  `json:"time"`
+	Weight         float64    `json:"weight"`
+	Threshold      float64    `json:"threshold"`
+	Rate           float64    `json:"rate"`
+	DaysLeft       *float64   `json:"days_left,omitempty"`
+	StarvationDate *time.Time `json:"starvation_date,omitempty"`
+	Readings       int        `json:"readings"`
+}
+
+var ErrNotEnoughData = errors.New("not enough readings to estimate the consumption")
+
+// InSeason returns true during the wintering months, now must be in the
+// timezone of the hive
+func InSeason(now time.Time) bool {
+	config := config.Get()
+	month := int(now.Month())
+	start, end := config.ForecastStartMonth, config.ForecastEndMonth
+	if start <= end {
+		return month >= start && month <= end
+	}
+	return month >= start || month <= end
+}
+
+// seasonStart returns the start of the wintering season of now, in the
+// timezone of now
+func seasonStart(now time.Time) time.Time {
+	config := config.Get()
+	year := now.Year()
+	if config.ForecastStartMonth > config.ForecastEndMonth && int(now.Month()) <= config.ForecastEndMonth {
+		year--
+	}
+	return time.Date(year, time.Month(config.ForecastStartMonth), 1, 0, 0, 0, 0, now.Location())
+}
+
+// Job forecasts the stores of every hive every interval, the hives out of
+// the wintering season in the timezone of their apiary are skipped by Run
+func Job(ctx context.Context, interval time.Duration) {
+	log := logger.Get(ctx).WithField("job", "forecast")
+	err := sink.RequireInflux()
+	if err != nil {
+		log.WithError(err).Error("job disabled")
+		return
+	}
+	for {
+		err := Run(ctx, time.Now())
+		if err != nil {
+			log.WithError(err).Error("fail to forecast food stores")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Run stores the forecast of every hive in its wintering season with
+// readings and raises an alert for the hives which will starve within the
+// configured number of days
+func Run(ctx context.Context, now time.Time) error {
+	log := logger.Get(ctx)
+	config := config.Get()
+	defaultLoc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return errors.Wrap(err, "invalid timezone")
+	}
+
+	from := now.Add(-config.ForecastWindow)
+	readings, err := nectar.Weights(config.InfluxUrl, "", from, now)
+	if err != nil {
+		return errors.Wrap(err, "fail to query weights")
+	}
+	events, err := step.List("", from, now)
+	if err != nil {
+		return errors.Wrap(err, "fail to list steps")
+	}
+
+	bp, err := influx.Start(config.InfluxUrl)
+	if err != nil {
+		return errors.Wrap(err, "fail to open influx connection")
+	}
+	for series, seriesReadings := range readings {
+		loc, err := series.Location(defaultLoc)
+		if err != nil {
+			return errors.Wrapf(err, "invalid timezone of apiary %v", series.Apiary)
+		}
+		if !InSeason(now.In(loc)) {
+			continue
+		}
+		f, err := Estimate(series, seriesReadings, events, now)
+		if err == ErrNotEnoughData {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "fail to forecast %v", series.StreamID)
+		}
+
+		values := map[string]interface{}{
+			"weight":    f.Weight,
+			"threshold": f.Threshold,
+			"rate":      f.Rate,
+		}
+		if f.DaysLeft != nil {
+			values["days_left"] = *f.DaysLeft
+		}
+		tags := map[string]string{"stream_id": series.StreamID}
+		if series.Apiary != "" {
+			tags["apiary"] = series.Apiary
+		}
+		if series.RucherID != "" {
+			tags["rucher_id"] = series.RucherID
+		}
+		err = influx.Add(Measurement, values, tags, bp, now)
+		if err != nil {
+			return errors.Wrap(err, "fail to add forecast point")
+		}
+
+		if f.DaysLeft != nil && *f.DaysLeft <= float64(config.ForecastAlertDays) {
+			err = raise(ctx, series, f, now.In(loc))
+			if err != nil {
+				log.WithError(err).Error("fail to raise starvation alert")
+			}
+		}
+	}
+
+	log.WithField("points", len((*bp).Points())).Info("Food stores forecasted")
+	err = influx.Write(config.InfluxUrl, bp)
+	if err != nil {
+		return errors.Wrap(err, "fail to write forecasts")
+	}
+	return nil
+}
+
+// raise alerts once per hive and wintering season, now is in the timezone of
+// the hive. The alert is raised again if the starvation date moved earlier by
+// more than the alert margin since the last alert.
+func raise(ctx context.Context, series nectar.Series, f Forecast, now time.Time) error {
+	config := config.Get()
+	start := seasonStart(now)
+	var parts []string
+	for _, part := range []string{series.Apiary, series.RucherID, strconv.Itoa(start.Year())} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	key := strings.Join(parts, "/")
+
+	last, err := alert.Last(series.StreamID, AlertType, key, start)
+	if err != nil {
+		return err
+	}
+	if last != nil && (last.Date == nil || !f.StarvationDate.Before(last.Date.Add(-config.ForecastAlertMargin))) {
+		return nil
+	}
+	date := f.StarvationDate.In(now.Location()).Format("2006-01-02")
+	return alert.Raise(ctx, alert.Alert{
+		Device:  series.StreamID,
+		Type:    AlertType,
+		Message: fmt.Sprintf("food stores exhausted in %.0f days (%v), consuming %.2f kg/day", *f.DaysLeft, date, f.Rate),
+		Time:    now,
+		Key:     key,
+		Date:    f.StarvationDate,
+	})
+}
+
+// Get returns the current forecast of a device. The apiary selects the hive
+// of a relay, the readings of the apiary of the device are used if empty. The
+// hives forwarded to the same apiary are told apart by rucher_id, the first
+// one is used.
+func Get(device, apiary string, now time.Time) (Forecast, error) {
+	config := config.Get()
+	if apiary == "" {
+		if d, ok := registry.Get().Device(device); ok {
+			apiary = d.Apiary
+		}
+	}
+	from := now.Add(-config.ForecastWindow)
+	readings, err := nectar.Weights(config.InfluxUrl, device, from, now)
+	if err != nil {
+		return Forecast{}, errors.Wrap(err, "fail to query weights")
+	}
+	events, err := step.List(device, from, now)
+	if err != nil {
+		return Forecast{}, errors.Wrap(err, "fail to list steps")
+	}
+	var candidates []nectar.Series
+	for s := range readings {
+		if s.Apiary == apiary {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 && len(readings) == 1 {
+		// Readings stored before the device was assigned to an apiary
+		for s := range readings {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return Forecast{StreamID: device, Apiary: apiary, Time: now}, ErrNotEnoughData
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].RucherID < candidates[j].RucherID })
+	return Estimate(candidates[0], readings[candidates[0]], events, now)
+}
+
+// Estimate projects the date the weight of the hive reaches its empty weight
+// plus the minimal stores. The consumption rate is the slope of the weight,
+// the steps (manipulations, swarms) are removed from the weight first unless
+// they have been rejected by the beekeeper.
+func Estimate(series nectar.Series, readings []nectar.Reading, stored []step.Event, now time.Time) (Forecast, error) {
+	config := config.Get()
+	f := Forecast{StreamID: series.StreamID, Apiary: series.Apiary, RucherID: series.RucherID, Time: now, Readings: len(readings)}
+	if len(readings) < 2 {
+		return f, ErrNotEnoughData
+	}
+	sorted := append([]nectar.Reading{}, readings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+	if sorted[len(sorted)-1].Time.Sub(sorted[0].Time) < minSpan {
+		return f, ErrNotEnoughData
+	}
+
+	empty := config.ForecastEmptyWeight
+	if d, ok := registry.Get().Device(series.StreamID); ok && d.EmptyWeight > 0 {
+		empty = d.EmptyWeight
+	}
+	f.Threshold = empty + config.ForecastMinStores
+	f.Weight = sorted[len(sorted)-1].Weight
+
+	rejected := make(map[string]bool)
+	for _, e := range stored {
+		if e.StreamID == series.StreamID && e.Apiary == series.Apiary && e.RucherID == series.RucherID && e.Status == step.StatusRejected {
+			rejected[e.ID] = true
+		}
+	}
+	steps := step.Detect(sorted, step.Options{
+		Threshold: config.StepThreshold,
+		MaxGap:    config.StepMaxGap,
+		Merge:     config.StepMergeWindow,
+	})
+	// The weight changes are removed reading by reading, a step merges the
+	// changes from its time to its last change
+	var adjusted []nectar.Reading
+	offset := 0.0
+	for i, r := range sorted {
+		for _, s := range steps {
+			if i > 0 && !r.Time.Before(s.Time) && !r.Time.After(s.Last) && !rejected[s.ID] {
+				offset += r.Weight - sorted[i-1].Weight
+			}
+		}
+		adjusted = append(adjusted, nectar.Reading{Time: r.Time, Weight: r.Weight - offset})
+	}
+
+	f.Rate = -slope(adjusted)
+	if f.Rate <= 0 {
+		f.Rate = 0
+		return f, nil
+	}
+	days := (f.Weight - f.Threshold) / f.Rate
+	if days < 0 {
+		days = 0
+	}
+	date := now.Add(time.Duration(days * float64(24*time.Hour)))
+	f.DaysLeft = &days
+	f.StarvationDate = &date
+	return f, nil
+}
+
+// slope returns the least squares slope of the weight, in kg per day
+func slope(readings []nectar.Reading) float64 {
+	origin := readings[0].Time
+	n := float64(len(readings))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, r := range readings {
+		x := r.Time.Sub(origin).Hours() / 24
+		sumX += x
+		sumY += r.Weight
+		sumXY += x * r.Weight
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
@@ -0,0 +1,242 @@
+package forecast
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/config/configtest"
+	"github.com/johnsudaar/ruche/influx/influxtest"
+	"github.com/johnsudaar/ruche/nectar"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+	"github.com/johnsudaar/ruche/step"
+)
+
+func Test_Estimate(t *testing.T) {
+	err := config.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrytest.Use(t, registry.Registry{Devices: []registry.Device{{StreamID: "1A2B3C", EmptyWeight: 25}}})
+
+	// Ten days consuming 0.2 kg/day, with a reading every hour. The
+	// beekeeper fed the colony on the fourth day and the wind shook the hive
+	// on the seventh day.
+	start := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+	feeding := start.Add(4 * 24 * time.Hour)
+	wind := start.Add(7 * 24 * time.Hour)
+	var readings []nectar.Reading
+	for h := 0; h <= 10*24; h++ {
+		at := start.Add(time.Duration(h) * time.Hour)
+		weight := 40 - 0.2*float64(h)/24
+		if !at.Before(feeding) {
+			weight += 3
+		}
+		if !at.Before(wind) {
+			weight -= 2.5
+		}
+		readings = append(readings, nectar.Reading{Time: at, Weight: weight})
+	}
+	stored := []step.Event{{
+		ID:       strconv.FormatInt(wind.UnixNano(), 10),
+		StreamID: "1A2B3C",
+		Time:     wind,
+		Status:   step.StatusRejected,
+	}}
+	now := readings[len(readings)-1].Time
+
+	f, err := Estimate(nectar.Series{StreamID: "1A2B3C"}, readings, stored, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rejected step is kept in the trend, the feeding is not
+	if f.Rate < 0.3 || f.Rate > 0.6 {
+		t.Fatalf("expected the drop in the consumption, got %v kg/day", f.Rate)
+	}
+	if f.Threshold != 30 {
+		t.Fatalf("expected a threshold of 30 kg, got %v", f.Threshold)
+	}
+	if f.DaysLeft == nil || math.Abs(*f.DaysLeft-(f.Weight-30)/f.Rate) > 1e-9 {
+		t.Fatalf("unexpected days left %+v", f)
+	}
+	if !f.StarvationDate.After(now) {
+		t.Fatalf("expected a starvation date after now, got %v", f.StarvationDate)
+	}
+
+	stored[0].Status = step.StatusConfirmed
+	f, err = Estimate(nectar.Series{StreamID: "1A2B3C"}, readings, stored, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(f.Rate-0.2) > 0.01 {
+		t.Fatalf("expected a consumption of about 0.2 kg/day, got %v", f.Rate)
+	}
+
+	_, err = Estimate(nectar.Series{StreamID: "1A2B3C"}, readings[:24], nil, now)
+	if err != ErrNotEnoughData {
+		t.Fatalf("expected not enough data, got %v", err)
+	}
+}
+
+func Test_EstimateMergedSteps(t *testing.T) {
+	configtest.Setenv(t, map[string]string{"STEP_MERGE_WINDOW": "2h"})
+
+	// Ten days consuming 0.2 kg/day, the beekeeper removed three supers
+	// one hour apart on the ninth day
+	start := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+	harvest := start.Add(9 * 24 * time.Hour)
+	var readings []nectar.Reading
+	for h := 0; h <= 10*24; h++ {
+		at := start.Add(time.Duration(h) * time.Hour)
+		weight := 40 - 0.2*float64(h)/24
+		for i := 0; i < 3; i++ {
+			if !at.Before(harvest.Add(time.Duration(i) * time.Hour)) {
+				weight -= 4
+			}
+		}
+		readings = append(readings, nectar.Reading{Time: at, Weight: weight})
+	}
+	now := readings[len(readings)-1].Time
+
+	f, err := Estimate(nectar.Series{StreamID: "1A2B3C"}, readings, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(f.Rate-0.2) > 0.01 {
+		t.Fatalf("expected a consumption of about 0.2 kg/day, got %v", f.Rate)
+	}
+}
+
+// weights returns a week of hourly readings until now, weighing weight at
+// now and losing rate kg a day
+func weights(now time.Time, weight, rate float64) [][]interface{} {
+	var values [][]interface{}
+	for h := -7 * 24; h <= 0; h++ {
+		at := now.Add(time.Duration(h) * time.Hour)
+		values = append(values, []interface{}{at.Format(time.RFC3339), weight - rate*float64(h)/24})
+	}
+	return values
+}
+
+func Test_RunAlert(t *testing.T) {
+	var now time.Time
+	var weight, rate float64
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		switch {
+		case strings.Contains(q, `FROM "raw"`):
+			return []influxtest.Serie{{Name: "raw", Tags: map[string]string{"stream_id": "1A2B3C", "rucher_id": "0"}, Columns: []string{"time", "mass_r1"}, Values: weights(now, weight, rate)}}
+		case strings.Contains(q, `FROM "alerts"`):
+			// The last stored alert
+			alerts := server.Points("alerts")
+			if len(alerts) == 0 {
+				return nil
+			}
+			last := alerts[len(alerts)-1]
+			return []influxtest.Serie{{Name: "alerts", Columns: []string{"time", "message", "key", "date"}, Values: [][]interface{}{
+				{last.Time.Format(time.RFC3339), last.Fields["message"], last.Fields["key"], last.Fields["date"]},
+			}}}
+		}
+		return nil
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL(), "FORECAST_ALERT_MARGIN": "24h"})
+	registrytest.Use(t, registry.Registry{Devices: []registry.Device{{StreamID: "1A2B3C"}}})
+
+	start := time.Date(2022, 11, 15, 0, 0, 0, 0, time.UTC)
+	for _, run := range []struct {
+		Name   string
+		Now    time.Time
+		Weight float64
+		Rate   float64
+		Alerts int
+	}{
+		// The stores are exhausted on the 20th
+		{Name: "first forecast", Now: start, Weight: 27.5, Rate: 0.5, Alerts: 1},
+		{Name: "same date the next day", Now: start.AddDate(0, 0, 1), Weight: 27, Rate: 0.5, Alerts: 1},
+		// The stores are exhausted on the 19th at noon
+		{Name: "date earlier within the margin", Now: start.AddDate(0, 0, 2), Weight: 26.75, Rate: 0.5, Alerts: 1},
+		// The stores are exhausted on the 18th at noon
+		{Name: "date earlier than the margin", Now: start.AddDate(0, 0, 2), Weight: 26.5, Rate: 1, Alerts: 2},
+		{Name: "date later", Now: start.AddDate(0, 0, 3), Weight: 26, Rate: 0.5, Alerts: 2},
+	} {
+		now, weight, rate = run.Now, run.Weight, run.Rate
+		err := Run(context.Background(), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alerts := server.Points("alerts"); len(alerts) != run.Alerts {
+			t.Fatalf("%v: expected %v alerts, got %+v", run.Name, run.Alerts, alerts)
+		}
+	}
+
+	alerts := server.Points("alerts")
+	for i, expected := range []time.Time{start.AddDate(0, 0, 5), start.AddDate(0, 0, 3).Add(12 * time.Hour)} {
+		date, err := time.Parse(time.RFC3339, alerts[i].Fields["date"])
+		if err != nil || date.Sub(expected).Abs() > time.Minute {
+			t.Fatalf("expected the alert of %v, got %+v", expected, alerts[i])
+		}
+		if alerts[i].Fields["key"] != "0/2022" || alerts[i].Tags["type"] != AlertType {
+			t.Fatalf("unexpected alert %+v", alerts[i])
+		}
+	}
+	if len(server.Points(Measurement)) != 5 {
+		t.Fatalf("expected a forecast per run, got %+v", server.Points(Measurement))
+	}
+	var checked bool
+	for _, q := range server.Queries() {
+		checked = checked || strings.Contains(q, `"key" = '0/2022' AND time >= '2022-10-01T00:00:00Z'`)
+	}
+	if !checked {
+		t.Fatalf("expected the alerts of the wintering season to be checked: %v", server.Queries())
+	}
+}
+
+func Test_RunInSeason(t *testing.T) {
+	// It is already October in Kolkata
+	now := time.Date(2022, 9, 30, 20, 0, 0, 0, time.UTC)
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		if !strings.Contains(q, `FROM "raw"`) {
+			return nil
+		}
+		columns := []string{"time", "mass_r1"}
+		return []influxtest.Serie{
+			{Name: "raw", Tags: map[string]string{"stream_id": "1A2B3C", "apiary": "kolkata"}, Columns: columns, Values: weights(now, 40, 0.5)},
+			{Name: "raw", Tags: map[string]string{"stream_id": "4D5E6F", "apiary": "paris"}, Columns: columns, Values: weights(now, 40, 0.5)},
+		}
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL()})
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "kolkata", Timezone: "Asia/Kolkata"}, {ID: "paris", Timezone: "Europe/Paris"}},
+		Devices:  []registry.Device{{StreamID: "1A2B3C", Apiary: "kolkata"}, {StreamID: "4D5E6F", Apiary: "paris"}},
+	})
+
+	err := Run(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := server.Points(Measurement)
+	if len(points) != 1 || points[0].Tags["apiary"] != "kolkata" {
+		t.Fatalf("expected only the hive of Kolkata to be forecasted, got %+v", points)
+	}
+}
+
+func Test_InSeason(t *testing.T) {
+	err := config.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for month, expected := range map[time.Month]bool{
+		time.October: true, time.January: true, time.March: true,
+		time.April: false, time.September: false,
+	} {
+		if InSeason(time.Date(2022, month, 15, 0, 0, 0, 0, time.UTC)) != expected {
+			t.Fatalf("expected in season %v for %v", expected, month)
+		}
+	}
+}
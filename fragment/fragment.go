@@ -0,0 +1,104 @@
+package fragment
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HeaderLength is the size of the header prepended to every fragment: the
+// message ID then the fragment index (high nibble) and count (low nibble)
+const HeaderLength = 2
+
+// Message is a payload reassembled from all its fragments
+type Message struct {
+	Payload []byte
+	// Created is the time of the first fragment
+	Created time.Time
+}
+
+type key struct {
+	device string
+	id     byte
+}
+
+type pending struct {
+	created   time.Time
+	fragments [][]byte
+	received  int
+}
+
+// Buffer keeps the fragments of every device until the message is complete.
+// Incomplete messages are dropped once a fragment newer than their first one
+// by more than the timeout is received.
+type Buffer struct {
+	timeout  time.Duration
+	lock     sync.Mutex
+	messages map[key]*pending
+}
+
+func NewBuffer(timeout time.Duration) *Buffer {
+	return &Buffer{
+		timeout:  timeout,
+		messages: make(map[key]*pending),
+	}
+}
+
+// Add buffers a fragment and returns the message when it is complete
+func (b *Buffer) Add(device string, frame []byte, created time.Time) (Message, bool, error) {
+	if len(frame) < HeaderLength {
+		return Message{}, false, fmt.Errorf("fragment too short: %v bytes", len(frame))
+	}
+	id := frame[0]
+	index := int(frame[1] >> 4)
+	count := int(frame[1] & 0x0f)
+	if count == 0 || index >= count {
+		return Message{}, false, fmt.Errorf("invalid fragment %v/%v", index, count)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.expire(created)
+
+	k := key{device: device, id: id}
+	msg, ok := b.messages[k]
+	if !ok || len(msg.fragments) != count {
+		// A message ID reused with another count is a new message
+		msg = &pending{created: created, fragments: make([][]byte, count)}
+		b.messages[k] = msg
+	}
+	if msg.fragments[index] == nil {
+		msg.received++
+	}
+	msg.fragments[index] = frame[HeaderLength:]
+	if created.Before(msg.created) {
+		msg.created = created
+	}
+
+	if msg.received < count {
+		return Message{}, false, nil
+	}
+
+	delete(b.messages, k)
+	res := Message{Created: msg.created}
+	for _, f := range msg.fragments {
+		res.Payload = append(res.Payload, f...)
+	}
+	return res, true, nil
+}
+
+// Pending returns the number of incomplete messages
+func (b *Buffer) Pending() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.messages)
+}
+
+func (b *Buffer) expire(now time.Time) {
+	for k, msg := range b.messages {
+		if now.Sub(msg.created) > b.timeout {
+			delete(b.messages, k)
+		}
+	}
+}
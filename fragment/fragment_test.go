@@ -0,0 +1,38 @@
+package fragment
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_Reassembly(t *testing.T) {
+	buffer := NewBuffer(10 * time.Minute)
+	first := time.Now()
+
+	_, complete, err := buffer.Add("dev", []byte{0x07, 0x12, 0xcc, 0xdd}, first.Add(time.Minute))
+	if err != nil || complete {
+		t.Fatalf("unexpected completion: %v %v", complete, err)
+	}
+	msg, complete, err := buffer.Add("dev", []byte{0x07, 0x02, 0xaa, 0xbb}, first)
+	if err != nil || !complete {
+		t.Fatalf("expected complete message: %v %v", complete, err)
+	}
+	if !bytes.Equal(msg.Payload, []byte{0xaa, 0xbb, 0xcc, 0xdd}) {
+		t.Fatalf("unexpected payload %x", msg.Payload)
+	}
+	if !msg.Created.Equal(first) {
+		t.Fatalf("expected the time of the first fragment, got %v", msg.Created)
+	}
+}
+
+func Test_Timeout(t *testing.T) {
+	buffer := NewBuffer(10 * time.Minute)
+	now := time.Now()
+
+	buffer.Add("dev", []byte{0x01, 0x02, 0xaa}, now)
+	buffer.Add("dev", []byte{0x02, 0x02, 0xaa}, now.Add(11*time.Minute))
+	if buffer.Pending() != 1 {
+		t.Fatalf("expected the first message to be dropped, %v pending", buffer.Pending())
+	}
+}
@@ -1,22 +1,35 @@
 module github.com/johnsudaar/ruche
 
-go 1.18
+go 1.19
 
 require (
 	github.com/Scalingo/go-handlers v1.2.6
 	github.com/Scalingo/go-utils v7.1.0+incompatible
+	github.com/dop251/goja v0.0.0-20230806174421-c933cf95e127
+	github.com/golang/snappy v0.0.4
 	github.com/gorilla/handlers v1.4.2
 	github.com/influxdata/influxdb v1.7.9
 	github.com/kelseyhightower/envconfig v1.4.0
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/sirupsen/logrus v1.4.2
+	github.com/xitongsys/parquet-go v1.6.2
 	gopkg.in/errgo.v1 v1.0.1
 )
 
 require (
+	github.com/apache/arrow/go/arrow v0.0.0-20200730104253-651201b0f516 // indirect
+	github.com/apache/thrift v0.14.2 // indirect
 	github.com/codegangsta/negroni v1.0.0 // indirect
+	github.com/dlclark/regexp2 v1.7.0 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
 	github.com/gofrs/uuid v3.2.0+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/gorilla/mux v1.7.3 // indirect
+	github.com/klauspost/compress v1.13.1 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
-	github.com/sirupsen/logrus v1.4.2 // indirect
-	golang.org/x/sys v0.0.0-20191220142924-d4481acd189f // indirect
+	github.com/pierrec/lz4/v4 v4.1.8 // indirect
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0 // indirect
+	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
+	golang.org/x/text v0.3.8 // indirect
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
 )
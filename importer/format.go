@@ -0,0 +1,285 @@
+package importer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Row is a reading read from an export file, Err is set if the line is
+// invalid
+type Row struct {
+	Line int
+	Time time.Time
+	// Device is the hive name or the stream ID found in the file, empty if the
+	// file only has the readings of one device
+	Device string
+	Fields map[string]interface{}
+	Err    error
+}
+
+// Reader reads the rows of an export file in the order of the file
+type Reader interface {
+	Read(r io.Reader, fn func(Row) error) error
+}
+
+// Column maps a column of an export on one of our fields
+type Column struct {
+	Field string `json:"field"`
+	// Unit of the column, converted to the unit of our fields (kg, °C)
+	Unit string `json:"unit"`
+}
+
+// CSV reads the exports with a header line. Columns which are not mapped
+// are ignored, all the columns are kept with their name if none is mapped.
+// DeviceColumn is the column of the hive name or stream ID, alternative names
+// are separated by commas.
+type CSV struct {
+	Delimiter    string            `json:"delimiter"`
+	TimeColumn   string            `json:"time_column"`
+	TimeLayout   string            `json:"time_layout"`
+	Timezone     string            `json:"timezone"`
+	DeviceColumn string            `json:"device_column"`
+	Columns      map[string]Column `json:"columns"`
+}
+
+const (
+	FormatRuche       = "ruche"
+	FormatBroodMinder = "broodminder"
+	FormatBEEP        = "beep"
+)
+
+var formats = map[string]Reader{
+	// Our own spreadsheets, named after the fields, with the readings of
+	// several hives if they have a device or hive column
+	FormatRuche: CSV{TimeColumn: "time", DeviceColumn: "device,hive"},
+	// CSV export of MyBroodMinder, in imperial units
+	FormatBroodMinder: CSV{
+		TimeColumn:   "UTC_TimeStamp",
+		TimeLayout:   "2006-01-02 15:04:05",
+		DeviceColumn: "Device_ID",
+		Columns: map[string]Column{
+			"Temperature": {Field: "temp", Unit: "degF"},
+			"Humidity":    {Field: "hum"},
+			"Weight":      {Field: "mass_r1", Unit: "lb"},
+		},
+	},
+	// Sensor data export of the BEEP app
+	FormatBEEP: CSV{
+		TimeColumn: "time",
+		Columns: map[string]Column{
+			"t_i":       {Field: "temp"},
+			"h":         {Field: "hum"},
+			"l":         {Field: "lum"},
+			"bv":        {Field: "bat_tension"},
+			"weight_kg": {Field: "mass_r1", Unit: "kg"},
+		},
+	},
+}
+
+// Register must be called before an import starts
+func Register(name string, r Reader) {
+	formats[name] = r
+}
+
+func Get(name string) (Reader, bool) {
+	r, ok := formats[name]
+	return r, ok
+}
+
+// LoadFile registers the CSV formats of a JSON object keyed by format name:
+//
+//	{
+//	  "spreadsheet-2019": {
+//	    "time_column": "Date", "time_layout": "02/01/2006 15:04", "timezone": "Europe/Paris",
+//	    "device_column": "Ruche",
+//	    "columns": {"Poids (g)": {"field": "mass_r1", "unit": "g"}, "Temp": {"field": "temp"}}
+//	  }
+//	}
+func LoadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "fail to read import formats file")
+	}
+	var loaded map[string]CSV
+	err = json.Unmarshal(content, &loaded)
+	if err != nil {
+		return errors.Wrap(err, "invalid import formats file")
+	}
+	for name, format := range loaded {
+		err = format.validate()
+		if err != nil {
+			return errors.Wrapf(err, "invalid format %v", name)
+		}
+		Register(name, format)
+	}
+	return nil
+}
+
+func (c CSV) validate() error {
+	if c.TimeColumn == "" {
+		return errors.New("time_column is required")
+	}
+	if c.Timezone != "" {
+		_, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return errors.Wrap(err, "invalid timezone")
+		}
+	}
+	for name, column := range c.Columns {
+		if column.Field == "" {
+			return fmt.Errorf("column %v has no field", name)
+		}
+		if _, ok := units[column.Unit]; !ok {
+			return fmt.Errorf("column %v has an unknown unit %q", name, column.Unit)
+		}
+	}
+	return nil
+}
+
+// units converts values to the units of our fields
+var units = map[string]func(float64) float64{
+	"":     func(v float64) float64 { return v },
+	"kg":   func(v float64) float64 { return v },
+	"g":    func(v float64) float64 { return v / 1000 },
+	"lb":   func(v float64) float64 { return v * 0.45359237 },
+	"degC": func(v float64) float64 { return v },
+	"degF": func(v float64) float64 { return (v - 32) * 5 / 9 },
+}
+
+func (c CSV) Read(r io.Reader, fn func(Row) error) error {
+	location := time.UTC
+	if c.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(c.Timezone)
+		if err != nil {
+			return errors.Wrap(err, "invalid timezone")
+		}
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	if c.Delimiter != "" {
+		reader.Comma = []rune(c.Delimiter)[0]
+	}
+	header, err := reader.Read()
+	if err != nil {
+		return errors.Wrap(err, "fail to read header")
+	}
+
+	timeIndex, deviceIndex := -1, -1
+	columns := make(map[int]Column)
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		switch {
+		case strings.EqualFold(name, c.TimeColumn):
+			timeIndex = i
+		case deviceIndex < 0 && c.isDeviceColumn(name):
+			deviceIndex = i
+		case len(c.Columns) == 0:
+			columns[i] = Column{Field: name}
+		default:
+			for mapped, column := range c.Columns {
+				if strings.EqualFold(name, mapped) {
+					columns[i] = column
+				}
+			}
+		}
+	}
+	if timeIndex < 0 {
+		return fmt.Errorf("no %v column", c.TimeColumn)
+	}
+	if len(columns) == 0 {
+		return errors.New("no known column")
+	}
+
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		row := Row{Line: line}
+		if err != nil {
+			row.Err = err
+		} else {
+			row = c.row(line, record, timeIndex, deviceIndex, columns, location)
+		}
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c CSV) isDeviceColumn(name string) bool {
+	for _, column := range strings.Split(c.DeviceColumn, ",") {
+		column = strings.TrimSpace(column)
+		if column != "" && strings.EqualFold(name, column) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CSV) row(line int, record []string, timeIndex, deviceIndex int, columns map[int]Column, location *time.Location) Row {
+	row := Row{Line: line, Fields: make(map[string]interface{})}
+	if timeIndex >= len(record) {
+		row.Err = errors.New("missing time")
+		return row
+	}
+	t, err := parseTime(strings.TrimSpace(record[timeIndex]), c.TimeLayout, location)
+	if err != nil {
+		row.Err = fmt.Errorf("invalid time %q", record[timeIndex])
+		return row
+	}
+	row.Time = t
+	if deviceIndex >= 0 && deviceIndex < len(record) {
+		row.Device = strings.TrimSpace(record[deviceIndex])
+	}
+
+	for i, column := range columns {
+		if i >= len(record) || strings.TrimSpace(record[i]) == "" {
+			continue
+		}
+		value := strings.TrimSpace(record[i])
+		f, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+		if err != nil {
+			if column.Unit != "" {
+				row.Err = fmt.Errorf("invalid %v value %q", column.Field, value)
+				return row
+			}
+			if b, err := strconv.ParseBool(value); err == nil {
+				row.Fields[column.Field] = b
+			} else {
+				row.Fields[column.Field] = value
+			}
+			continue
+		}
+		row.Fields[column.Field] = units[column.Unit](f)
+	}
+	return row
+}
+
+// parseTime uses the layout if set, RFC3339 times, unix timestamps and
+// "2006-01-02 15:04:05" otherwise
+func parseTime(value, layout string, location *time.Location) (time.Time, error) {
+	if layout != "" {
+		return time.ParseInLocation(layout, value, location)
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", value, location)
+}
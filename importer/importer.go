@@ -0,0 +1,254 @@
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/johnsudaar/ruche/uplink"
+	"github.com/pkg/errors"
+)
+
+const maxErrors = 100
+
+type Options struct {
+	Format string
+	// Device is the hive name or stream ID of the rows without device column
+	Device    string
+	BatchSize int
+	// StateFile keeps the last line written, an interrupted import of the same
+	// file restarts after it
+	StateFile string
+	// Progress receives a line after every batch if set
+	Progress io.Writer
+}
+
+type Report struct {
+	Lines    int      `json:"lines"`
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Errors   []string `json:"errors"`
+}
+
+// state is the progress of an import, the hash identifies the file
+type state struct {
+	SHA256 string `json:"sha256"`
+	Line   int    `json:"line"`
+}
+
+type device struct {
+	streamID string
+	model    string
+	schema   decoder.Schema
+}
+
+// Run imports an export file through the configured sinks. The file is read
+// once to count and hash it, then the rows are written in batches.
+func Run(ctx context.Context, path string, opts Options) (Report, error) {
+	log := logger.Get(ctx).WithField("file", path).WithField("format", opts.Format)
+	report := Report{Errors: []string{}}
+
+	reader, ok := Get(opts.Format)
+	if !ok {
+		return report, fmt.Errorf("unknown format %q", opts.Format)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	hash, total, err := scan(path, reader)
+	if err != nil {
+		return report, errors.Wrap(err, "fail to read file")
+	}
+
+	resume := 0
+	if opts.StateFile != "" {
+		previous, err := readState(opts.StateFile)
+		if err != nil {
+			return report, errors.Wrap(err, "fail to read state file")
+		}
+		if previous.SHA256 == hash {
+			resume = previous.Line
+			log.WithField("line", resume).Info("Resuming import")
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return report, errors.Wrap(err, "fail to open file")
+	}
+	defer file.Close()
+
+	devices := make(map[string]device)
+	var batch []sink.Point
+	lastLine := 0
+	flush := func() error {
+		if len(batch) > 0 {
+			err := sink.Write(ctx, batch)
+			if err != nil {
+				return errors.Wrap(err, "fail to write points")
+			}
+			batch = nil
+		}
+		if opts.StateFile != "" {
+			// The asynchronous sinks must have stored the points before the
+			// lines are recorded as imported
+			err := sink.Flush(ctx)
+			if err != nil {
+				return errors.Wrap(err, "fail to flush points")
+			}
+			err = writeState(opts.StateFile, state{SHA256: hash, Line: lastLine})
+			if err != nil {
+				return errors.Wrap(err, "fail to write state file")
+			}
+		}
+		if opts.Progress != nil {
+			fmt.Fprintf(opts.Progress, "%v/%v rows, %v imported\n", report.Lines, total, report.Imported)
+		}
+		return nil
+	}
+
+	pending := 0
+	err = reader.Read(file, func(row Row) error {
+		report.Lines++
+		lastLine = row.Line
+		if row.Line <= resume {
+			report.Skipped++
+			return nil
+		}
+
+		points, err := rowPoints(row, opts.Device, devices)
+		if err != nil {
+			report.addErrors(fmt.Sprintf("line %v: %v", row.Line, err))
+		} else {
+			for _, p := range points {
+				batch = append(batch, p.At(row.Time))
+			}
+			report.Imported++
+			pending++
+		}
+
+		if pending >= opts.BatchSize {
+			pending = 0
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return report, errors.Wrap(err, "fail to import rows")
+	}
+	err = flush()
+	if err != nil {
+		return report, err
+	}
+
+	log.WithField("imported", report.Imported).WithField("errors", len(report.Errors)).Info("File imported")
+	return report, nil
+}
+
+func rowPoints(row Row, defaultDevice string, devices map[string]device) ([]uplink.Point, error) {
+	if row.Err != nil {
+		return nil, row.Err
+	}
+	name := row.Device
+	if name == "" {
+		name = defaultDevice
+	}
+	if name == "" {
+		return nil, errors.New("no device, set --device")
+	}
+
+	d, ok := devices[name]
+	if !ok {
+		found, ok := registry.Get().DeviceByHive(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown hive %q", name)
+		}
+		d = device{streamID: found.StreamID, model: found.Model}
+		if d.model == "" {
+			d.model = decoder.DefaultModel
+		}
+		d.schema, _ = decoder.SchemaOf(d.model)
+		devices[name] = d
+	}
+
+	if len(row.Fields) == 0 {
+		return nil, errors.New("no value")
+	}
+	if d.schema != nil {
+		if errs := d.schema.Validate(row.Fields); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid fields %v", errs)
+		}
+	}
+	return uplink.FieldPoints(d.streamID, d.model, row.Fields)
+}
+
+// scan returns the hash of the file and its number of rows
+func scan(path string, reader Reader) (string, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	rows := 0
+	err = reader.Read(io.TeeReader(file, hash), func(Row) error {
+		rows++
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	// The reader may stop before the end of the file
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), rows, nil
+}
+
+func readState(path string) (state, error) {
+	var s state
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(content, &s)
+	return s, err
+}
+
+// writeState replaces the state file atomically
+func writeState(path string, s state) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	err = os.WriteFile(tmp, content, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (r *Report) addErrors(errs ...string) {
+	for _, err := range errs {
+		if len(r.Errors) >= maxErrors {
+			return
+		}
+		r.Errors = append(r.Errors, err)
+	}
+}
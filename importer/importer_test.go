@@ -0,0 +1,201 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+	"github.com/johnsudaar/ruche/sink"
+)
+
+// memorySink keeps the written points and fails after a number of writes
+type memorySink struct {
+	points    []sink.Point
+	failAfter int
+	writes    int
+}
+
+func (s *memorySink) Write(ctx context.Context, points []sink.Point) error {
+	s.writes++
+	if s.failAfter > 0 && s.writes > s.failAfter {
+		return errors.New("sink unavailable")
+	}
+	s.points = append(s.points, points...)
+	return nil
+}
+
+// bufferedSink keeps the written points until they are flushed, the flushes
+// fail after a number of them
+type bufferedSink struct {
+	pending   []sink.Point
+	points    []sink.Point
+	failAfter int
+	flushes   int
+}
+
+func (s *bufferedSink) Write(ctx context.Context, points []sink.Point) error {
+	s.pending = append(s.pending, points...)
+	return nil
+}
+
+func (s *bufferedSink) Flush(ctx context.Context) error {
+	s.flushes++
+	if s.failAfter > 0 && s.flushes > s.failAfter {
+		return errors.New("remote unavailable")
+	}
+	s.points = append(s.points, s.pending...)
+	s.pending = nil
+	return nil
+}
+
+func Test_BroodMinder(t *testing.T) {
+	export := "Device_ID,Sample,UTC_TimeStamp,Temperature,Humidity,Weight\n" +
+		"43:10:CD,1,2021-07-01 12:00:00,95,60,110.231\n" +
+		"43:10:CD,2,2021-07-01 12:15:00,abc,60,110\n"
+
+	var rows []Row
+	err := formats[FormatBroodMinder].Read(strings.NewReader(export), func(r Row) error {
+		rows = append(rows, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Err != nil || rows[1].Err == nil {
+		t.Fatalf("unexpected rows %+v", rows)
+	}
+	if rows[0].Device != "43:10:CD" || rows[0].Time.Hour() != 12 {
+		t.Fatalf("unexpected row %+v", rows[0])
+	}
+	if temp := rows[0].Fields["temp"].(float64); temp != 35 {
+		t.Fatalf("expected 35°C, got %v", temp)
+	}
+	if mass := rows[0].Fields["mass_r1"].(float64); math.Abs(mass-50) > 0.001 {
+		t.Fatalf("expected 50 kg, got %v", mass)
+	}
+	if _, ok := rows[0].Fields["Sample"]; ok {
+		t.Fatal("unmapped columns must be ignored")
+	}
+}
+
+func Test_RunResume(t *testing.T) {
+	dir := t.TempDir()
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "chenes"}},
+		Devices:  []registry.Device{{StreamID: "1A2B3C", Apiary: "chenes", Hive: "reine-2024"}},
+	})
+
+	path := filepath.Join(dir, "export.csv")
+	content := "time,temp,hum\n"
+	for i := 0; i < 5; i++ {
+		content += fmt.Sprintf("2021-07-01T12:0%v:00Z,30,60\n", i)
+	}
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Format: FormatRuche, Device: "reine-2024", BatchSize: 2, StateFile: path + ".state"}
+
+	failing := &memorySink{failAfter: 1}
+	sink.Use(failing)
+	_, err = Run(context.Background(), path, opts)
+	if err == nil {
+		t.Fatal("expected the import to be interrupted")
+	}
+	if len(failing.points) != 2 || failing.points[0].Tags["stream_id"] != "1A2B3C" || failing.points[0].Tags["apiary"] != "chenes" {
+		t.Fatalf("unexpected points %+v", failing.points)
+	}
+
+	resumed := &memorySink{}
+	sink.Use(resumed)
+	report, err := Run(context.Background(), path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 2 || report.Imported != 3 || len(resumed.points) != 3 {
+		t.Fatalf("expected the import to resume after the first batch: %+v", report)
+	}
+}
+
+func Test_RunFlush(t *testing.T) {
+	dir := t.TempDir()
+	registrytest.Use(t, registry.Registry{
+		Devices: []registry.Device{{StreamID: "1A2B3C", Hive: "reine-2024"}},
+	})
+
+	path := filepath.Join(dir, "export.csv")
+	content := "time,temp,hum\n"
+	for i := 0; i < 5; i++ {
+		content += fmt.Sprintf("2021-07-01T12:0%v:00Z,30,60\n", i)
+	}
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Format: FormatRuche, Device: "reine-2024", BatchSize: 2, StateFile: path + ".state"}
+
+	// The second batch is written but not pushed, its lines must be imported
+	// again
+	buffered := &bufferedSink{failAfter: 1}
+	sink.Use(buffered)
+	defer sink.Use()
+	_, err = Run(context.Background(), path, opts)
+	if err == nil {
+		t.Fatal("expected the import to be interrupted")
+	}
+	if len(buffered.points) != 2 {
+		t.Fatalf("unexpected pushed points %+v", buffered.points)
+	}
+
+	resumed := &bufferedSink{}
+	sink.Use(resumed)
+	report, err := Run(context.Background(), path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 2 || report.Imported != 3 || len(resumed.points) != 3 {
+		t.Fatalf("expected the import to resume after the first pushed batch: %+v", report)
+	}
+}
+
+func Test_RunSeveralHives(t *testing.T) {
+	dir := t.TempDir()
+	registrytest.Use(t, registry.Registry{
+		Devices: []registry.Device{
+			{StreamID: "1A2B3C", Hive: "reine-2024"},
+			{StreamID: "4D5E6F", Hive: "noire"},
+		},
+	})
+
+	path := filepath.Join(dir, "export.csv")
+	content := "time,hive,temp\n2021-07-01T12:00:00Z,reine-2024,30\n2021-07-01T12:00:00Z,noire,31\n"
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memory := &memorySink{}
+	sink.Use(memory)
+	report, err := Run(context.Background(), path, Options{Format: FormatRuche, StateFile: path + ".state"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 || len(memory.points) != 2 {
+		t.Fatalf("expected the readings of both hives: %+v", report)
+	}
+	for _, p := range memory.points {
+		if _, ok := p.Values["hive"]; ok {
+			t.Fatalf("the hive column must not be a field: %+v", p)
+		}
+	}
+	if memory.points[1].Tags["stream_id"] != "4D5E6F" || memory.points[1].Values["temp"] != 31.0 {
+		t.Fatalf("unexpected point %+v", memory.points[1])
+	}
+}
@@ -0,0 +1,190 @@
+package influx
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// cqPrefix starts the names of the continuous queries created by ruche, the
+// others are left untouched
+const cqPrefix = "ruche_"
+
+// Rollup is a retention policy storing the mean, min and max of the raw
+// fields over every interval
+type Rollup struct {
+	Name     string
+	Interval string
+	Duration string
+}
+
+// BootstrapOptions describes the database to provision
+type BootstrapOptions struct {
+	// RawPolicy is the default retention policy, the readings are written in it
+	RawPolicy   string
+	RawDuration string
+	Rollups     []Rollup
+	// Numeric fields downsampled by the continuous queries, by measurement
+	Measurements map[string][]string
+}
+
+// ParseRollups parses rollups written as name:interval:duration, for instance
+// hourly:1h:365d
+func ParseRollups(specs []string) ([]Rollup, error) {
+	rollups := []Rollup{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, errgo.Newf("invalid rollup %q, expected name:interval:duration", spec)
+		}
+		rollups = append(rollups, Rollup{Name: parts[0], Interval: parts[1], Duration: parts[2]})
+	}
+	return rollups, nil
+}
+
+// Bootstrap creates the database of the URL if missing, its retention
+// policies and the continuous queries of the rollups of every measurement. It
+// can be run on every start: existing policies are altered and the continuous
+// queries whose definition changed are replaced. Only the continuous queries
+// named with the ruche_ prefix are managed.
+func Bootstrap(influxURL string, opts BootstrapOptions) error {
+	infos, err := parseConnectionString(influxURL)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	db := QuoteIdent(infos.Database)
+
+	_, err = Query(influxURL, "CREATE DATABASE "+db)
+	if err != nil {
+		return errgo.Notef(err, "fail to create database")
+	}
+
+	policies, err := QueryRows(influxURL, "SHOW RETENTION POLICIES ON "+db)
+	if err != nil {
+		return errgo.Notef(err, "fail to list retention policies")
+	}
+	existing := make(map[string]bool)
+	for _, p := range policies {
+		existing[fmt.Sprint(p.Values["name"])] = true
+	}
+
+	err = retentionPolicy(influxURL, db, existing, opts.RawPolicy, opts.RawDuration, true)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, r := range opts.Rollups {
+		err = retentionPolicy(influxURL, db, existing, r.Name, r.Duration, false)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+
+	queries, err := QueryRows(influxURL, "SHOW CONTINUOUS QUERIES")
+	if err != nil {
+		return errgo.Notef(err, "fail to list continuous queries")
+	}
+	var current []string
+	for _, q := range queries {
+		if q.Measurement == infos.Database {
+			current = append(current, fmt.Sprint(q.Values["name"]))
+		}
+	}
+
+	// The continuous queries of ruche which are not expected anymore are
+	// dropped, including those of the rollups removed from the configuration
+	expected := make(map[string]string)
+	for measurement, fields := range opts.Measurements {
+		if len(fields) == 0 {
+			continue
+		}
+		for _, r := range opts.Rollups {
+			name, query := ContinuousQuery(infos.Database, opts.RawPolicy, measurement, fields, r)
+			expected[name] = query
+		}
+	}
+	for _, c := range current {
+		if _, ok := expected[c]; ok {
+			delete(expected, c)
+			continue
+		}
+		if !strings.HasPrefix(c, cqPrefix) {
+			continue
+		}
+		_, err = Query(influxURL, fmt.Sprintf("DROP CONTINUOUS QUERY %s ON %s", QuoteIdent(c), db))
+		if err != nil {
+			return errgo.Notef(err, "fail to drop continuous query %v", c)
+		}
+	}
+
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, err = Query(influxURL, expected[name])
+		if err != nil {
+			return errgo.Notef(err, "fail to create continuous query %v", name)
+		}
+	}
+	return nil
+}
+
+func retentionPolicy(influxURL, db string, existing map[string]bool, name, duration string, isDefault bool) error {
+	verb := "CREATE"
+	if existing[name] {
+		verb = "ALTER"
+	}
+	query := fmt.Sprintf("%s RETENTION POLICY %s ON %s DURATION %s", verb, QuoteIdent(name), db, duration)
+	if verb == "CREATE" {
+		query += " REPLICATION 1"
+	}
+	if isDefault {
+		query += " DEFAULT"
+	}
+	_, err := Query(influxURL, query)
+	if err != nil {
+		return errgo.Notef(err, "fail to %s retention policy %v", strings.ToLower(verb), name)
+	}
+	return nil
+}
+
+// ContinuousQuery returns the name and the definition of the continuous query
+// of a rollup of the measurement. The name ends with a hash of the definition
+// so that a changed definition is detected.
+func ContinuousQuery(database, rawPolicy, measurement string, fields []string, r Rollup) (string, string) {
+	fields = append([]string{}, fields...)
+	sort.Strings(fields)
+
+	var selects []string
+	for _, f := range fields {
+		for _, fn := range []string{"mean", "min", "max"} {
+			selects = append(selects, fmt.Sprintf("%s(%s) AS %s", fn, QuoteIdent(f), QuoteIdent(f+"_"+fn)))
+		}
+	}
+	db := QuoteIdent(database)
+	quoted := QuoteIdent(measurement)
+	query := fmt.Sprintf("SELECT %s INTO %s.%s.%s FROM %s.%s.%s GROUP BY time(%s), *",
+		strings.Join(selects, ", "),
+		db, QuoteIdent(r.Name), quoted,
+		db, QuoteIdent(rawPolicy), quoted,
+		r.Interval,
+	)
+
+	sum := sha1.Sum([]byte(query))
+	name := cqPrefix + measurement + "_" + r.Name + "_" + hex.EncodeToString(sum[:4])
+	return name, fmt.Sprintf("CREATE CONTINUOUS QUERY %s ON %s BEGIN %s END", QuoteIdent(name), db, query)
+}
+
+// QuoteIdent escapes a database, retention policy, measurement or field name
+func QuoteIdent(name string) string {
+	return `"` + strings.Replace(strings.Replace(name, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
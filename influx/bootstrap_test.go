@@ -0,0 +1,165 @@
+package influx
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fakeInflux keeps the retention policies and continuous queries created by
+// the statements it receives
+type fakeInflux struct {
+	statements []string
+	policies   map[string]bool
+	queries    map[string]string
+}
+
+var (
+	createRP = regexp.MustCompile(`^CREATE RETENTION POLICY "([^"]+)"`)
+	createCQ = regexp.MustCompile(`^CREATE CONTINUOUS QUERY "([^"]+)"`)
+	dropCQ   = regexp.MustCompile(`^DROP CONTINUOUS QUERY "([^"]+)"`)
+)
+
+func (f *fakeInflux) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	q := req.FormValue("q")
+	f.statements = append(f.statements, q)
+
+	result := map[string]interface{}{"statement_id": 0}
+	switch {
+	case strings.HasPrefix(q, "SHOW RETENTION POLICIES"):
+		values := [][]interface{}{}
+		for name := range f.policies {
+			values = append(values, []interface{}{name, "0s", "168h0m0s", 1, false})
+		}
+		result["series"] = []map[string]interface{}{{
+			"columns": []string{"name", "duration", "shardGroupDuration", "replicaN", "default"},
+			"values":  values,
+		}}
+	case strings.HasPrefix(q, "SHOW CONTINUOUS QUERIES"):
+		values := [][]interface{}{}
+		for name, query := range f.queries {
+			values = append(values, []interface{}{name, query})
+		}
+		result["series"] = []map[string]interface{}{{
+			"name":    "ruche",
+			"columns": []string{"name", "query"},
+			"values":  values,
+		}}
+	case createRP.MatchString(q):
+		f.policies[createRP.FindStringSubmatch(q)[1]] = true
+	case createCQ.MatchString(q):
+		f.queries[createCQ.FindStringSubmatch(q)[1]] = q
+	case dropCQ.MatchString(q):
+		delete(f.queries, dropCQ.FindStringSubmatch(q)[1])
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(map[string]interface{}{"results": []interface{}{result}})
+}
+
+func (f *fakeInflux) count(prefix string) int {
+	n := 0
+	for _, s := range f.statements {
+		if strings.HasPrefix(s, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func Test_Bootstrap(t *testing.T) {
+	fake := &fakeInflux{policies: map[string]bool{"autogen": true}, queries: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	url := server.URL + "/ruche"
+
+	rollups, err := ParseRollups([]string{"hourly:1h:365d", "daily:1d:INF"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := BootstrapOptions{
+		RawPolicy:   "autogen",
+		RawDuration: "30d",
+		Rollups:     rollups,
+		Measurements: map[string][]string{
+			"raw":   {"mass_r0", "temp_r0"},
+			"sound": {"level"},
+		},
+	}
+
+	err = Bootstrap(url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.count(`ALTER RETENTION POLICY "autogen" ON "ruche" DURATION 30d DEFAULT`) != 1 {
+		t.Fatalf("expected the raw policy to be altered: %v", fake.statements)
+	}
+	if !fake.policies["hourly"] || !fake.policies["daily"] || len(fake.queries) != 4 {
+		t.Fatalf("expected rollups to be created: %v", fake.statements)
+	}
+	for name, q := range fake.queries {
+		switch {
+		case strings.HasPrefix(name, "ruche_raw_"):
+			if !strings.Contains(q, `max("temp_r0") AS "temp_r0_max"`) {
+				t.Fatalf("unexpected continuous query %v", q)
+			}
+		case strings.HasPrefix(name, "ruche_sound_"):
+			if !strings.Contains(q, `max("level") AS "level_max"`) || !strings.Contains(q, `FROM "ruche"."autogen"."sound"`) {
+				t.Fatalf("unexpected continuous query %v", q)
+			}
+		default:
+			t.Fatalf("unexpected continuous query name %v", name)
+		}
+	}
+
+	// A second start does not change anything
+	fake.statements = nil
+	err = Bootstrap(url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.count("CREATE CONTINUOUS QUERY") != 0 || fake.count("DROP CONTINUOUS QUERY") != 0 || fake.count("CREATE RETENTION POLICY") != 0 {
+		t.Fatalf("expected bootstrap to be idempotent: %v", fake.statements)
+	}
+
+	// A new field replaces the continuous queries
+	fake.statements = nil
+	opts.Measurements["raw"] = append(opts.Measurements["raw"], "humidity")
+	err = Bootstrap(url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.count("DROP CONTINUOUS QUERY") != 2 || fake.count("CREATE CONTINUOUS QUERY") != 2 || len(fake.queries) != 4 {
+		t.Fatalf("expected continuous queries to be replaced: %v", fake.statements)
+	}
+
+	// The queries of a removed rollup are dropped, the queries created by
+	// the operators are kept
+	fake.statements = nil
+	fake.queries["raw_daily_custom"] = "CREATE CONTINUOUS QUERY"
+	opts.Rollups = rollups[:1]
+	err = Bootstrap(url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.count("DROP CONTINUOUS QUERY") != 2 || fake.count("CREATE CONTINUOUS QUERY") != 0 || len(fake.queries) != 3 {
+		t.Fatalf("expected the daily continuous queries to be dropped: %v", fake.statements)
+	}
+	if _, ok := fake.queries["raw_daily_custom"]; !ok {
+		t.Fatalf("expected the query of the operator to be kept: %v", fake.queries)
+	}
+	for name := range fake.queries {
+		if strings.HasPrefix(name, "ruche_raw_daily_") || strings.HasPrefix(name, "ruche_sound_daily_") {
+			t.Fatalf("daily continuous query kept: %v", fake.queries)
+		}
+	}
+}
+
+func Test_ParseRollups(t *testing.T) {
+	_, err := ParseRollups([]string{"hourly:1h"})
+	if err == nil {
+		t.Fatal("expected an error for a rollup without duration")
+	}
+}
@@ -0,0 +1,193 @@
+package influx
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	FieldFloat   = "float"
+	FieldInteger = "integer"
+	FieldString  = "string"
+	FieldBoolean = "boolean"
+)
+
+// FieldTypes returns the types of the fields stored in the measurement
+func FieldTypes(influxURL, measurement string) (map[string]string, error) {
+	rows, err := QueryRows(influxURL, "SHOW FIELD KEYS FROM "+QuoteIdent(measurement))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	types := make(map[string]string)
+	for _, row := range rows {
+		types[fmt.Sprint(row.Values["fieldKey"])] = fmt.Sprint(row.Values["fieldType"])
+	}
+	return types, nil
+}
+
+// TypeOf returns the type a value is written with, empty if the value cannot
+// be written
+func TypeOf(value interface{}) string {
+	switch value.(type) {
+	case float32, float64:
+		return FieldFloat
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return FieldInteger
+	case string:
+		return FieldString
+	case bool:
+		return FieldBoolean
+	}
+	return ""
+}
+
+// Conflict is a value whose type is not the type of its stored field
+type Conflict struct {
+	Measurement string
+	Field       string
+	Stored      string
+	Written     string
+}
+
+// ConflictsError is returned by Write when values were dropped because of
+// their type, the other values are written
+type ConflictsError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictsError) Error() string {
+	var conflicts []string
+	for _, c := range e.Conflicts {
+		conflicts = append(conflicts, fmt.Sprintf("%v value of %v.%v dropped, the field is %v", c.Written, c.Measurement, c.Field, c.Stored))
+	}
+	return "field type conflict: " + strings.Join(conflicts, ", ")
+}
+
+// storedTypes caches the field types of the measurements of every database,
+// by connection string then measurement. The types of new fields are only
+// added once written.
+var storedTypes = struct {
+	sync.Mutex
+	types map[string]map[string]map[string]string
+}{types: make(map[string]map[string]map[string]string)}
+
+// check returns the batch with its values converted to the stored types, the
+// values which could not be converted and the types of the new fields. A
+// field written with another type than the stored one is rejected by InfluxDB
+// with the whole batch: integers are written as floats in float fields, whole
+// floats as integers in integer fields, and the other conflicting values are
+// dropped.
+func check(influxURL string, bp influx.BatchPoints) (influx.BatchPoints, []Conflict, map[string]map[string]string, error) {
+	checked, err := influx.NewBatchPoints(influx.BatchPointsConfig{
+		Database:         bp.Database(),
+		Precision:        bp.Precision(),
+		RetentionPolicy:  bp.RetentionPolicy(),
+		WriteConsistency: bp.WriteConsistency(),
+	})
+	if err != nil {
+		return nil, nil, nil, errgo.Mask(err)
+	}
+
+	storedTypes.Lock()
+	defer storedTypes.Unlock()
+	database, ok := storedTypes.types[influxURL]
+	if !ok {
+		database = make(map[string]map[string]string)
+		storedTypes.types[influxURL] = database
+	}
+
+	var conflicts []Conflict
+	added := make(map[string]map[string]string)
+	for _, pt := range bp.Points() {
+		measurement := pt.Name()
+		types, ok := database[measurement]
+		if !ok {
+			types, err = FieldTypes(influxURL, measurement)
+			if err != nil {
+				return nil, nil, nil, errgo.Notef(err, "fail to get field types of %v", measurement)
+			}
+			database[measurement] = types
+		}
+		if added[measurement] == nil {
+			added[measurement] = make(map[string]string)
+		}
+
+		fields, err := pt.Fields()
+		if err != nil {
+			return nil, nil, nil, errgo.Mask(err)
+		}
+		values := make(map[string]interface{}, len(fields))
+		for field, value := range fields {
+			written := TypeOf(value)
+			stored, ok := types[field]
+			if !ok {
+				stored, ok = added[measurement][field]
+			}
+			if !ok {
+				added[measurement][field] = written
+			}
+			if !ok || stored == written {
+				values[field] = value
+				continue
+			}
+			if converted, ok := convert(value, stored); ok {
+				values[field] = converted
+				continue
+			}
+			conflicts = append(conflicts, Conflict{Measurement: measurement, Field: field, Stored: stored, Written: written})
+		}
+		if len(values) == 0 {
+			continue
+		}
+		converted, err := influx.NewPoint(measurement, pt.Tags(), values, pt.Time())
+		if err != nil {
+			return nil, nil, nil, errgo.Mask(err)
+		}
+		checked.AddPoint(converted)
+	}
+	return checked, conflicts, added, nil
+}
+
+// addTypes stores the types of the written fields
+func addTypes(influxURL string, added map[string]map[string]string) {
+	storedTypes.Lock()
+	defer storedTypes.Unlock()
+	for measurement, fields := range added {
+		types := storedTypes.types[influxURL][measurement]
+		for field, written := range fields {
+			if _, ok := types[field]; !ok {
+				types[field] = written
+			}
+		}
+	}
+}
+
+// forgetTypes removes the cached types of the measurements of the batch
+func forgetTypes(influxURL string, bp influx.BatchPoints) {
+	storedTypes.Lock()
+	defer storedTypes.Unlock()
+	for _, pt := range bp.Points() {
+		delete(storedTypes.types[influxURL], pt.Name())
+	}
+}
+
+// convert returns the value in the stored type if it can be converted without
+// loss
+func convert(value interface{}, stored string) (interface{}, bool) {
+	switch stored {
+	case FieldFloat:
+		if i, ok := value.(int64); ok {
+			return float64(i), true
+		}
+	case FieldInteger:
+		if f, ok := value.(float64); ok && f == math.Trunc(f) {
+			return int64(f), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,103 @@
+package influx
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_WriteFieldTypes(t *testing.T) {
+	var written []string
+	fail := true
+	conflict := false
+	stored := [][]interface{}{{"temp", "float"}}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			if fail {
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if conflict {
+				resp.Header().Set("Content-Type", "application/json")
+				resp.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(resp).Encode(map[string]string{
+					"error": `partial write: field type conflict: input field "level" on measurement "raw" is type float, already exists as type string dropped=1`,
+				})
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			written = append(written, string(body))
+			resp.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(map[string]interface{}{"results": []interface{}{map[string]interface{}{
+			"statement_id": 0,
+			"series": []map[string]interface{}{{
+				"name":    "raw",
+				"columns": []string{"fieldKey", "fieldType"},
+				"values":  stored,
+			}},
+		}}})
+	}))
+	defer server.Close()
+	url := server.URL + "/ruche"
+
+	write := func(values map[string]interface{}) error {
+		bp, err := Start(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Add("raw", values, map[string]string{"stream_id": "dev"}, bp, time.Unix(1651406400, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Write(url, bp)
+	}
+
+	// The type of a new field is only known once written
+	err := write(map[string]interface{}{"temp": 21, "note": "full"})
+	if err == nil {
+		t.Fatal("expected a write error")
+	}
+	fail = false
+	err = write(map[string]interface{}{"temp": 21, "note": 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 || !strings.Contains(written[0], "note=1.5") || !strings.Contains(written[0], "temp=21 ") {
+		t.Fatalf("unexpected points %q", written)
+	}
+
+	err = write(map[string]interface{}{"temp": "hot", "note": 2})
+	conflicts, ok := err.(*ConflictsError)
+	if !ok || len(conflicts.Conflicts) != 1 || conflicts.Conflicts[0].Field != "temp" {
+		t.Fatalf("expected a conflict on temp, got %v", err)
+	}
+	if len(written) != 2 || written[1] != "raw,stream_id=dev note=2 1651406400\n" {
+		t.Fatalf("expected the other values to be written, got %q", written)
+	}
+
+	// The field has been written with another type by another client, the
+	// types are read again after the conflict reported by InfluxDB
+	err = write(map[string]interface{}{"level": 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored = append(stored, []interface{}{"level", "string"})
+	conflict = true
+	err = write(map[string]interface{}{"level": 2.5})
+	if err == nil || !strings.Contains(err.Error(), "field type conflict") {
+		t.Fatalf("expected a field type conflict, got %v", err)
+	}
+	conflict = false
+	err = write(map[string]interface{}{"level": 3.5, "note": 3})
+	conflicts, ok = err.(*ConflictsError)
+	if !ok || len(conflicts.Conflicts) != 1 || conflicts.Conflicts[0].Field != "level" || conflicts.Conflicts[0].Stored != "string" {
+		t.Fatalf("expected a conflict on level, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Package influxtest provides a fake InfluxDB server for the tests of the
+// packages querying and writing points
+package influxtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serie is a serie of a query result
+type Serie struct {
+	Name    string            `json:"name,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+// Point is a point written to the server
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	// Fields are kept as written: strings are unquoted, integers keep their
+	// i suffix
+	Fields map[string]string
+	Time   time.Time
+}
+
+// Server answers the queries with the series returned by Respond and keeps
+// the statements and the written points
+type Server struct {
+	server *httptest.Server
+	// Respond returns the series of a query, it may be nil
+	Respond func(query string) []Serie
+
+	lock    sync.Mutex
+	queries []string
+	points  []Point
+}
+
+// New starts a server closed at the end of the test
+func New(t *testing.T) *Server {
+	s := &Server{}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// URL is the connection string of the ruche database of the server
+func (s *Server) URL() string {
+	return s.server.URL + "/ruche"
+}
+
+// Queries returns the received statements
+func (s *Server) Queries() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.queries...)
+}
+
+// Points returns the points written in the measurement
+func (s *Server) Points(measurement string) []Point {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var points []Point
+	for _, p := range s.points {
+		if p.Measurement == measurement {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+func (s *Server) serveHTTP(resp http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/write") {
+		points, err := parseLines(req)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.lock.Lock()
+		s.points = append(s.points, points...)
+		s.lock.Unlock()
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	q := req.FormValue("q")
+	s.lock.Lock()
+	s.queries = append(s.queries, q)
+	s.lock.Unlock()
+
+	result := map[string]interface{}{"statement_id": 0}
+	if s.Respond != nil {
+		if series := s.Respond(q); len(series) > 0 {
+			result["series"] = series
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(map[string]interface{}{"results": []interface{}{result}})
+}
+
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond, "u": time.Microsecond, "ms": time.Millisecond,
+	"s": time.Second, "m": time.Minute, "h": time.Hour,
+}
+
+func parseLines(req *http.Request) ([]Point, error) {
+	unit, ok := precisions[req.URL.Query().Get("precision")]
+	if !ok {
+		unit = time.Nanosecond
+	}
+	var points []Point
+	scanner := bufio.NewScanner(req.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		parts := split(line, ' ')
+		p := Point{Tags: map[string]string{}, Fields: map[string]string{}}
+		key := split(parts[0], ',')
+		p.Measurement = unescape(key[0])
+		for _, tag := range key[1:] {
+			kv := split(tag, '=')
+			p.Tags[unescape(kv[0])] = unescape(kv[1])
+		}
+		if len(parts) > 1 {
+			for _, field := range split(parts[1], ',') {
+				kv := split(field, '=')
+				value := kv[1]
+				if strings.HasPrefix(value, `"`) {
+					value = strings.Replace(strings.Trim(value, `"`), `\"`, `"`, -1)
+				}
+				p.Fields[unescape(kv[0])] = value
+			}
+		}
+		if len(parts) > 2 {
+			ts, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			p.Time = time.Unix(0, ts*int64(unit)).UTC()
+		}
+		points = append(points, p)
+	}
+	return points, scanner.Err()
+}
+
+// split splits the line protocol on the separator outside of quotes and
+// escapes
+func split(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(`\ `, " ", `\,`, ",", `\=`, "=").Replace(s)
+}
@@ -0,0 +1,95 @@
+package influx
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+	"gopkg.in/errgo.v1"
+)
+
+// Row is a row of a query result with the tags of its serie
+type Row struct {
+	Measurement string
+	Tags        map[string]string
+	Time        time.Time
+	Values      map[string]interface{}
+}
+
+func Query(influxURL string, query string) ([]influx.Result, error) {
+	client, infos, err := Client(influxURL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer client.Close()
+
+	res, err := client.Query(influx.NewQuery(query, infos.Database, ""))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if res.Error() != nil {
+		return nil, errgo.Mask(res.Error())
+	}
+	return res.Results, nil
+}
+
+// QueryRows runs the query and flattens the series, null values are omitted
+func QueryRows(influxURL string, query string) ([]Row, error) {
+	results, err := Query(influxURL, query)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	rows := []Row{}
+	for _, result := range results {
+		for _, serie := range result.Series {
+			for _, values := range serie.Values {
+				row := Row{
+					Measurement: serie.Name,
+					Tags:        serie.Tags,
+					Values:      make(map[string]interface{}),
+				}
+				for i, column := range serie.Columns {
+					if column == "time" {
+						row.Time, err = time.Parse(time.RFC3339Nano, fmt.Sprint(values[i]))
+						if err != nil {
+							return nil, errgo.Notef(err, "invalid time")
+						}
+						continue
+					}
+					if values[i] != nil {
+						row.Values[column] = values[i]
+					}
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// Float converts a value returned by a query to a float
+func Float(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Quote escapes a string to be used as a tag value in a query
+func Quote(value string) string {
+	return "'" + strings.Replace(strings.Replace(value, `\`, `\\`, -1), "'", `\'`, -1) + "'"
+}
+
+// Time formats a time to be used in a query
+func Time(t time.Time) string {
+	return "'" + t.UTC().Format(time.RFC3339Nano) + "'"
+}
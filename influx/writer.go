@@ -1,12 +1,36 @@
 package influx
 
 import (
+	"strings"
 	"time"
 
 	influx "github.com/influxdata/influxdb/client/v2"
 	"gopkg.in/errgo.v1"
 )
 
+// precision of the written times, the times are truncated to it
+var precision = "s"
+
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond, "u": time.Microsecond, "ms": time.Millisecond,
+	"s": time.Second, "m": time.Minute, "h": time.Hour,
+}
+
+// SetPrecision must be called before the first write, the precision is one of
+// ns, u, ms, s, m or h
+func SetPrecision(p string) error {
+	if _, ok := precisions[p]; !ok {
+		return errgo.Newf("invalid precision %q", p)
+	}
+	precision = p
+	return nil
+}
+
+// Truncate returns the time of the point written at t
+func Truncate(t time.Time) time.Time {
+	return t.Truncate(precisions[precision])
+}
+
 func Start(influxURL string) (*influx.BatchPoints, error) {
 	infos, err := parseConnectionString(influxURL)
 	if err != nil {
@@ -14,7 +38,7 @@ func Start(influxURL string) (*influx.BatchPoints, error) {
 	}
 	bp, err := influx.NewBatchPoints(influx.BatchPointsConfig{
 		Database:  infos.Database,
-		Precision: "s",
+		Precision: precision,
 	})
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -22,16 +46,36 @@ func Start(influxURL string) (*influx.BatchPoints, error) {
 	return &bp, nil
 }
 
+// Write checks the values against the types of the stored fields before
+// writing them. The conflicting values are dropped and reported with a
+// *ConflictsError once the other values are written.
 func Write(influxURL string, bp *influx.BatchPoints) error {
-	client, _, err := Client(influxURL)
+	checked, conflicts, added, err := check(influxURL, *bp)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	defer client.Close()
 
-	err = client.Write(*bp)
-	if err != nil {
-		return errgo.Mask(err)
+	if len(checked.Points()) > 0 {
+		client, _, err := Client(influxURL)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer client.Close()
+
+		err = client.Write(checked)
+		if err != nil {
+			// The fields were written with another type since their types
+			// were cached, they are read again on the next write
+			if strings.Contains(err.Error(), "field type conflict") {
+				forgetTypes(influxURL, checked)
+			}
+			return errgo.Mask(err)
+		}
+		addTypes(influxURL, added)
+	}
+
+	if len(conflicts) > 0 {
+		return &ConflictsError{Conflicts: conflicts}
 	}
 	return nil
 }
@@ -0,0 +1,99 @@
+package link
+
+import (
+	"sync"
+)
+
+// Stats is the state of the link of a device after a frame has been observed
+type Stats struct {
+	SeqNumber uint32
+	// Gap is the number of frames missing between the previous frame and this one
+	Gap      uint32
+	Received uint64
+	Lost     uint64
+	Resets   uint64
+	// Reset is true if the counter went back, which means the device rebooted
+	Reset     bool
+	Duplicate bool
+}
+
+// LossRate is the ratio of lost frames over the expected frames since the
+// tracker started
+func (s Stats) LossRate() float64 {
+	expected := s.Received + s.Lost
+	if expected == 0 {
+		return 0
+	}
+	return float64(s.Lost) / float64(expected)
+}
+
+type deviceState struct {
+	last     uint32
+	received uint64
+	lost     uint64
+	resets   uint64
+}
+
+// Tracker keeps the sequence counters of every device. Modulus is the number
+// of values the network counter can take before wrapping (4096 for Sigfox), 0
+// means the counter never wraps.
+type Tracker struct {
+	modulus uint32
+	lock    sync.Mutex
+	devices map[string]*deviceState
+}
+
+func NewTracker(modulus uint32) *Tracker {
+	return &Tracker{
+		modulus: modulus,
+		devices: make(map[string]*deviceState),
+	}
+}
+
+// Observe records the sequence number of a frame received from a device
+func (t *Tracker) Observe(device string, seq uint32) Stats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	state, ok := t.devices[device]
+	if !ok {
+		state = &deviceState{last: seq, received: 1}
+		t.devices[device] = state
+		return state.stats(seq)
+	}
+
+	stats := Stats{}
+	switch {
+	case seq == state.last:
+		stats.Duplicate = true
+	case seq > state.last:
+		stats.Gap = seq - state.last - 1
+	case t.modulus > 0 && seq+t.modulus-state.last < t.modulus/2:
+		// The counter wrapped
+		stats.Gap = seq + t.modulus - state.last - 1
+	default:
+		stats.Reset = true
+		state.resets++
+	}
+
+	if !stats.Duplicate {
+		state.received++
+		state.lost += uint64(stats.Gap)
+		state.last = seq
+	}
+
+	res := state.stats(seq)
+	res.Gap = stats.Gap
+	res.Reset = stats.Reset
+	res.Duplicate = stats.Duplicate
+	return res
+}
+
+func (s *deviceState) stats(seq uint32) Stats {
+	return Stats{
+		SeqNumber: seq,
+		Received:  s.received,
+		Lost:      s.lost,
+		Resets:    s.resets,
+	}
+}
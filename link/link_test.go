@@ -0,0 +1,34 @@
+package link
+
+import (
+	"testing"
+)
+
+func Test_Tracker(t *testing.T) {
+	tracker := NewTracker(4096)
+
+	tracker.Observe("dev", 10)
+	stats := tracker.Observe("dev", 13)
+	if stats.Gap != 2 || stats.Lost != 2 || stats.Received != 2 {
+		t.Fatalf("unexpected stats after gap: %+v", stats)
+	}
+	if stats.LossRate() != 0.5 {
+		t.Fatalf("expected loss rate of 0.5, got %v", stats.LossRate())
+	}
+
+	stats = tracker.Observe("dev", 13)
+	if !stats.Duplicate || stats.Received != 2 {
+		t.Fatalf("expected duplicate frame: %+v", stats)
+	}
+
+	stats = tracker.Observe("dev", 0)
+	if !stats.Reset || stats.Resets != 1 || stats.Gap != 0 {
+		t.Fatalf("expected counter reset: %+v", stats)
+	}
+
+	tracker.Observe("dev", 4094)
+	stats = tracker.Observe("dev", 1)
+	if stats.Reset || stats.Gap != 2 {
+		t.Fatalf("expected counter wrap: %+v", stats)
+	}
+}
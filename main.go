@@ -2,9 +2,20 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
 
 	"github.com/Scalingo/go-utils/logger"
 	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/flight"
+	"github.com/johnsudaar/ruche/forecast"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/nectar"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/johnsudaar/ruche/step"
+	"github.com/johnsudaar/ruche/timecheck"
 	"github.com/johnsudaar/ruche/webserver"
 	"github.com/pkg/errors"
 )
@@ -19,5 +30,118 @@ func main() {
 	ctx := logger.ToCtx(context.Background(), log)
 	log.Info("Config initialized")
 
-	webserver.Start(ctx)
+	err = timecheck.Checker{Policy: timecheck.Policy(config.Get().TimestampPolicy)}.Validate()
+	if err != nil {
+		panic(errors.Wrap(err, "invalid config"))
+	}
+
+	_, err = nectar.ParseWindow(config.Get().NectarDaytimeStart, config.Get().NectarDaytimeEnd)
+	if err != nil {
+		panic(errors.Wrap(err, "invalid config"))
+	}
+
+	err = step.ValidateSeasonStart(config.Get().SeasonStartMonth)
+	if err != nil {
+		panic(errors.Wrap(err, "invalid config"))
+	}
+
+	err = influx.SetPrecision(config.Get().InfluxPrecision)
+	if err != nil {
+		panic(errors.Wrap(err, "invalid config"))
+	}
+
+	err = registry.Init(config.Get().RegistryFile)
+	if err != nil {
+		panic(errors.Wrap(err, "fail to load registry"))
+	}
+
+	if config.Get().DecodersFile != "" {
+		err = decoder.LoadFile(config.Get().DecodersFile)
+		if err != nil {
+			panic(errors.Wrap(err, "fail to load decoders"))
+		}
+	}
+
+	if config.Get().InfluxBootstrap {
+		err = bootstrapInflux(ctx)
+		if err != nil {
+			panic(errors.Wrap(err, "fail to bootstrap influx"))
+		}
+	}
+
+	if len(os.Args) < 2 {
+		err = sink.Init(ctx)
+		if err != nil {
+			panic(errors.Wrap(err, "fail to init sinks"))
+		}
+		go flight.Job(ctx, config.Get().FlightJobInterval)
+		go nectar.Job(ctx, config.Get().NectarJobInterval)
+		go step.Job(ctx, config.Get().StepJobInterval)
+		go forecast.Job(ctx, config.Get().ForecastJobInterval)
+		webserver.Start(ctx)
+		return
+	}
+
+	switch os.Args[1] {
+	case "reprocess":
+		err = reprocessCommand(ctx, os.Args[2:])
+	case "upload":
+		err = uploadCommand(ctx, os.Args[2:])
+	case "import":
+		err = importCommand(ctx, os.Args[2:])
+	case "export":
+		err = exportCommand(ctx, os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// bootstrapInflux provisions the database with rollups of the numeric fields
+// of every model, in the measurement of its decoder
+func bootstrapInflux(ctx context.Context) error {
+	config := config.Get()
+	rollups, err := influx.ParseRollups(config.InfluxRollups)
+	if err != nil {
+		return errors.Wrap(err, "invalid rollups")
+	}
+
+	// Only the measured numbers are aggregated, not the identifiers
+	measurements := make(map[string][]string)
+	for _, model := range decoder.Models() {
+		schema, ok := decoder.SchemaOf(model)
+		if !ok {
+			continue
+		}
+		measurement := decoder.MeasurementOf(decoder.Get(model))
+		for name, field := range schema {
+			if !field.Tag && (field.Type == decoder.TypeFloat || field.Type == decoder.TypeInteger) && !contains(measurements[measurement], name) {
+				measurements[measurement] = append(measurements[measurement], name)
+			}
+		}
+	}
+
+	err = influx.Bootstrap(config.InfluxUrl, influx.BootstrapOptions{
+		RawPolicy:    config.InfluxRawPolicy,
+		RawDuration:  config.InfluxRawRetention,
+		Rollups:      rollups,
+		Measurements: measurements,
+	})
+	if err != nil {
+		return errors.Wrap(err, "fail to provision database")
+	}
+	logger.Get(ctx).WithField("rollups", len(rollups)).Info("Influx database provisioned")
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
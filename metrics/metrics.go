@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const prefix = "ruche_"
+
+// Sample is the latest value of a field
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+	// Time of the reading, an older reading does not replace the sample
+	Time time.Time
+}
+
+type device struct {
+	labels   map[string]string
+	lastSeen time.Time
+	samples  map[string]Sample
+}
+
+// Store keeps the latest value of every field of every device in memory and
+// exposes them in the Prometheus text format
+type Store struct {
+	lock    sync.Mutex
+	devices map[string]*device
+}
+
+func NewStore() *Store {
+	return &Store{devices: make(map[string]*device)}
+}
+
+// Record stores the fields of a point. Labels identify the device (stream_id,
+// apiary, hive), tags the point within the device (e.g. the probe position).
+// Fields which are neither numbers nor booleans are ignored, as well as the
+// fields of late readings older than the stored sample.
+func (s *Store) Record(streamID string, labels map[string]string, measurement string, values map[string]interface{}, tags map[string]string, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d, ok := s.devices[streamID]
+	if !ok {
+		d = &device{samples: make(map[string]Sample)}
+		s.devices[streamID] = d
+	}
+	d.labels = labels
+	if at.After(d.lastSeen) {
+		d.lastSeen = at
+	}
+
+	for field, value := range values {
+		f, ok := Value(value)
+		if !ok {
+			continue
+		}
+		sampleLabels := make(map[string]string)
+		for k, v := range labels {
+			sampleLabels[k] = v
+		}
+		for k, v := range tags {
+			sampleLabels[k] = v
+		}
+		sample := Sample{
+			Name:   Sanitize(prefix + measurement + "_" + field),
+			Labels: sampleLabels,
+			Value:  f,
+			Time:   at,
+		}
+		key := sample.Name + labelString(tags)
+		if stored, ok := d.samples[key]; ok && stored.Time.After(at) {
+			continue
+		}
+		d.samples[key] = sample
+	}
+}
+
+// WriteTo writes every gauge in the Prometheus text exposition format
+func (s *Store) WriteTo(w io.Writer) (int64, error) {
+	s.lock.Lock()
+	byName := make(map[string][]Sample)
+	for _, d := range s.devices {
+		name := prefix + "device_last_seen_timestamp_seconds"
+		byName[name] = append(byName[name], Sample{Name: name, Labels: d.labels, Value: float64(d.lastSeen.Unix())})
+		for _, sample := range d.samples {
+			byName[sample.Name] = append(byName[sample.Name], sample)
+		}
+	}
+	s.lock.Unlock()
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		samples := byName[name]
+		sort.Slice(samples, func(i, j int) bool {
+			return labelString(samples[i].Labels) < labelString(samples[j].Labels)
+		})
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		for _, sample := range samples {
+			fmt.Fprintf(&b, "%s%s %s\n", name, labelString(sample.Labels), strconv.FormatFloat(sample.Value, 'f', -1, 64))
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func labelString(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, Sanitize(k), escape(labels[k])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Sanitize replaces the characters not allowed in Prometheus metric and label
+// names
+func Sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Number converts a number of any Go numeric type to a float
+func Number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Value converts a field to a gauge value, booleans are 1 or 0
+func Value(value interface{}) (float64, bool) {
+	if b, ok := value.(bool); ok {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	return Number(value)
+}
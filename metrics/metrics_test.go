@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_WriteTo(t *testing.T) {
+	store := NewStore()
+	labels := map[string]string{"stream_id": "1A2B", "apiary": "chenes", "hive": "h1"}
+	at := time.Unix(1700000000, 0)
+
+	store.Record("1A2B", labels, "raw", map[string]interface{}{"mass_r1": 42.5, "note": "ignored"}, nil, at)
+	store.Record("1A2B", labels, "brood", map[string]interface{}{"temp": 35.1}, map[string]string{"probe": "2"}, at)
+	store.Record("1A2B", labels, "brood", map[string]interface{}{"brood_present": true}, nil, at)
+	// A backfilled reading does not replace the latest value
+	store.Record("1A2B", labels, "raw", map[string]interface{}{"mass_r1": 40.0}, nil, at.Add(-time.Hour))
+
+	var out strings.Builder
+	_, err := store.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`ruche_raw_mass_r1{apiary="chenes",hive="h1",stream_id="1A2B"} 42.5`,
+		`ruche_brood_temp{apiary="chenes",hive="h1",probe="2",stream_id="1A2B"} 35.1`,
+		`ruche_brood_brood_present{apiary="chenes",hive="h1",stream_id="1A2B"} 1`,
+		`ruche_device_last_seen_timestamp_seconds{apiary="chenes",hive="h1",stream_id="1A2B"} 1700000000`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("missing %q in\n%v", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "note") {
+		t.Error("string fields must not be exported")
+	}
+}
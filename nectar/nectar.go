@@ -0,0 +1,342 @@
+package nectar
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/pkg/errors"
+)
+
+const Measurement = "daily"
+
+// massFields are the load cells of a hive, their sum is the hive weight
+var massFields = []string{"mass_r1", "mass_r2", "mass_r3", "mass_r4"}
+
+// Daily is the weight change of a hive during a local day. The net gain is
+// the daytime gain minus the nighttime loss, the nighttime being the hours
+// outside of the daytime window. MaxDrop is the largest drop from a peak to a
+// later reading of the day, the departure of the foragers in the morning.
+type Daily struct {
+	Apiary    string    `json:"apiary,omitempty"`
+	RucherID  string    `json:"rucher_id,omitempty"`
+	Date      string    `json:"date"`
+	Time      time.Time `json:"time"`
+	Weight    float64   `json:"weight"`
+	NetGain   float64   `json:"net_gain"`
+	DayGain   float64   `json:"day_gain"`
+	NightLoss float64   `json:"night_loss"`
+	MaxDrop   float64   `json:"max_drop"`
+	Readings  int       `json:"readings"`
+}
+
+// Reading is the weight of a hive at a time
+type Reading struct {
+	Time   time.Time
+	Weight float64
+}
+
+// Window is the local time of the start and the end of the daytime
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses a daytime window from two local times, e.g. 06:00 and
+// 21:00
+func ParseWindow(start, end string) (Window, error) {
+	s, err := time.Parse("15:04", start)
+	if err != nil {
+		return Window{}, errors.Wrap(err, "invalid daytime start")
+	}
+	e, err := time.Parse("15:04", end)
+	if err != nil {
+		return Window{}, errors.Wrap(err, "invalid daytime end")
+	}
+	w := Window{
+		Start: time.Duration(s.Hour())*time.Hour + time.Duration(s.Minute())*time.Minute,
+		End:   time.Duration(e.Hour())*time.Hour + time.Duration(e.Minute())*time.Minute,
+	}
+	if w.End <= w.Start {
+		return Window{}, errors.New("daytime must end after it starts")
+	}
+	return w, nil
+}
+
+// Job recomputes the current and previous days every interval
+func Job(ctx context.Context, interval time.Duration) {
+	log := logger.Get(ctx).WithField("job", "nectar")
+	err := sink.RequireInflux()
+	if err != nil {
+		log.WithError(err).Error("job disabled")
+		return
+	}
+	for {
+		now := time.Now()
+		err := Compute(ctx, now.Add(-24*time.Hour), now)
+		if err != nil {
+			log.WithError(err).Error("fail to compute daily weight changes")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Compute summarizes the weight of every hive per local day, from the day of
+// from to the day of to, in the daily measurement. The days are split in the
+// timezone of the apiary of the readings.
+func Compute(ctx context.Context, from, to time.Time) error {
+	log := logger.Get(ctx)
+	config := config.Get()
+	window, err := ParseWindow(config.NectarDaytimeStart, config.NectarDaytimeEnd)
+	if err != nil {
+		return errors.Wrap(err, "invalid daytime")
+	}
+	defaultLoc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return errors.Wrap(err, "invalid timezone")
+	}
+
+	// The local day of from starts at most 24 hours before it
+	readings, err := Weights(config.InfluxUrl, "", from.Add(-24*time.Hour), to)
+	if err != nil {
+		return errors.Wrap(err, "fail to query weights")
+	}
+
+	bp, err := influx.Start(config.InfluxUrl)
+	if err != nil {
+		return errors.Wrap(err, "fail to open influx connection")
+	}
+	for series, seriesReadings := range readings {
+		loc, err := series.Location(defaultLoc)
+		if err != nil {
+			return errors.Wrapf(err, "invalid timezone of apiary %v", series.Apiary)
+		}
+		tags := map[string]string{"stream_id": series.StreamID}
+		if series.Apiary != "" {
+			tags["apiary"] = series.Apiary
+		}
+		if series.RucherID != "" {
+			tags["rucher_id"] = series.RucherID
+		}
+		if device, ok := registry.Get().Device(series.StreamID); ok && device.Hive != "" {
+			tags["hive"] = device.Hive
+		}
+
+		first := midnight(from.In(loc))
+		for _, daily := range Summarize(seriesReadings, loc, window) {
+			if daily.Time.Before(first) {
+				continue
+			}
+			values := map[string]interface{}{
+				"weight":     daily.Weight,
+				"net_gain":   daily.NetGain,
+				"day_gain":   daily.DayGain,
+				"night_loss": daily.NightLoss,
+				"max_drop":   daily.MaxDrop,
+				"readings":   int64(daily.Readings),
+			}
+			err = influx.Add(Measurement, values, tags, bp, daily.Time)
+			if err != nil {
+				return errors.Wrap(err, "fail to add daily point")
+			}
+		}
+	}
+
+	log.WithField("points", len((*bp).Points())).Info("Daily weight changes computed")
+	err = influx.Write(config.InfluxUrl, bp)
+	if err != nil {
+		return errors.Wrap(err, "fail to write daily points")
+	}
+	return nil
+}
+
+// Series identifies the readings of a hive. A relay forwards the readings of
+// the hives of several apiaries with its own stream_id, they are told apart
+// by the rucher_id sent by the relay and the apiary it is mapped to.
+type Series struct {
+	StreamID string
+	Apiary   string
+	RucherID string
+}
+
+// Location returns the timezone of the apiary of the series, of the apiary
+// of the device for the readings stored without apiary
+func (s Series) Location(defaultLoc *time.Location) (*time.Location, error) {
+	id := s.Apiary
+	if id == "" {
+		if device, ok := registry.Get().Device(s.StreamID); ok {
+			id = device.Apiary
+		}
+	}
+	if apiary, ok := registry.Get().Apiary(id); ok && apiary.Timezone != "" {
+		return apiary.Location()
+	}
+	return defaultLoc, nil
+}
+
+// Weights returns the weight readings of a device, of every device if empty
+func Weights(influxURL, device string, from, to time.Time) (map[Series][]Reading, error) {
+	condition := ""
+	if device != "" {
+		condition = `"stream_id" = ` + influx.Quote(device) + " AND "
+	}
+	query := fmt.Sprintf(
+		`SELECT "mass_r1", "mass_r2", "mass_r3", "mass_r4" FROM "raw" WHERE %stime >= %s AND time <= %s GROUP BY "stream_id", "apiary", "rucher_id"`,
+		condition, influx.Time(from), influx.Time(to),
+	)
+	rows, err := influx.QueryRows(influxURL, query)
+	if err != nil {
+		return nil, err
+	}
+	readings := make(map[Series][]Reading)
+	for _, row := range rows {
+		weight, ok := Weight(row.Values)
+		if !ok {
+			continue
+		}
+		series := Series{StreamID: row.Tags["stream_id"], Apiary: row.Tags["apiary"], RucherID: row.Tags["rucher_id"]}
+		readings[series] = append(readings[series], Reading{Time: row.Time, Weight: weight})
+	}
+	return readings, nil
+}
+
+// Weight returns the sum of the load cells of a reading
+func Weight(values map[string]interface{}) (float64, bool) {
+	weight := 0.0
+	found := false
+	for _, field := range massFields {
+		if v, ok := influx.Float(values[field]); ok {
+			weight += v
+			found = true
+		}
+	}
+	return weight, found
+}
+
+// Summarize splits the readings per local day. Days with less than two
+// readings are skipped. The net gain of a day is measured from the last
+// reading of the previous day, from the first reading of the day if there is
+// none.
+func Summarize(readings []Reading, loc *time.Location, window Window) []Daily {
+	sorted := append([]Reading{}, readings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	var days []Daily
+	var previous *Reading
+	for start := 0; start < len(sorted); {
+		day := midnight(sorted[start].Time.In(loc))
+		end := start
+		for end < len(sorted) && midnight(sorted[end].Time.In(loc)).Equal(day) {
+			end++
+		}
+		if daily, ok := summarizeDay(sorted[start:end], previous, day, window); ok {
+			days = append(days, daily)
+		}
+		previous = &sorted[end-1]
+		start = end
+	}
+	return days
+}
+
+func summarizeDay(readings []Reading, previous *Reading, day time.Time, window Window) (Daily, bool) {
+	if len(readings) < 2 {
+		return Daily{}, false
+	}
+	first, last := readings[0], readings[len(readings)-1]
+	baseline := first
+	if previous != nil {
+		baseline = *previous
+	}
+	daily := Daily{
+		Date:     day.Format("2006-01-02"),
+		Time:     day,
+		Weight:   last.Weight,
+		NetGain:  last.Weight - baseline.Weight,
+		Readings: len(readings),
+	}
+
+	// Weight at the start and the end of the daytime, the closest readings
+	// inside the window
+	dayStart := at(day, window.Start)
+	dayEnd := at(day, window.End)
+	var morning, evening *Reading
+	for i := range readings {
+		r := readings[i]
+		if r.Time.Before(dayStart) || r.Time.After(dayEnd) {
+			continue
+		}
+		if morning == nil {
+			morning = &readings[i]
+		}
+		evening = &readings[i]
+	}
+	if morning != nil {
+		daily.DayGain = evening.Weight - morning.Weight
+	}
+	daily.NightLoss = daily.DayGain - daily.NetGain
+
+	peak := first.Weight
+	for _, r := range readings {
+		if r.Weight > peak {
+			peak = r.Weight
+		}
+		if drop := peak - r.Weight; drop > daily.MaxDrop {
+			daily.MaxDrop = drop
+		}
+	}
+	return daily, true
+}
+
+// Get returns the daily weight changes of a device, the days of a relay
+// forwarding several hives are returned for every apiary and rucher_id
+func Get(device string, from, to time.Time) ([]Daily, error) {
+	config := config.Get()
+	query := fmt.Sprintf(
+		`SELECT "weight", "net_gain", "day_gain", "night_loss", "max_drop", "readings" FROM "%s" WHERE "stream_id" = %s AND time >= %s AND time <= %s GROUP BY "apiary", "rucher_id"`,
+		Measurement, influx.Quote(device), influx.Time(from), influx.Time(to),
+	)
+	rows, err := influx.QueryRows(config.InfluxUrl, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query daily weight changes")
+	}
+
+	defaultLoc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid timezone")
+	}
+
+	res := make([]Daily, 0, len(rows))
+	for _, row := range rows {
+		series := Series{StreamID: device, Apiary: row.Tags["apiary"], RucherID: row.Tags["rucher_id"]}
+		loc, err := series.Location(defaultLoc)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid apiary timezone")
+		}
+		d := Daily{Apiary: series.Apiary, RucherID: series.RucherID, Time: row.Time.In(loc), Date: row.Time.In(loc).Format("2006-01-02")}
+		d.Weight, _ = influx.Float(row.Values["weight"])
+		d.NetGain, _ = influx.Float(row.Values["net_gain"])
+		d.DayGain, _ = influx.Float(row.Values["day_gain"])
+		d.NightLoss, _ = influx.Float(row.Values["night_loss"])
+		d.MaxDrop, _ = influx.Float(row.Values["max_drop"])
+		readings, _ := influx.Float(row.Values["readings"])
+		d.Readings = int(readings)
+		res = append(res, d)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res, nil
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// at returns the local time of the day, offset from midnight
+func at(day time.Time, offset time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(offset.Hours()), int(offset.Minutes())%60, 0, 0, day.Location())
+}
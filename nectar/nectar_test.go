@@ -0,0 +1,138 @@
+package nectar
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/config/configtest"
+	"github.com/johnsudaar/ruche/influx/influxtest"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+)
+
+func Test_Summarize(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	window, err := ParseWindow("06:00", "21:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2022, 6, day, hour, minute, 0, 0, loc)
+	}
+
+	readings := []Reading{
+		// Only reading of the 1st, 00:30 on the 2nd in Paris is still the 1st
+		// in UTC. The net gain of the 2nd is measured from it.
+		{Time: at(1, 23, 30), Weight: 50.2},
+		{Time: at(2, 0, 30), Weight: 50},
+		{Time: at(2, 6, 0), Weight: 49.5},
+		{Time: at(2, 9, 0), Weight: 48.7},
+		{Time: at(2, 14, 0), Weight: 51.2},
+		{Time: at(2, 21, 0), Weight: 52},
+		{Time: at(2, 23, 50), Weight: 51.4},
+	}
+
+	days := Summarize(readings, loc, window)
+	if len(days) != 1 {
+		t.Fatalf("expected the day with a single reading to be skipped: %+v", days)
+	}
+	d := days[0]
+	if d.Date != "2022-06-02" || d.Readings != 6 || !d.Time.Equal(at(2, 0, 0)) {
+		t.Fatalf("unexpected day %+v", d)
+	}
+	for name, c := range map[string][2]float64{
+		"net_gain":   {d.NetGain, 1.2},
+		"day_gain":   {d.DayGain, 2.5},
+		"night_loss": {d.NightLoss, 1.3},
+		"max_drop":   {d.MaxDrop, 1.3},
+		"weight":     {d.Weight, 51.4},
+	} {
+		if math.Abs(c[0]-c[1]) > 1e-9 {
+			t.Errorf("expected %v to be %v, got %v", name, c[1], c[0])
+		}
+	}
+
+	// Without the previous day, the net gain is measured from the first
+	// reading of the day
+	days = Summarize(readings[1:], loc, window)
+	if len(days) != 1 || math.Abs(days[0].NetGain-1.4) > 1e-9 {
+		t.Fatalf("unexpected days %+v", days)
+	}
+}
+
+func Test_Weight(t *testing.T) {
+	w, ok := Weight(map[string]interface{}{"mass_r1": 10.0, "mass_r3": 12.5, "temp": 20.0})
+	if !ok || w != 22.5 {
+		t.Fatalf("expected 22.5, got %v", w)
+	}
+	_, ok = Weight(map[string]interface{}{"temp": 20.0})
+	if ok {
+		t.Fatal("expected no weight without load cells")
+	}
+}
+
+func Test_ComputeRelay(t *testing.T) {
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		if !strings.HasPrefix(q, `SELECT "mass_r1"`) {
+			return nil
+		}
+		serie := func(apiary, rucherID string, first, last float64) influxtest.Serie {
+			return influxtest.Serie{
+				Name:    "raw",
+				Tags:    map[string]string{"stream_id": "relay", "apiary": apiary, "rucher_id": rucherID},
+				Columns: []string{"time", "mass_r1", "mass_r2", "mass_r3", "mass_r4"},
+				Values: [][]interface{}{
+					{"2022-06-02T08:00:00Z", first, nil, nil, nil},
+					{"2022-06-02T16:00:00Z", last, nil, nil, nil},
+				},
+			}
+		}
+		// The hives of the rucher_id 3 and 4 are not mapped, they are tagged
+		// with the apiary of the relay
+		return []influxtest.Serie{
+			serie("chenes", "1", 40, 41),
+			serie("pins", "3", 30, 32),
+			serie("pins", "4", 20, 23),
+		}
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL(), "TIMEZONE": "Europe/Paris"})
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "chenes"}, {ID: "pins"}},
+		Devices:  []registry.Device{{StreamID: "relay", Apiary: "pins", RucherIDs: map[string]string{"1": "chenes"}}},
+	})
+
+	to := time.Date(2022, 6, 2, 20, 0, 0, 0, time.UTC)
+	err := Compute(context.Background(), to.Add(-time.Hour), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range server.Queries() {
+		if strings.HasPrefix(q, `SELECT "mass_r1"`) && !strings.Contains(q, `GROUP BY "stream_id", "apiary", "rucher_id"`) {
+			t.Fatalf("expected the weights to be grouped by rucher_id: %v", q)
+		}
+	}
+
+	gains := make(map[string]string)
+	for _, p := range server.Points(Measurement) {
+		if p.Tags["stream_id"] != "relay" {
+			t.Fatalf("unexpected point %+v", p)
+		}
+		gains[p.Tags["apiary"]+"/"+p.Tags["rucher_id"]] = p.Fields["net_gain"]
+	}
+	expected := map[string]string{"chenes/1": "1", "pins/3": "2", "pins/4": "3"}
+	if len(gains) != len(expected) {
+		t.Fatalf("expected a day per hive, got %v", gains)
+	}
+	for hive, gain := range expected {
+		if gains[hive] != gain {
+			t.Fatalf("expected %v, got %v", expected, gains)
+		}
+	}
+}
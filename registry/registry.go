@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var registry = &Registry{}
+
+// Registry describes the apiaries and the devices sending their readings. It
+// is loaded from a JSON file:
+//
+//	{
+//	  "apiaries": [{"id": "chenes", "name": "Les Chênes", "timezone": "Europe/Paris"}],
+//	  "devices": [
+//	    {"stream_id": "1A2B3C", "apiary": "chenes", "hive": "reine-2024", "empty_weight": 22.5},
+//	    {"stream_id": "4D5E6F", "rucher_ids": {"1": "chenes", "2": "prairie"}},
+//	    {"stream_id": "scale-01", "model": "esp32-scale", "apiary": "chenes", "token": "secret"}
+//	  ]
+//	}
+type Registry struct {
+	Apiaries []Apiary `json:"apiaries"`
+	Devices  []Device `json:"devices"`
+}
+
+type Apiary struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Timezone string `json:"timezone"`
+}
+
+type Device struct {
+	StreamID string `json:"stream_id"`
+	Model    string `json:"model"`
+	// Hive is the name of the hive the device is installed on
+	Hive string `json:"hive"`
+	// Token authenticates the device when it posts its readings directly
+	Token string `json:"token"`
+	// Apiary is the apiary of the readings without rucher_id or with an
+	// unmapped one
+	Apiary string `json:"apiary"`
+	// RucherIDs maps the rucher_id sent in the payload to an apiary, relays
+	// forward readings of several apiaries
+	RucherIDs map[string]string `json:"rucher_ids"`
+	// EmptyWeight is the weight of the hive without bees nor stores, in kg.
+	// The default of the configuration is used if not set.
+	EmptyWeight float64 `json:"empty_weight"`
+}
+
+// Init loads the registry file, an empty path means an empty registry
+func Init(path string) error {
+	if path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "fail to read registry file")
+	}
+
+	var r Registry
+	err = json.Unmarshal(content, &r)
+	if err != nil {
+		return errors.Wrap(err, "invalid registry file")
+	}
+	return Use(&r)
+}
+
+// Use replaces the registry
+func Use(r *Registry) error {
+	err := r.validate()
+	if err != nil {
+		return errors.Wrap(err, "invalid registry")
+	}
+	registry = r
+	return nil
+}
+
+func Get() *Registry {
+	return registry
+}
+
+func (r *Registry) Device(streamID string) (Device, bool) {
+	for _, d := range r.Devices {
+		if d.StreamID == streamID {
+			return d, true
+		}
+	}
+	return Device{}, false
+}
+
+// DeviceByHive returns the device installed on the hive, the name may also be
+// the stream ID of the device
+func (r *Registry) DeviceByHive(name string) (Device, bool) {
+	for _, d := range r.Devices {
+		if d.Hive != "" && d.Hive == name {
+			return d, true
+		}
+	}
+	return r.Device(name)
+}
+
+// DeviceByToken returns the device authenticated by the token
+func (r *Registry) DeviceByToken(token string) (Device, bool) {
+	if token == "" {
+		return Device{}, false
+	}
+	for _, d := range r.Devices {
+		if d.Token != "" && subtle.ConstantTimeCompare([]byte(d.Token), []byte(token)) == 1 {
+			return d, true
+		}
+	}
+	return Device{}, false
+}
+
+func (r *Registry) Apiary(id string) (Apiary, bool) {
+	for _, a := range r.Apiaries {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return Apiary{}, false
+}
+
+// ApiaryOf returns the apiary of a reading sent by the device, rucherID is nil
+// when the payload has none
+func (r *Registry) ApiaryOf(streamID string, rucherID *int) (Apiary, bool) {
+	d, ok := r.Device(streamID)
+	if !ok {
+		return Apiary{}, false
+	}
+	id := d.Apiary
+	if rucherID != nil {
+		if mapped, ok := d.RucherIDs[strconv.Itoa(*rucherID)]; ok {
+			id = mapped
+		}
+	}
+	return r.Apiary(id)
+}
+
+// Location returns the timezone of the apiary, UTC if it has none
+func (a Apiary) Location() (*time.Location, error) {
+	if a.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(a.Timezone)
+}
+
+func (r *Registry) validate() error {
+	for _, a := range r.Apiaries {
+		if a.ID == "" {
+			return errors.New("apiary without id")
+		}
+		_, err := a.Location()
+		if err != nil {
+			return errors.Wrapf(err, "invalid timezone of apiary %v", a.ID)
+		}
+	}
+	for _, d := range r.Devices {
+		if d.StreamID == "" {
+			return errors.New("device without stream_id")
+		}
+		if _, ok := r.Apiary(d.Apiary); d.Apiary != "" && !ok {
+			return errors.Errorf("unknown apiary %v of device %v", d.Apiary, d.StreamID)
+		}
+		for rucherID, apiary := range d.RucherIDs {
+			if _, err := strconv.Atoi(rucherID); err != nil {
+				return errors.Errorf("invalid rucher_id %q of device %v", rucherID, d.StreamID)
+			}
+			if _, ok := r.Apiary(apiary); !ok {
+				return errors.Errorf("unknown apiary %v of device %v", apiary, d.StreamID)
+			}
+		}
+	}
+	return nil
+}
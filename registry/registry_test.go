@@ -0,0 +1,34 @@
+package registry
+
+import (
+	"testing"
+)
+
+func Test_ApiaryOf(t *testing.T) {
+	r := &Registry{
+		Apiaries: []Apiary{{ID: "chenes"}, {ID: "prairie"}},
+		Devices: []Device{
+			{StreamID: "relay", Apiary: "chenes", RucherIDs: map[string]string{"2": "prairie"}},
+		},
+	}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	one, two, three := 1, 2, 3
+	cases := []struct {
+		rucherID *int
+		apiary   string
+	}{{nil, "chenes"}, {&one, "chenes"}, {&two, "prairie"}, {&three, "chenes"}}
+	for _, c := range cases {
+		a, ok := r.ApiaryOf("relay", c.rucherID)
+		if !ok || a.ID != c.apiary {
+			t.Errorf("rucher_id %v: expected %v, got %v", c.rucherID, c.apiary, a.ID)
+		}
+	}
+
+	_, ok := r.ApiaryOf("unknown", &one)
+	if ok {
+		t.Error("unknown device mapped to an apiary")
+	}
+}
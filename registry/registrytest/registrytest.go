@@ -0,0 +1,20 @@
+// Package registrytest sets the registry of the tests
+package registrytest
+
+import (
+	"testing"
+
+	"github.com/johnsudaar/ruche/registry"
+)
+
+// Use replaces the registry until the end of the test
+func Use(t *testing.T, r registry.Registry) {
+	previous := registry.Get()
+	t.Cleanup(func() {
+		registry.Use(previous)
+	})
+	err := registry.Use(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,289 @@
+package reprocess
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/johnsudaar/ruche/archive"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/fragment"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/johnsudaar/ruche/uplink"
+	"github.com/pkg/errors"
+)
+
+const (
+	webhookRoute = "/webhooks"
+	batchSize    = 1000
+)
+
+type Options struct {
+	Device string
+	From   time.Time
+	To     time.Time
+	// DryRun prints the difference with the stored points instead of writing
+	DryRun bool
+	Out    io.Writer
+}
+
+type Summary struct {
+	Records   int
+	Points    int
+	Skipped   int
+	Unchanged int
+}
+
+// Run replays the archived uplinks of a device through the current decoders
+// and replaces the points stored at the same timestamps: the stored points are
+// deleted first, the fields the decoders no longer return are not kept.
+func Run(ctx context.Context, opts Options) (Summary, error) {
+	log := logger.Get(ctx)
+	config := config.Get()
+	summary := Summary{}
+
+	if config.ArchiveDir == "" {
+		return summary, errors.New("ARCHIVE_DIR is not set")
+	}
+	err := sink.RequireInflux()
+	if err != nil {
+		return summary, err
+	}
+
+	// Stored points of every measurement, loaded on first use in dry run
+	existing := make(map[string]map[int64][]influx.Row)
+
+	fragments := fragment.NewBuffer(config.FragmentTimeout)
+	var bp *influxclient.BatchPoints
+	// deletes are the statements deleting the stored points replaced by the
+	// batch, they are run just before it is written
+	var deletes []string
+	flush := func() error {
+		if bp == nil || len((*bp).Points()) == 0 {
+			return nil
+		}
+		for _, statement := range deletes {
+			_, err := influx.Query(config.InfluxUrl, statement)
+			if err != nil {
+				return errors.Wrap(err, "fail to delete stored points")
+			}
+		}
+		deletes = nil
+		err := influx.Write(config.InfluxUrl, bp)
+		if conflicts, ok := err.(*influx.ConflictsError); ok {
+			log.WithError(conflicts).Warn("values dropped")
+		} else if err != nil {
+			return errors.Wrap(err, "fail to write points")
+		}
+		bp = nil
+		return nil
+	}
+
+	err = archive.Read(config.ArchiveDir, func(r archive.Record) error {
+		if r.Route != webhookRoute {
+			return nil
+		}
+		var body uplink.Input
+		err := json.Unmarshal([]byte(r.Body), &body)
+		if err != nil {
+			log.WithError(err).Warn("invalid archived body")
+			summary.Skipped++
+			return nil
+		}
+		if body.StreamID != opts.Device {
+			return nil
+		}
+		body, timeCheck, err := uplink.CheckTime(body, r.ReceivedAt)
+		if err != nil {
+			summary.Skipped++
+			return nil
+		}
+		if body.Created.Before(opts.From.Add(-config.FragmentTimeout)) || body.Created.After(opts.To) {
+			return nil
+		}
+
+		payload, err := hex.DecodeString(body.Value.Payload)
+		if err != nil {
+			summary.Skipped++
+			return nil
+		}
+		body, payload, complete, err := uplink.Reassemble(fragments, body, payload)
+		if err != nil || !complete {
+			return nil
+		}
+		// Fragments sent before the period are only needed to reassemble the
+		// first messages
+		if body.Created.Before(opts.From) {
+			return nil
+		}
+		summary.Records++
+
+		if _, ok := uplink.Event(body.Model, payload); ok {
+			summary.Skipped++
+			return nil
+		}
+		points, err := uplink.Points(body, payload)
+		if err != nil {
+			log.WithError(err).WithField("created", body.Created).Warn("fail to decode archived payload")
+			summary.Skipped++
+			return nil
+		}
+
+		// measurements of the stored points to replace
+		replaced := []string{}
+		for _, point := range points {
+			if timeCheck.Suspect {
+				point.Values["time_suspect"] = true
+			}
+			if opts.DryRun {
+				stored, ok := existing[point.Measurement]
+				if !ok {
+					stored, err = storedPoints(config.InfluxUrl, point.Measurement, opts)
+					if err != nil {
+						return errors.Wrap(err, "fail to query stored points")
+					}
+					existing[point.Measurement] = stored
+				}
+				old := matchingRow(stored[influx.Truncate(body.Created).UnixNano()], point.Tags)
+				if printDiff(opts.Out, body.Created, point, old) {
+					summary.Points++
+				} else {
+					summary.Unchanged++
+				}
+				continue
+			}
+
+			if bp == nil {
+				bp, err = influx.Start(config.InfluxUrl)
+				if err != nil {
+					return errors.Wrap(err, "fail to open influx connection")
+				}
+			}
+			err = influx.Add(point.Measurement, point.Values, point.Tags, bp, body.Created)
+			if err != nil {
+				return errors.Wrap(err, "fail to add batch point")
+			}
+			summary.Points++
+			if !contains(replaced, point.Measurement) {
+				replaced = append(replaced, point.Measurement)
+			}
+		}
+		for _, measurement := range replaced {
+			deletes = append(deletes, fmt.Sprintf(`DELETE FROM "%s" WHERE "stream_id" = %s AND time = %s`,
+				measurement, influx.Quote(opts.Device), influx.Time(influx.Truncate(body.Created))))
+		}
+		if bp != nil && len((*bp).Points()) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return summary, errors.Wrap(err, "fail to read archive")
+	}
+
+	err = flush()
+	if err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// storedPoints returns the points of the device in the measurement indexed by
+// timestamp (in nanoseconds)
+func storedPoints(influxURL string, measurement string, opts Options) (map[int64][]influx.Row, error) {
+	query := fmt.Sprintf(`SELECT * FROM "%s" WHERE "stream_id" = %s AND time >= %s AND time <= %s GROUP BY *`,
+		measurement, influx.Quote(opts.Device), influx.Time(opts.From), influx.Time(opts.To),
+	)
+	rows, err := influx.QueryRows(influxURL, query)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make(map[int64][]influx.Row)
+	for _, row := range rows {
+		points[row.Time.UnixNano()] = append(points[row.Time.UnixNano()], row)
+	}
+	return points, nil
+}
+
+// matchingRow returns the fields of the stored point with the same tags, a
+// missing tag is the same as an empty one
+func matchingRow(rows []influx.Row, tags map[string]string) map[string]interface{} {
+	for _, row := range rows {
+		match := true
+		for k, v := range row.Tags {
+			if tags[k] != v {
+				match = false
+			}
+		}
+		for k, v := range tags {
+			if row.Tags[k] != v {
+				match = false
+			}
+		}
+		if match {
+			return row.Values
+		}
+	}
+	return nil
+}
+
+// printDiff prints the fields which would change once the stored point is
+// replaced and returns false if there is no difference
+func printDiff(out io.Writer, ts time.Time, point uplink.Point, old map[string]interface{}) bool {
+	values := point.Values
+	if old == nil {
+		fmt.Fprintf(out, "%v %v: new point\n", ts.UTC().Format(time.RFC3339), point.Measurement)
+		for _, name := range sortedKeys(values) {
+			fmt.Fprintf(out, "  + %v: %v\n", name, values[name])
+		}
+		return true
+	}
+
+	lines := []string{}
+	for _, name := range sortedKeys(values) {
+		oldValue, ok := old[name]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("  + %v: %v", name, values[name]))
+		} else if fmt.Sprint(oldValue) != fmt.Sprint(values[name]) {
+			lines = append(lines, fmt.Sprintf("  ~ %v: %v -> %v", name, oldValue, values[name]))
+		}
+	}
+	for _, name := range sortedKeys(old) {
+		if _, ok := values[name]; !ok {
+			lines = append(lines, fmt.Sprintf("  - %v: %v", name, old[name]))
+		}
+	}
+	if len(lines) == 0 {
+		return false
+	}
+
+	fmt.Fprintf(out, "%v %v:\n%v\n", ts.UTC().Format(time.RFC3339), point.Measurement, strings.Join(lines, "\n"))
+	return true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package reprocess
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/archive"
+	"github.com/johnsudaar/ruche/config/configtest"
+	"github.com/johnsudaar/ruche/influx/influxtest"
+)
+
+// archiveUplinks archives an uplink of the device received on time, and one
+// received 30 days after it was sent
+func archiveUplinks(t *testing.T, dir string, created time.Time) {
+	w, err := archive.NewWriter(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i, received := range []time.Time{created, created.Add(30 * 24 * time.Hour)} {
+		body := fmt.Sprintf(`{"streamId": "1A2B3C", "model": "hive", "created": %q, "value": {"payload": "002008301100003a01150038f010e8044340e8"}}`,
+			created.Add(time.Duration(i)*time.Hour).Format(time.RFC3339))
+		err = w.Append(archive.Record{ReceivedAt: received, Route: "/webhooks", Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_Run(t *testing.T) {
+	created := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		if !strings.HasPrefix(q, "SELECT") {
+			return nil
+		}
+		// The stored point has a field the decoder no longer returns
+		return []influxtest.Serie{{
+			Name:    "raw",
+			Tags:    map[string]string{"stream_id": "1A2B3C", "model": "hive", "rucher_id": "0"},
+			Columns: []string{"time", "temp", "legacy"},
+			Values:  [][]interface{}{{created.Format(time.RFC3339), 20.8, 1}},
+		}}
+	}
+	dir := t.TempDir()
+	archiveUplinks(t, dir, created)
+	configtest.Setenv(t, map[string]string{
+		"ARCHIVE_DIR":         dir,
+		"SCALINGO_INFLUX_URL": server.URL(),
+		"TIMESTAMP_POLICY":    "reject",
+	})
+	opts := Options{Device: "1A2B3C", From: created.Add(-time.Hour), To: created.Add(48 * time.Hour)}
+
+	t.Run("dry run", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		opts := opts
+		opts.DryRun = true
+		opts.Out = out
+		summary, err := Run(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The uplink received too late is rejected by the timestamp policy
+		if summary.Records != 1 || summary.Points != 1 || summary.Skipped != 1 {
+			t.Fatalf("unexpected summary %+v", summary)
+		}
+		if !strings.Contains(out.String(), "2022-06-01T12:00:00Z raw:") || !strings.Contains(out.String(), "  - legacy: 1") {
+			t.Fatalf("expected the legacy field to be removed, got:\n%v", out.String())
+		}
+		if len(server.Points("raw")) != 0 {
+			t.Fatal("expected no point to be written")
+		}
+		for _, q := range server.Queries() {
+			if strings.HasPrefix(q, "DELETE") {
+				t.Fatalf("expected no point to be deleted, got %v", q)
+			}
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		summary, err := Run(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.Records != 1 || summary.Points != 1 || summary.Skipped != 1 {
+			t.Fatalf("unexpected summary %+v", summary)
+		}
+
+		var deletes []string
+		for _, q := range server.Queries() {
+			if strings.HasPrefix(q, "DELETE") {
+				deletes = append(deletes, q)
+			}
+		}
+		expected := `DELETE FROM "raw" WHERE "stream_id" = '1A2B3C' AND time = '2022-06-01T12:00:00Z'`
+		if len(deletes) != 1 || deletes[0] != expected {
+			t.Fatalf("expected %v, got %v", expected, deletes)
+		}
+
+		points := server.Points("raw")
+		if len(points) != 1 || !points[0].Time.Equal(created) || points[0].Tags["stream_id"] != "1A2B3C" {
+			t.Fatalf("unexpected points %+v", points)
+		}
+		if _, ok := points[0].Fields["legacy"]; ok {
+			t.Fatalf("expected the legacy field not to be written, got %+v", points[0].Fields)
+		}
+	})
+}
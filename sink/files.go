@@ -0,0 +1,615 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	csvExt     = ".csv"
+	gzipExt    = ".gz"
+	parquetExt = ".parquet"
+	dayLayout  = "2006-01-02"
+
+	// Readings of devices which are not assigned to an apiary
+	unassignedApiary = "unassigned"
+)
+
+// Files writes the readings to CSV files in a directory, one file per
+// apiary, measurement and local day of the apiary:
+//
+//	<dir>/<apiary>/<day>_<measurement>.csv
+//
+// The columns after the time are the known tags and fields of the
+// measurement (see columnsOf), the header is the same every day. A reading
+// with a column which is not in the header closes the file and starts a new
+// one of the same day, <day>_<measurement>.N.csv, with the new columns
+// appended. Once the day is over in the apiary timezone
+// the file is converted to Parquet if enabled, then gzipped.
+type Files struct {
+	dir      string
+	parquet  bool
+	timezone *time.Location
+
+	lock  sync.Mutex
+	files map[string]*dayFile
+}
+
+type dayFile struct {
+	path     string
+	day      string
+	location *time.Location
+	file     *os.File
+	csv      *csv.Writer
+	// Tags then fields, after the time
+	columns []string
+}
+
+// NewFiles closes the files of the days which are over and rotates the files
+// every minute until the context is done
+func NewFiles(ctx context.Context, dir string, parquet bool, timezone *time.Location) (*Files, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create files directory")
+	}
+	s := &Files{
+		dir:      dir,
+		parquet:  parquet,
+		timezone: timezone,
+		files:    make(map[string]*dayFile),
+	}
+
+	err = s.closeLeftovers(time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to close previous files")
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				err := s.Rotate(now)
+				if err != nil {
+					logger.Get(ctx).WithError(err).Error("fail to rotate files")
+				}
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *Files) Write(ctx context.Context, points []Point) error {
+	log := logger.Get(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, p := range points {
+		apiary, location := s.apiaryOf(p)
+		day := p.Time.In(location).Format(dayLayout)
+		path := filepath.Join(s.dir, apiary, day+"_"+p.Measurement+csvExt)
+
+		f, ok := s.files[path]
+		if !ok {
+			var err error
+			f, err = s.open(path, day, location, columnsOf(p))
+			if err != nil {
+				return errors.Wrapf(err, "fail to open %v", path)
+			}
+			s.files[path] = f
+		}
+
+		if unknown := unknownColumns(p, f.columns); len(unknown) > 0 {
+			log.WithField("file", f.path).WithField("columns", unknown).Info("New columns, starting a new file")
+			err := s.closeFile(f)
+			delete(s.files, path)
+			if err != nil {
+				return err
+			}
+			f, err = s.open(path, day, location, append(f.columns, unknown...))
+			if err != nil {
+				return errors.Wrapf(err, "fail to open %v", path)
+			}
+			s.files[path] = f
+		}
+
+		err := f.write(p)
+		if err != nil {
+			return errors.Wrapf(err, "fail to write in %v", f.path)
+		}
+	}
+
+	for _, f := range s.files {
+		f.csv.Flush()
+		if err := f.csv.Error(); err != nil {
+			return errors.Wrapf(err, "fail to write in %v", f.path)
+		}
+	}
+	return nil
+}
+
+// Rotate closes the files of the days which are over in their apiary timezone
+func (s *Files) Rotate(now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for path, f := range s.files {
+		if f.day >= now.In(f.location).Format(dayLayout) {
+			continue
+		}
+		err := s.closeFile(f)
+		delete(s.files, path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeFile closes a file which will not be written anymore, it is converted
+// and compressed
+func (s *Files) closeFile(f *dayFile) error {
+	f.csv.Flush()
+	if err := f.csv.Error(); err != nil {
+		f.file.Close()
+		return errors.Wrapf(err, "fail to write in %v", f.path)
+	}
+	err := f.file.Close()
+	if err != nil {
+		return errors.Wrapf(err, "fail to close %v", f.path)
+	}
+	return s.closeDay(f.path)
+}
+
+// Flush syncs the open files to the disk
+func (s *Files) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, f := range s.files {
+		f.csv.Flush()
+		if err := f.csv.Error(); err != nil {
+			return errors.Wrapf(err, "fail to write in %v", f.path)
+		}
+		err := f.file.Sync()
+		if err != nil {
+			return errors.Wrapf(err, "fail to sync %v", f.path)
+		}
+	}
+	return nil
+}
+
+func (s *Files) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for path, f := range s.files {
+		delete(s.files, path)
+		err := f.file.Close()
+		if err != nil {
+			return errors.Wrapf(err, "fail to close %v", path)
+		}
+	}
+	return nil
+}
+
+func (s *Files) apiaryOf(p Point) (string, *time.Location) {
+	id := p.Tags["apiary"]
+	if id == "" {
+		return unassignedApiary, s.timezone
+	}
+	location := s.timezone
+	if a, ok := registry.Get().Apiary(id); ok && a.Timezone != "" {
+		if l, err := a.Location(); err == nil {
+			location = l
+		}
+	}
+	return id, location
+}
+
+// open continues the file of the day if the process restarted during the day
+// or creates it with the columns. Readings received after their day has been
+// closed go to a new file of that day.
+func (s *Files) open(path, day string, location *time.Location, columns []string) (*dayFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create apiary directory")
+	}
+	base := strings.TrimSuffix(path, csvExt)
+	for seq := 1; exists(path + gzipExt); seq++ {
+		path = fmt.Sprintf("%s.%d%s", base, seq, csvExt)
+	}
+
+	f := &dayFile{path: path, day: day, location: location}
+	header, err := readHeader(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "fail to read file header")
+	}
+	if len(header) > 1 {
+		f.columns = header[1:]
+	} else {
+		f.columns = columns
+	}
+
+	f.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open file")
+	}
+	f.csv = csv.NewWriter(f.file)
+	if len(header) == 0 {
+		err = f.csv.Write(append([]string{"time"}, f.columns...))
+		if err != nil {
+			f.file.Close()
+			return nil, errors.Wrap(err, "fail to write file header")
+		}
+	}
+	return f, nil
+}
+
+func (f *dayFile) write(p Point) error {
+	row := []string{p.Time.In(f.location).Format(time.RFC3339)}
+	for _, column := range f.columns {
+		if tag, ok := p.Tags[column]; ok {
+			row = append(row, tag)
+		} else {
+			row = append(row, formatValue(p.Values[column]))
+		}
+	}
+	return f.csv.Write(row)
+}
+
+// knownColumns are the columns of the measurements which are not decoded
+// from a payload and the tags set by the decoders, by measurement
+var knownColumns = map[string]struct{ tags, fields []string }{
+	"radio": {
+		tags:   []string{"gateway", "station"},
+		fields: []string{"counter_reset", "duplicate", "loss_rate", "lost", "received", "rssi", "seq_gap", "seq_number", "snr"},
+	},
+	"clock":         {fields: []string{"reason", "rejected", "skew", "suspect"}},
+	"device_events": {tags: []string{"type"}, fields: []string{"count", "detail", "message"}},
+	"brood":         {tags: []string{"probe"}},
+}
+
+// Columns of every decoded measurement
+var (
+	decodedTags   = []string{"location_provider", "model"}
+	decodedFields = []string{"location_accuracy", "location_alt", "location_lat", "location_lon", "time_suspect"}
+)
+
+// columnsOf returns the columns of a new file: the tags then the fields of
+// the measurement, which do not depend on the first reading of the day, then
+// the other columns of the point. The tags are the apiary tags plus those of
+// the measurement, the fields those of the decoder schemas of the models
+// writing to the measurement then the other known fields, each sorted by name.
+func columnsOf(p Point) []string {
+	tags := map[string]bool{"apiary": true, "rucher_id": true, "stream_id": true}
+	fields := make(map[string]bool)
+	known := make(map[string]bool)
+
+	if columns, ok := knownColumns[p.Measurement]; ok {
+		for _, tag := range columns.tags {
+			tags[tag] = true
+		}
+		for _, field := range columns.fields {
+			known[field] = true
+		}
+	}
+	decoded := false
+	for _, model := range decoder.Models() {
+		if decoder.MeasurementOf(decoder.Get(model)) != p.Measurement {
+			continue
+		}
+		decoded = true
+		schema, _ := decoder.SchemaOf(model)
+		for name, field := range schema {
+			if field.Tag {
+				tags[name] = true
+			} else {
+				fields[name] = true
+			}
+		}
+	}
+	// The points of the decoders without a schema are decoded as well
+	if decoded || p.Tags["model"] != "" {
+		for _, tag := range decodedTags {
+			tags[tag] = true
+		}
+		for _, field := range decodedFields {
+			known[field] = true
+		}
+	}
+	for name := range fields {
+		delete(known, name)
+	}
+
+	columns := append(sortedNames(tags), sortedNames(fields)...)
+	columns = append(columns, sortedNames(known)...)
+	return append(columns, unknownColumns(p, columns)...)
+}
+
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func unknownColumns(p Point, columns []string) []string {
+	known := make(map[string]bool)
+	for _, c := range columns {
+		known[c] = true
+	}
+	var unknown []string
+	for tag := range p.Tags {
+		if !known[tag] {
+			unknown = append(unknown, tag)
+		}
+	}
+	for field := range p.Values {
+		if !known[field] {
+			unknown = append(unknown, field)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// closeLeftovers closes the files of the days which were over while the
+// process was stopped
+func (s *Files) closeLeftovers(now time.Time) error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*", "*"+csvExt))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		location := s.timezone
+		if a, ok := registry.Get().Apiary(filepath.Base(filepath.Dir(path))); ok && a.Timezone != "" {
+			if l, err := a.Location(); err == nil {
+				location = l
+			}
+		}
+		name := filepath.Base(path)
+		if len(name) < len(dayLayout) || name[:len(dayLayout)] >= now.In(location).Format(dayLayout) {
+			continue
+		}
+		err = s.closeDay(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeDay converts the CSV file of a day which is over to Parquet if enabled
+// and replaces it by its gzipped version. The new files are written under a
+// temporary name then renamed so that a reader never sees a partial file.
+func (s *Files) closeDay(path string) error {
+	if s.parquet {
+		err := writeParquet(path, strings.TrimSuffix(path, csvExt)+parquetExt)
+		if err != nil {
+			return errors.Wrapf(err, "fail to convert %v to parquet", path)
+		}
+	}
+
+	err := atomicWrite(path+gzipExt, func(w io.Writer) error {
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		gz := gzip.NewWriter(w)
+		_, err = io.Copy(gz, src)
+		if err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return errors.Wrapf(err, "fail to compress %v", path)
+	}
+	return os.Remove(path)
+}
+
+// writeParquet converts a CSV file to Parquet. The fields of the schema keep
+// their type, the types of the other columns are guessed from their values.
+func writeParquet(csvPath, parquetPath string) error {
+	src, err := os.Open(csvPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	rows, err := csv.NewReader(bufio.NewReader(src)).ReadAll()
+	if err != nil {
+		return errors.Wrap(err, "fail to read csv")
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	header, rows := rows[0], rows[1:]
+
+	// The schema is only known from the model of the readings
+	types := make(map[string]string)
+	for i, column := range header {
+		if column == "model" && len(rows) > 0 {
+			if schema, ok := decoder.SchemaOf(rows[0][i]); ok {
+				for name, field := range schema {
+					types[name] = field.Type
+				}
+			}
+		}
+	}
+
+	metadata := make([]string, len(header))
+	metadata[0] = "name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"
+	for i, column := range header[1:] {
+		columnType, ok := types[column]
+		if !ok {
+			columnType = guessType(rows, i+1)
+		}
+		types[column] = columnType
+		metadata[i+1] = parquetColumn(column, columnType)
+	}
+
+	return atomicWrite(parquetPath, func(w io.Writer) error {
+		pw, err := writer.NewCSVWriterFromWriter(metadata, w, 1)
+		if err != nil {
+			return errors.Wrap(err, "invalid parquet schema")
+		}
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+
+		for _, row := range rows {
+			t, err := time.Parse(time.RFC3339, row[0])
+			if err != nil {
+				return errors.Wrapf(err, "invalid time %v", row[0])
+			}
+			values := []interface{}{t.UnixNano() / int64(time.Millisecond)}
+			for i, column := range header[1:] {
+				values = append(values, parquetValue(row[i+1], types[column]))
+			}
+			err = pw.Write(values)
+			if err != nil {
+				return errors.Wrap(err, "fail to write parquet row")
+			}
+		}
+		return pw.WriteStop()
+	})
+}
+
+func guessType(rows [][]string, column int) string {
+	columnType := ""
+	for _, row := range rows {
+		value := row[column]
+		if value == "" {
+			continue
+		}
+		valueType := decoder.TypeString
+		if value == "true" || value == "false" {
+			valueType = decoder.TypeBoolean
+		} else if _, err := strconv.ParseFloat(value, 64); err == nil {
+			valueType = decoder.TypeFloat
+		}
+		if columnType != "" && columnType != valueType {
+			return decoder.TypeString
+		}
+		columnType = valueType
+	}
+	if columnType == "" {
+		return decoder.TypeString
+	}
+	return columnType
+}
+
+func parquetColumn(name, columnType string) string {
+	switch columnType {
+	case decoder.TypeFloat:
+		return "name=" + name + ", type=DOUBLE, repetitiontype=OPTIONAL"
+	case decoder.TypeInteger:
+		return "name=" + name + ", type=INT64, repetitiontype=OPTIONAL"
+	case decoder.TypeBoolean:
+		return "name=" + name + ", type=BOOLEAN, repetitiontype=OPTIONAL"
+	default:
+		return "name=" + name + ", type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"
+	}
+}
+
+// parquetValue returns nil for empty and invalid values
+func parquetValue(value, columnType string) interface{} {
+	if value == "" {
+		return nil
+	}
+	switch columnType {
+	case decoder.TypeFloat:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case decoder.TypeInteger:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return int64(f)
+		}
+	case decoder.TypeBoolean:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	default:
+		return value
+	}
+	return nil
+}
+
+func atomicWrite(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer dst.Close()
+
+	err = write(dst)
+	if err != nil {
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readHeader(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header, err := csv.NewReader(f).Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return header, err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
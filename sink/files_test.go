@@ -0,0 +1,151 @@
+package sink
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+)
+
+func Test_Files(t *testing.T) {
+	dir := t.TempDir()
+	registrytest.Use(t, registry.Registry{Apiaries: []registry.Apiary{{ID: "chenes", Timezone: "Europe/Paris"}}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := filepath.Join(dir, "files")
+	s, err := NewFiles(ctx, out, true, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 23:30 and 00:30 in Paris, both on May 1st in UTC
+	evening := time.Date(2022, 5, 1, 21, 30, 0, 0, time.UTC)
+	tags := map[string]string{"stream_id": "dev", "model": "hive", "apiary": "chenes"}
+	err = s.Write(ctx, []Point{
+		{Measurement: "raw", Tags: tags, Values: map[string]interface{}{"mass_r0": 42.5}, Time: evening},
+		{Measurement: "raw", Tags: tags, Values: map[string]interface{}{"mass_r0": 42.0, "unknown": 1.0}, Time: evening.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Rotate(evening.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := filepath.Join(out, "chenes", "2022-05-01_raw.csv")
+	if _, err := os.Stat(closed); !os.IsNotExist(err) {
+		t.Fatalf("expected %v to be compressed", closed)
+	}
+	if _, err := os.Stat(filepath.Join(out, "chenes", "2022-05-01_raw.parquet")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "chenes", "2022-05-02_raw.csv")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(closed + gzipExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "time,apiary,location_provider,model,rucher_id,stream_id,bat_tension,"
+	if !strings.HasPrefix(string(content), header) {
+		t.Fatalf("unexpected header: %s", content)
+	}
+	row := "\n2022-05-01T23:30:00+02:00,chenes,,hive,,dev,"
+	if !strings.Contains(string(content), row) {
+		t.Fatalf("expected a row in local time: %s", content)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_FilesNewColumns(t *testing.T) {
+	ctx := context.Background()
+	out := t.TempDir()
+	s, err := NewFiles(ctx, out, false, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder.Register("brood-probes", decoder.Brood{})
+
+	// The brood decoder sends the summary of the probe string first, then a
+	// point per probe. The header has every column of the measurement
+	// whatever the first point.
+	at := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	tags := map[string]string{"stream_id": "dev", "model": "brood-probes"}
+	probe := func(position, temp string) Point {
+		return Point{Measurement: "brood", Tags: map[string]string{"stream_id": "dev", "model": "brood-probes", "probe": position}, Values: map[string]interface{}{"temp": temp}, Time: at}
+	}
+	err = s.Write(ctx, []Point{
+		{Measurement: "brood", Tags: tags, Values: map[string]interface{}{"probes": 2.0, "brood_present": true}, Time: at},
+		probe("0", "34.5"),
+		probe("1", "35.1"),
+		{Measurement: "brood", Tags: tags, Values: map[string]interface{}{"probes": 2.0, "brood_present": false, "time_suspect": true}, Time: at.Add(time.Hour)},
+		// A field which is not in the schema
+		{Measurement: "brood", Tags: tags, Values: map[string]interface{}{"probes": 2.0, "battery": 3.3}, Time: at.Add(2 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := readGzip(filepath.Join(out, unassignedApiary, "2022-05-01_brood.csv.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "time,apiary,location_provider,model,probe,rucher_id,stream_id,brood_present,central_temp,probes,temp,location_accuracy,location_alt,location_lat,location_lon,time_suspect"
+	if first != header+"\n"+
+		"2022-05-01T12:00:00Z,,,brood-probes,,,dev,true,,2,,,,,,\n"+
+		"2022-05-01T12:00:00Z,,,brood-probes,0,,dev,,,,34.5,,,,,\n"+
+		"2022-05-01T12:00:00Z,,,brood-probes,1,,dev,,,,35.1,,,,,\n"+
+		"2022-05-01T13:00:00Z,,,brood-probes,,,dev,false,,2,,,,,,true\n" {
+		t.Fatalf("unexpected first file: %s", first)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.ReadFile(filepath.Join(out, unassignedApiary, "2022-05-01_brood.1.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(second) != header+",battery\n2022-05-01T14:00:00Z,,,brood-probes,,,dev,,,2,,,,,,,3.3\n" {
+		t.Fatalf("unexpected second file: %s", second)
+	}
+}
+
+func readGzip(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	content, err := io.ReadAll(gz)
+	return string(content), err
+}
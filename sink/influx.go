@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/pkg/errors"
+)
+
+// Influx writes the points in the InfluxDB database of the URL. The values
+// whose type conflicts with their stored field are dropped and reported, see
+// influx.Write.
+type Influx struct {
+	URL string
+}
+
+func NewInflux(url string) *Influx {
+	return &Influx{URL: url}
+}
+
+func (s *Influx) Write(ctx context.Context, points []Point) error {
+	log := logger.Get(ctx).WithField("sink", TypeInflux)
+
+	bp, err := influx.Start(s.URL)
+	if err != nil {
+		return errors.Wrap(err, "fail to open influx connection")
+	}
+	for _, p := range points {
+		err = influx.Add(p.Measurement, p.Values, p.Tags, bp, p.Time)
+		if err != nil {
+			return errors.Wrap(err, "fail to add batch point")
+		}
+	}
+	err = influx.Write(s.URL, bp)
+	if conflicts, ok := err.(*influx.ConflictsError); ok {
+		for _, c := range conflicts.Conflicts {
+			log.WithField("measurement", c.Measurement).WithField("field", c.Field).
+				Warnf("Field type conflict, %v value dropped from %v field", c.Written, c.Stored)
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "fail to write points")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_InfluxFieldConflicts(t *testing.T) {
+	var written string
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			body, _ := io.ReadAll(req.Body)
+			written += string(body)
+			resp.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(map[string]interface{}{"results": []interface{}{map[string]interface{}{
+			"statement_id": 0,
+			"series": []map[string]interface{}{{
+				"name":    "raw",
+				"columns": []string{"fieldKey", "fieldType"},
+				"values":  [][]interface{}{{"mass_r1", "float"}, {"lum", "integer"}, {"note", "string"}},
+			}},
+		}}})
+	}))
+	defer server.Close()
+
+	s := NewInflux(server.URL + "/ruche")
+	err := s.Write(context.Background(), []Point{
+		{
+			Measurement: "raw",
+			Tags:        map[string]string{"stream_id": "dev"},
+			Values:      map[string]interface{}{"mass_r1": int64(12), "lum": 300.0, "note": 1.5},
+			Time:        time.Unix(1651406400, 0),
+		},
+		{
+			Measurement: "raw",
+			Tags:        map[string]string{"stream_id": "dev"},
+			Values:      map[string]interface{}{"note": true},
+			Time:        time.Unix(1651406460, 0),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(written), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected the point without valid fields to be skipped: %q", written)
+	}
+	if !strings.Contains(lines[0], "lum=300i") || !strings.Contains(lines[0], "mass_r1=12 ") || strings.Contains(lines[0], "note") {
+		t.Fatalf("unexpected point %q", lines[0])
+	}
+}
@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/golang/snappy"
+	"github.com/johnsudaar/ruche/metrics"
+	"github.com/pkg/errors"
+)
+
+const remoteWriteQueueSize = 100000
+
+// Delay before the first retry of a batch, doubled on every retry
+var remoteWriteBackoff = time.Second
+
+type RemoteWriteConfig struct {
+	URL           string
+	Username      string
+	Password      string
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+}
+
+// RemoteWrite pushes every numeric field as a sample named
+// ruche_<measurement>_<field> with the Prometheus remote write protocol. The
+// samples keep the time of the reading. They are queued and sent in batches
+// by a background worker, failed batches are retried with an exponential
+// backoff unless the server rejects them.
+type RemoteWrite struct {
+	config RemoteWriteConfig
+	client *http.Client
+
+	lock    sync.Mutex
+	queue   []timeSeries
+	flushCh chan struct{}
+	// Only one batch is sent at a time
+	sendLock sync.Mutex
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type timeSeries struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+func NewRemoteWrite(ctx context.Context, config RemoteWriteConfig) *RemoteWrite {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 10 * time.Second
+	}
+	s := &RemoteWrite{
+		config:  config,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		flushCh: make(chan struct{}, 1),
+	}
+	go s.run(ctx)
+	return s
+}
+
+func (s *RemoteWrite) Write(ctx context.Context, points []Point) error {
+	series := toTimeSeries(points)
+
+	s.lock.Lock()
+	s.queue = append(s.queue, series...)
+	if dropped := len(s.queue) - remoteWriteQueueSize; dropped > 0 {
+		logger.Get(ctx).WithField("samples", dropped).Error("remote write queue full, dropping oldest samples")
+		s.queue = s.queue[dropped:]
+	}
+	full := len(s.queue) >= s.config.BatchSize
+	s.lock.Unlock()
+
+	if full {
+		select {
+		case s.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *RemoteWrite) run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.flushCh:
+		}
+		s.flush(ctx)
+	}
+}
+
+// Flush pushes the queued samples
+func (s *RemoteWrite) Flush(ctx context.Context) error {
+	if !s.flush(ctx) {
+		return errors.New("fail to push queued samples")
+	}
+	return nil
+}
+
+// Close pushes the queued samples before the process exits
+func (s *RemoteWrite) Close() error {
+	return s.Flush(context.Background())
+}
+
+// flush sends the queue in batches and returns false if a batch has been
+// dropped
+func (s *RemoteWrite) flush(ctx context.Context) bool {
+	log := logger.Get(ctx).WithField("sink", TypeRemoteWrite)
+
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	for {
+		s.lock.Lock()
+		n := len(s.queue)
+		if n > s.config.BatchSize {
+			n = s.config.BatchSize
+		}
+		batch := s.queue[:n]
+		s.queue = s.queue[n:]
+		s.lock.Unlock()
+		if n == 0 {
+			return true
+		}
+
+		err := s.send(ctx, batch)
+		if err != nil {
+			log.WithError(err).WithField("samples", n).Error("fail to push samples, dropping them")
+			return false
+		}
+	}
+}
+
+func (s *RemoteWrite) send(ctx context.Context, batch []timeSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(batch))
+
+	backoff := remoteWriteBackoff
+	var err error
+	for attempt := 0; attempt <= s.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		var retry bool
+		retry, err = s.post(body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return errors.Wrapf(err, "giving up after %v retries", s.config.MaxRetries)
+}
+
+// post returns true if the request can be retried
+func (s *RemoteWrite) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "invalid remote write request")
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "fail to send samples")
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		return true, fmt.Errorf("remote write answered %v: %s", res.StatusCode, msg)
+	}
+	if res.StatusCode >= 300 {
+		return false, fmt.Errorf("remote write rejected samples %v: %s", res.StatusCode, msg)
+	}
+	return false, nil
+}
+
+func toTimeSeries(points []Point) []timeSeries {
+	var series []timeSeries
+	for _, p := range points {
+		for field, value := range p.Values {
+			f, ok := metrics.Value(value)
+			if !ok {
+				continue
+			}
+			labels := []label{{name: "__name__", value: metrics.Sanitize("ruche_" + p.Measurement + "_" + field)}}
+			for k, v := range p.Tags {
+				if v != "" {
+					labels = append(labels, label{name: metrics.Sanitize(k), value: v})
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+			series = append(series, timeSeries{
+				labels:    labels,
+				value:     f,
+				timestamp: p.Time.UnixNano() / int64(time.Millisecond),
+			})
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest encodes the prometheus.WriteRequest protobuf message:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []timeSeries) []byte {
+	var req []byte
+	for _, ts := range series {
+		var msg []byte
+		for _, l := range ts.labels {
+			var lbl []byte
+			lbl = appendBytes(lbl, 1, []byte(l.name))
+			lbl = appendBytes(lbl, 2, []byte(l.value))
+			msg = appendBytes(msg, 1, lbl)
+		}
+		var sample []byte
+		sample = appendTag(sample, 1, 1)
+		sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(ts.value))
+		sample = appendTag(sample, 2, 0)
+		sample = binary.AppendUvarint(sample, uint64(ts.timestamp))
+		msg = appendBytes(msg, 2, sample)
+
+		req = appendBytes(req, 1, msg)
+	}
+	return req
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytes(b []byte, field int, value []byte) []byte {
+	b = appendTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
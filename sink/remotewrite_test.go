@@ -0,0 +1,72 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func Test_RemoteWrite(t *testing.T) {
+	remoteWriteBackoff = time.Millisecond
+	created := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	requests := 0
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers: %v", req.Header)
+		}
+		if requests == 1 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		resp.WriteHeader(http.StatusNoContent)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewRemoteWrite(ctx, RemoteWriteConfig{URL: server.URL, BatchSize: 2, FlushInterval: time.Hour, MaxRetries: 2})
+
+	err := s.Write(ctx, []Point{{
+		Measurement: "hive",
+		Tags:        map[string]string{"stream_id": "dev", "model": "hive"},
+		Values:      map[string]interface{}{"weight": 42.5, "time_suspect": true, "note": "skipped"},
+		Time:        created,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body []byte
+	select {
+	case body = <-bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("samples were not pushed")
+	}
+	if requests != 2 {
+		t.Fatalf("expected the batch to be retried once, got %v requests", requests)
+	}
+
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// WriteRequest{timeseries: [TimeSeries{labels, samples: [Sample{value, timestamp}]}]}
+	// encoded by hand, the series are in any order
+	suspect, _ := hex.DecodeString("0a580a230a085f5f6e616d655f5f121772756368655f686976655f74696d655f737573706563740a0d0a056d6f64656c1204686976650a100a0973747265616d5f69641203646576121009000000000000f03f1080d4f7fb8730")
+	weight, _ := hex.DecodeString("0a520a1d0a085f5f6e616d655f5f121172756368655f686976655f7765696768740a0d0a056d6f64656c1204686976650a100a0973747265616d5f6964120364657612100900000000004045401080d4f7fb8730")
+	if !bytes.Equal(decoded, append(suspect, weight...)) && !bytes.Equal(decoded, append(weight, suspect...)) {
+		t.Fatalf("unexpected write request %x", decoded)
+	}
+}
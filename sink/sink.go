@@ -0,0 +1,162 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/johnsudaar/ruche/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	TypeInflux      = "influx"
+	TypeRemoteWrite = "remote_write"
+	TypeFiles       = "files"
+)
+
+// Point is a reading to store
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Values      map[string]interface{}
+	Time        time.Time
+}
+
+// Sink stores readings. Sinks are configured with the SINKS environment
+// variable and every reading is written to all of them.
+type Sink interface {
+	Write(ctx context.Context, points []Point) error
+}
+
+// Flusher is implemented by the sinks which write the points asynchronously
+type Flusher interface {
+	// Flush returns once the points written before are stored
+	Flush(ctx context.Context) error
+}
+
+var sinks []Sink
+
+// Init creates the configured sinks, the background workers of the
+// asynchronous sinks stop with the context
+func Init(ctx context.Context) error {
+	config := config.Get()
+	sinks = nil
+	for _, name := range config.Sinks {
+		switch strings.TrimSpace(name) {
+		case TypeInflux:
+			sinks = append(sinks, NewInflux(config.InfluxUrl))
+		case TypeRemoteWrite:
+			if config.RemoteWriteURL == "" {
+				return errors.New("REMOTE_WRITE_URL is not set")
+			}
+			sinks = append(sinks, NewRemoteWrite(ctx, RemoteWriteConfig{
+				URL:           config.RemoteWriteURL,
+				Username:      config.RemoteWriteUsername,
+				Password:      config.RemoteWritePassword,
+				BatchSize:     config.RemoteWriteBatchSize,
+				FlushInterval: config.RemoteWriteFlushInterval,
+				MaxRetries:    config.RemoteWriteMaxRetries,
+			}))
+		case TypeFiles:
+			if config.FilesDir == "" {
+				return errors.New("FILES_DIR is not set")
+			}
+			timezone, err := time.LoadLocation(config.Timezone)
+			if err != nil {
+				return errors.Wrap(err, "invalid timezone")
+			}
+			files, err := NewFiles(ctx, config.FilesDir, config.FilesParquet, timezone)
+			if err != nil {
+				return errors.Wrap(err, "fail to init files sink")
+			}
+			sinks = append(sinks, files)
+		default:
+			return fmt.Errorf("unknown sink %q", name)
+		}
+	}
+	return nil
+}
+
+// Configured returns true if the sink is set in the SINKS configuration
+func Configured(name string) bool {
+	for _, configured := range config.Get().Sinks {
+		if strings.TrimSpace(configured) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireInflux returns an error if the influx sink is not configured. The
+// bulk imports, the replays of the archive, the jobs computing from the
+// stored readings (flight, nectar, step, forecast) and the stored alerts read
+// and write InfluxDB directly, they are not written to the other sinks.
+func RequireInflux() error {
+	if !Configured(TypeInflux) {
+		return errors.Errorf("the %v sink is required, SINKS is %v", TypeInflux, strings.Join(config.Get().Sinks, ","))
+	}
+	return nil
+}
+
+// Use replaces the configured sinks
+func Use(s ...Sink) {
+	sinks = s
+}
+
+// Write stores the points in every sink, a failing sink does not prevent the
+// others from being written
+func Write(ctx context.Context, points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	var errs []string
+	for _, s := range sinks {
+		err := s.Write(ctx, points)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Flush waits for the points written before to be stored by the
+// asynchronous sinks, for instance before recording the progress of an import
+func Flush(ctx context.Context) error {
+	var errs []string
+	for _, s := range sinks {
+		if f, ok := s.(Flusher); ok {
+			err := f.Flush(ctx)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Close flushes and closes the sinks which buffer the points, it must be
+// called before a command exits
+func Close() error {
+	var errs []string
+	for _, s := range sinks {
+		if c, ok := s.(io.Closer); ok {
+			err := c.Close()
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
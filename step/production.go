@@ -0,0 +1,141 @@
+package step
+
+import (
+	"time"
+
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/nectar"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/pkg/errors"
+)
+
+// Production sums the confirmed steps of a hive during a season. NetGain is
+// the weight change between the first and the last reading of the season,
+// ColonyGain is the part of it which is not due to a manipulation: the net
+// gain minus the confirmed steps.
+type Production struct {
+	Season     int       `json:"season"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Harvested  float64   `json:"harvested_kg"`
+	Fed        float64   `json:"fed_kg"`
+	Swarms     int       `json:"swarms"`
+	NetGain    float64   `json:"net_gain_kg"`
+	ColonyGain float64   `json:"colony_gain_kg"`
+}
+
+// ValidateSeasonStart checks the month the seasons start on
+func ValidateSeasonStart(month int) error {
+	if month < 1 || month > 12 {
+		return errors.Errorf("invalid season start month %v", month)
+	}
+	return nil
+}
+
+// SeasonRange returns the start and the end of a season of a hive, seasons
+// start on the configured month of their year in the timezone of the apiary
+// of the hive
+func SeasonRange(device, apiary string, season int) (time.Time, time.Time, error) {
+	loc, err := location(device, apiary)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	from := time.Date(season, time.Month(config.Get().SeasonStartMonth), 1, 0, 0, 0, 0, loc)
+	return from, from.AddDate(1, 0, 0), nil
+}
+
+// CurrentSeason returns the season of a hive at a time, in the timezone of
+// its apiary
+func CurrentSeason(device, apiary string, now time.Time) (int, error) {
+	loc, err := location(device, apiary)
+	if err != nil {
+		return 0, err
+	}
+	now = now.In(loc)
+	if int(now.Month()) < config.Get().SeasonStartMonth {
+		return now.Year() - 1, nil
+	}
+	return now.Year(), nil
+}
+
+// GetProduction returns the production of a hive during a season. The apiary
+// selects the hive of a relay, the apiary of the device is used if empty.
+func GetProduction(device, apiary string, season int) (Production, error) {
+	config := config.Get()
+	deviceApiary := ""
+	if d, ok := registry.Get().Device(device); ok {
+		deviceApiary = d.Apiary
+	}
+	if apiary == "" {
+		apiary = deviceApiary
+	}
+	// The data stored before the device was assigned to an apiary belong to
+	// the hive of the device
+	inApiary := func(tagged string) bool {
+		return tagged == apiary || (tagged == "" && apiary == deviceApiary)
+	}
+
+	from, to, err := SeasonRange(device, apiary, season)
+	if err != nil {
+		return Production{}, err
+	}
+	p := Production{Season: season, From: from, To: to}
+
+	events, err := List(device, from, to)
+	if err != nil {
+		return p, err
+	}
+	steps := 0.0
+	for _, e := range events {
+		if e.Status != StatusConfirmed || !inApiary(e.Apiary) {
+			continue
+		}
+		steps += e.Magnitude
+		switch e.Type {
+		case TypeHarvest:
+			p.Harvested -= e.Magnitude
+		case TypeFeeding:
+			p.Fed += e.Magnitude
+		case TypeSwarm:
+			p.Swarms++
+		}
+	}
+
+	readings, err := nectar.Weights(config.InfluxUrl, device, from, to)
+	if err != nil {
+		return p, errors.Wrap(err, "fail to query weights")
+	}
+	var first, last *nectar.Reading
+	for series, seriesReadings := range readings {
+		if !inApiary(series.Apiary) {
+			continue
+		}
+		for i := range seriesReadings {
+			r := &seriesReadings[i]
+			if first == nil || r.Time.Before(first.Time) {
+				first = r
+			}
+			if last == nil || r.Time.After(last.Time) {
+				last = r
+			}
+		}
+	}
+	if first != nil {
+		p.NetGain = last.Weight - first.Weight
+	}
+	p.ColonyGain = p.NetGain - steps
+	return p, nil
+}
+
+// location returns the timezone of the apiary of the hive
+func location(device, apiary string) (*time.Location, error) {
+	defaultLoc, err := time.LoadLocation(config.Get().Timezone)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid timezone")
+	}
+	loc, err := nectar.Series{StreamID: device, Apiary: apiary}.Location(defaultLoc)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid apiary timezone")
+	}
+	return loc, nil
+}
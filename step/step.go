@@ -0,0 +1,298 @@
+package step
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	influxclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/nectar"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/pkg/errors"
+)
+
+const (
+	Measurement = "steps"
+
+	StatusCandidate = "candidate"
+	StatusConfirmed = "confirmed"
+	StatusRejected  = "rejected"
+
+	TypeSwarm      = "swarm"
+	TypeHarvest    = "harvest"
+	TypeSuperAdded = "super_added"
+	TypeFeeding    = "feeding"
+	TypeOther      = "other"
+	// TypeFalsePositive rejects a step which was not a manipulation
+	TypeFalsePositive = "false_positive"
+)
+
+var (
+	ErrNotFound    = errors.New("step not found")
+	ErrInvalidType = errors.New("invalid step type")
+)
+
+var types = map[string]bool{
+	TypeSwarm:         true,
+	TypeHarvest:       true,
+	TypeSuperAdded:    true,
+	TypeFeeding:       true,
+	TypeOther:         true,
+	TypeFalsePositive: true,
+}
+
+// Event is a sudden change of the weight of a hive. It is detected as a
+// candidate and classified by the beekeeper. The ID is the time of the
+// event in unix nanoseconds. The apiary and the rucher_id tell apart the
+// hives forwarded by a relay.
+type Event struct {
+	ID        string    `json:"id"`
+	StreamID  string    `json:"stream_id"`
+	Apiary    string    `json:"apiary,omitempty"`
+	RucherID  string    `json:"rucher_id,omitempty"`
+	Time      time.Time `json:"time"`
+	Before    float64   `json:"before"`
+	After     float64   `json:"after"`
+	Magnitude float64   `json:"magnitude"`
+	Status    string    `json:"status"`
+	Type      string    `json:"type,omitempty"`
+	// Last is the time of the last change merged in a detected step, it is
+	// not stored
+	Last time.Time `json:"-"`
+}
+
+// Options of the detection
+type Options struct {
+	// Threshold is the minimal weight change between two readings, in kg
+	Threshold float64
+	// MaxGap is the maximal time between two readings, larger gaps are not
+	// steps but missing data
+	MaxGap time.Duration
+	// Steps of the same sign within Merge are a single event, e.g. several
+	// supers removed one after the other
+	Merge time.Duration
+}
+
+// Job detects the steps of the last two days every interval
+func Job(ctx context.Context, interval time.Duration) {
+	log := logger.Get(ctx).WithField("job", "step")
+	err := sink.RequireInflux()
+	if err != nil {
+		log.WithError(err).Error("job disabled")
+		return
+	}
+	for {
+		now := time.Now()
+		err := Compute(ctx, now.Add(-48*time.Hour), now)
+		if err != nil {
+			log.WithError(err).Error("fail to detect steps")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Compute detects the steps of the weight of every hive and stores the new
+// ones as candidates. The classified events are kept as is, the candidates
+// are updated if more steps have been merged in them.
+func Compute(ctx context.Context, from, to time.Time) error {
+	log := logger.Get(ctx)
+	config := config.Get()
+	opts := Options{
+		Threshold: config.StepThreshold,
+		MaxGap:    config.StepMaxGap,
+		Merge:     config.StepMergeWindow,
+	}
+
+	readings, err := nectar.Weights(config.InfluxUrl, "", from, to)
+	if err != nil {
+		return errors.Wrap(err, "fail to query weights")
+	}
+	stored, err := List("", from, to)
+	if err != nil {
+		return errors.Wrap(err, "fail to list stored steps")
+	}
+	known := make(map[string]Event)
+	for _, e := range stored {
+		known[key(e)] = e
+	}
+
+	bp, err := influx.Start(config.InfluxUrl)
+	if err != nil {
+		return errors.Wrap(err, "fail to open influx connection")
+	}
+	for series, seriesReadings := range readings {
+		for _, e := range Detect(seriesReadings, opts) {
+			e.StreamID, e.Apiary, e.RucherID = series.StreamID, series.Apiary, series.RucherID
+			if k, ok := known[key(e)]; ok && (k.Status != StatusCandidate || k.Magnitude == e.Magnitude) {
+				continue
+			}
+			err = add(bp, e)
+			if err != nil {
+				return errors.Wrap(err, "fail to add step point")
+			}
+		}
+	}
+
+	log.WithField("points", len((*bp).Points())).Info("Weight steps detected")
+	err = influx.Write(config.InfluxUrl, bp)
+	if err != nil {
+		return errors.Wrap(err, "fail to write steps")
+	}
+	return nil
+}
+
+// Detect returns the steps of the readings as candidates
+func Detect(readings []nectar.Reading, opts Options) []Event {
+	sorted := append([]nectar.Reading{}, readings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	var events []Event
+	// Index of the event the next step can be merged in, and time of its
+	// last step
+	current := -1
+	var last time.Time
+	for i := 1; i < len(sorted); i++ {
+		prev, r := sorted[i-1], sorted[i]
+		if r.Time.Sub(prev.Time) > opts.MaxGap {
+			current = -1
+			continue
+		}
+		delta := r.Weight - prev.Weight
+		if math.Abs(delta) < opts.Threshold {
+			continue
+		}
+
+		if current >= 0 && r.Time.Sub(last) <= opts.Merge && (delta > 0) == (events[current].Magnitude > 0) {
+			events[current].After = r.Weight
+			events[current].Magnitude = r.Weight - events[current].Before
+			events[current].Last = r.Time
+			last = r.Time
+			continue
+		}
+		events = append(events, Event{
+			ID:        strconv.FormatInt(r.Time.UnixNano(), 10),
+			Time:      r.Time,
+			Before:    prev.Weight,
+			After:     r.Weight,
+			Magnitude: delta,
+			Status:    StatusCandidate,
+			Last:      r.Time,
+		})
+		current = len(events) - 1
+		last = r.Time
+	}
+	return events
+}
+
+// List returns the steps of a device, of every device if empty
+func List(device string, from, to time.Time) ([]Event, error) {
+	config := config.Get()
+	condition := ""
+	if device != "" {
+		condition = `"stream_id" = ` + influx.Quote(device) + " AND "
+	}
+	query := fmt.Sprintf(
+		`SELECT "before", "after", "magnitude", "status", "type" FROM "%s" WHERE %stime >= %s AND time <= %s GROUP BY "stream_id", "apiary", "rucher_id"`,
+		Measurement, condition, influx.Time(from), influx.Time(to),
+	)
+	rows, err := influx.QueryRows(config.InfluxUrl, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query steps")
+	}
+
+	events := make([]Event, 0, len(rows))
+	for _, row := range rows {
+		e := Event{
+			ID:       strconv.FormatInt(row.Time.UnixNano(), 10),
+			StreamID: row.Tags["stream_id"],
+			Apiary:   row.Tags["apiary"],
+			RucherID: row.Tags["rucher_id"],
+			Time:     row.Time,
+		}
+		e.Before, _ = influx.Float(row.Values["before"])
+		e.After, _ = influx.Float(row.Values["after"])
+		e.Magnitude, _ = influx.Float(row.Values["magnitude"])
+		if status, ok := row.Values["status"].(string); ok {
+			e.Status = status
+		}
+		if t, ok := row.Values["type"].(string); ok {
+			e.Type = t
+		}
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+// Classify sets the type of a step, it is confirmed unless it is a false
+// positive
+func Classify(device, id, stepType string) (Event, error) {
+	if !types[stepType] {
+		return Event{}, ErrInvalidType
+	}
+	ns, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Event{}, ErrNotFound
+	}
+	at := time.Unix(0, ns)
+
+	events, err := List(device, at, at)
+	if err != nil {
+		return Event{}, err
+	}
+	if len(events) == 0 {
+		return Event{}, ErrNotFound
+	}
+	e := events[0]
+	e.Type = stepType
+	e.Status = StatusConfirmed
+	if stepType == TypeFalsePositive {
+		e.Status = StatusRejected
+	}
+
+	// The point replaces the stored one, it has the same tags and time
+	config := config.Get()
+	bp, err := influx.Start(config.InfluxUrl)
+	if err != nil {
+		return e, errors.Wrap(err, "fail to open influx connection")
+	}
+	err = add(bp, e)
+	if err != nil {
+		return e, errors.Wrap(err, "fail to add step point")
+	}
+	err = influx.Write(config.InfluxUrl, bp)
+	if err != nil {
+		return e, errors.Wrap(err, "fail to write step")
+	}
+	return e, nil
+}
+
+func add(bp *influxclient.BatchPoints, e Event) error {
+	values := map[string]interface{}{
+		"before":    e.Before,
+		"after":     e.After,
+		"magnitude": e.Magnitude,
+		"status":    e.Status,
+	}
+	if e.Type != "" {
+		values["type"] = e.Type
+	}
+	tags := map[string]string{"stream_id": e.StreamID}
+	if e.Apiary != "" {
+		tags["apiary"] = e.Apiary
+	}
+	if e.RucherID != "" {
+		tags["rucher_id"] = e.RucherID
+	}
+	return influx.Add(Measurement, values, tags, bp, e.Time)
+}
+
+func key(e Event) string {
+	return e.StreamID + "/" + e.Apiary + "/" + e.RucherID + "/" + e.ID
+}
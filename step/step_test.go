@@ -0,0 +1,231 @@
+package step
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/config/configtest"
+	"github.com/johnsudaar/ruche/influx/influxtest"
+	"github.com/johnsudaar/ruche/nectar"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+)
+
+func Test_Detect(t *testing.T) {
+	start := time.Date(2022, 7, 14, 8, 0, 0, 0, time.UTC)
+	weights := []float64{
+		60, 60.3, 60.1,
+		// Two supers removed ten minutes apart
+		48.2, 36.5,
+		36.6, 36.8,
+		// Syrup feeding
+		40.1, 40.0,
+	}
+	var readings []nectar.Reading
+	for i, w := range weights {
+		readings = append(readings, nectar.Reading{Time: start.Add(time.Duration(i) * 10 * time.Minute), Weight: w})
+	}
+	// A gap is missing data, not a step
+	readings = append(readings, nectar.Reading{Time: start.Add(5 * time.Hour), Weight: 10})
+
+	events := Detect(readings, Options{Threshold: 2, MaxGap: time.Hour, Merge: 30 * time.Minute})
+	if len(events) != 2 {
+		t.Fatalf("expected 2 steps, got %+v", events)
+	}
+
+	harvest := events[0]
+	if !harvest.Time.Equal(readings[3].Time) || math.Abs(harvest.Magnitude+23.6) > 1e-9 || harvest.Before != 60.1 || harvest.After != 36.5 {
+		t.Fatalf("unexpected harvest step %+v", harvest)
+	}
+	if harvest.Status != StatusCandidate || harvest.ID == "" {
+		t.Fatalf("expected a candidate with an id %+v", harvest)
+	}
+
+	feeding := events[1]
+	if math.Abs(feeding.Magnitude-3.3) > 1e-9 {
+		t.Fatalf("unexpected feeding step %+v", feeding)
+	}
+}
+
+var stepColumns = []string{"time", "before", "after", "magnitude", "status", "type"}
+
+func Test_Compute(t *testing.T) {
+	start := time.Date(2022, 7, 14, 8, 0, 0, 0, time.UTC)
+	at := func(i int) string {
+		return start.Add(time.Duration(i) * 10 * time.Minute).Format(time.RFC3339)
+	}
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		tags := map[string]string{"stream_id": "1A2B3C", "apiary": "chenes", "rucher_id": "1"}
+		switch {
+		case strings.Contains(q, `FROM "raw"`):
+			return []influxtest.Serie{{Name: "raw", Tags: tags, Columns: []string{"time", "mass_r1"}, Values: [][]interface{}{
+				{at(0), 60}, {at(1), 60.2}, {at(2), 48}, {at(3), 48.1}, {at(4), 52.3},
+			}}}
+		case strings.Contains(q, `FROM "steps"`):
+			// The harvest has been classified by the beekeeper
+			return []influxtest.Serie{{Name: Measurement, Tags: tags, Columns: stepColumns, Values: [][]interface{}{
+				{at(2), 60.2, 48, -12.2, StatusConfirmed, TypeHarvest},
+			}}}
+		}
+		return nil
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL()})
+
+	err := Compute(context.Background(), start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := server.Points(Measurement)
+	if len(points) != 1 {
+		t.Fatalf("expected only the new step to be written, got %+v", points)
+	}
+	p := points[0]
+	magnitude, _ := strconv.ParseFloat(p.Fields["magnitude"], 64)
+	if p.Time.Format(time.RFC3339) != at(4) || math.Abs(magnitude-4.2) > 1e-9 || p.Fields["status"] != StatusCandidate {
+		t.Fatalf("unexpected step %+v", p)
+	}
+	if p.Tags["stream_id"] != "1A2B3C" || p.Tags["apiary"] != "chenes" || p.Tags["rucher_id"] != "1" {
+		t.Fatalf("unexpected tags %v", p.Tags)
+	}
+}
+
+func Test_Classify(t *testing.T) {
+	at := time.Date(2022, 7, 14, 8, 20, 0, 0, time.UTC)
+	id := strconv.FormatInt(at.UnixNano(), 10)
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		if !strings.Contains(q, "time >= '2022-07-14T08:20:00Z'") {
+			return nil
+		}
+		return []influxtest.Serie{{Name: Measurement, Tags: map[string]string{"stream_id": "1A2B3C", "apiary": "chenes"}, Columns: stepColumns, Values: [][]interface{}{
+			{at.Format(time.RFC3339), 60.2, 48, -12.2, StatusCandidate, nil},
+		}}}
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL()})
+
+	_, err := Classify("1A2B3C", id, "robbery")
+	if err != ErrInvalidType {
+		t.Fatalf("expected an invalid type error, got %v", err)
+	}
+	_, err = Classify("1A2B3C", strconv.FormatInt(at.Add(time.Hour).UnixNano(), 10), TypeHarvest)
+	if err != ErrNotFound {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+
+	e, err := Classify("1A2B3C", id, TypeFalsePositive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Status != StatusRejected || e.Type != TypeFalsePositive || e.Apiary != "chenes" {
+		t.Fatalf("unexpected step %+v", e)
+	}
+
+	// The stored point is replaced, with the same tags and time
+	points := server.Points(Measurement)
+	if len(points) != 1 {
+		t.Fatalf("expected the step to be written, got %+v", points)
+	}
+	p := points[0]
+	if !p.Time.Equal(at) || p.Tags["apiary"] != "chenes" || p.Fields["status"] != StatusRejected || p.Fields["type"] != TypeFalsePositive {
+		t.Fatalf("unexpected point %+v", p)
+	}
+}
+
+func Test_GetProduction(t *testing.T) {
+	server := influxtest.New(t)
+	server.Respond = func(q string) []influxtest.Serie {
+		tags := map[string]string{"stream_id": "1A2B3C"}
+		// The relay also forwards a hive of another apiary
+		pins := map[string]string{"stream_id": "1A2B3C", "apiary": "pins"}
+		switch {
+		case strings.Contains(q, `FROM "steps"`):
+			return []influxtest.Serie{{Name: Measurement, Tags: tags, Columns: stepColumns, Values: [][]interface{}{
+				{"2022-05-10T10:00:00Z", 30, 32, -2, StatusConfirmed, TypeSwarm},
+				{"2022-07-14T08:20:00Z", 60, 48, -12, StatusConfirmed, TypeHarvest},
+				{"2022-09-20T09:00:00Z", 40, 43, 3, StatusConfirmed, TypeFeeding},
+				{"2022-09-21T09:00:00Z", 43, 40, -3, StatusRejected, TypeFalsePositive},
+				{"2022-09-22T09:00:00Z", 40, 37, -3, StatusCandidate, nil},
+			}}, {Name: Measurement, Tags: pins, Columns: stepColumns, Values: [][]interface{}{
+				{"2022-07-15T08:20:00Z", 50, 40, -10, StatusConfirmed, TypeHarvest},
+			}}}
+		case strings.Contains(q, `FROM "raw"`):
+			columns := []string{"time", "mass_r1", "mass_r2", "mass_r3", "mass_r4"}
+			return []influxtest.Serie{{Name: "raw", Tags: tags, Columns: columns, Values: [][]interface{}{
+				{"2022-03-02T10:00:00Z", 30, nil, nil, nil},
+				{"2022-07-14T10:00:00Z", 50, nil, nil, nil},
+				{"2022-10-01T10:00:00Z", 44, nil, nil, nil},
+			}}, {Name: "raw", Tags: pins, Columns: columns, Values: [][]interface{}{
+				{"2022-03-01T10:00:00Z", 10, nil, nil, nil},
+				{"2022-11-01T10:00:00Z", 90, nil, nil, nil},
+			}}}
+		}
+		return nil
+	}
+	configtest.Setenv(t, map[string]string{"SCALINGO_INFLUX_URL": server.URL(), "SEASON_START_MONTH": "3"})
+
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "chenes", Timezone: "Europe/Paris"}, {ID: "pins"}},
+		Devices:  []registry.Device{{StreamID: "1A2B3C", Apiary: "chenes", RucherIDs: map[string]string{"2": "pins"}}},
+	})
+
+	p, err := GetProduction("1A2B3C", "", 2022)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The season starts on the 1st of March in the timezone of the apiary
+	if p.From.Format(time.RFC3339) != "2022-03-01T00:00:00+01:00" || p.To.Format(time.RFC3339) != "2023-03-01T00:00:00+01:00" {
+		t.Fatalf("unexpected season %v - %v", p.From, p.To)
+	}
+	for _, q := range server.Queries() {
+		if !strings.Contains(q, "time >= '2022-02-28T23:00:00Z' AND time <= '2023-02-28T23:00:00Z'") {
+			t.Errorf("unexpected range of %v", q)
+		}
+	}
+	// The net gain is the change between the first and the last reading
+	if p.Harvested != 12 || p.Fed != 3 || p.Swarms != 1 || p.NetGain != 14 || p.ColonyGain != 25 {
+		t.Fatalf("unexpected production %+v", p)
+	}
+
+	p, err = GetProduction("1A2B3C", "pins", 2022)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.From.Format(time.RFC3339) != "2022-03-01T00:00:00Z" || p.Harvested != 10 || p.Swarms != 0 || p.NetGain != 80 || p.ColonyGain != 90 {
+		t.Fatalf("unexpected production of the relayed hive %+v", p)
+	}
+}
+
+func Test_CurrentSeason(t *testing.T) {
+	configtest.Setenv(t, map[string]string{"SEASON_START_MONTH": "3", "TIMEZONE": "UTC"})
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "chenes", Timezone: "Europe/Paris"}},
+		Devices:  []registry.Device{{StreamID: "1A2B3C", Apiary: "chenes"}, {StreamID: "4D5E6F"}},
+	})
+
+	// It is already March in Paris
+	now := time.Date(2023, 2, 28, 23, 30, 0, 0, time.UTC)
+	for device, expected := range map[string]int{"1A2B3C": 2023, "4D5E6F": 2022} {
+		season, err := CurrentSeason(device, "", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if season != expected {
+			t.Errorf("%v: expected season %v, got %v", device, expected, season)
+		}
+	}
+}
+
+func Test_ValidateSeasonStart(t *testing.T) {
+	for month, valid := range map[int]bool{0: false, 1: true, 12: true, 13: false} {
+		if err := ValidateSeasonStart(month); (err == nil) != valid {
+			t.Errorf("month %v: unexpected error %v", month, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package timecheck
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Policy string
+
+const (
+	// PolicyReject drops the readings with a suspect time
+	PolicyReject Policy = "reject"
+	// PolicyClamp stores the readings with a suspect time at the receive time
+	PolicyClamp Policy = "clamp"
+	// PolicyFlag stores the readings at their time with a time_suspect field
+	PolicyFlag Policy = "flag"
+
+	ReasonMissing = "missing"
+	ReasonFuture  = "future"
+	ReasonTooOld  = "too_old"
+)
+
+// ErrRejected is returned when the time is suspect and the policy is reject
+var ErrRejected = errors.New("suspect time rejected")
+
+// Result is the time to store the reading at
+type Result struct {
+	Time time.Time
+	// Suspect is set when the reading must be flagged
+	Suspect bool
+	// Reason is set when the time sent by the device is suspect, whatever the
+	// policy
+	Reason string
+	// Skew is the receive time minus the time sent by the device
+	Skew time.Duration
+}
+
+type Checker struct {
+	Policy    Policy
+	MaxFuture time.Duration
+	MaxAge    time.Duration
+}
+
+func (c Checker) Validate() error {
+	switch c.Policy {
+	case PolicyReject, PolicyClamp, PolicyFlag:
+		return nil
+	}
+	return fmt.Errorf("unknown timestamp policy %q", c.Policy)
+}
+
+// Check applies the policy to the time sent by a device
+func (c Checker) Check(created, received time.Time) (Result, error) {
+	res := Result{Time: created}
+	switch {
+	case created.IsZero() || created.Unix() <= 0:
+		res.Reason = ReasonMissing
+	case created.Sub(received) > c.MaxFuture:
+		res.Reason = ReasonFuture
+	case c.MaxAge > 0 && received.Sub(created) > c.MaxAge:
+		res.Reason = ReasonTooOld
+	}
+	if res.Reason != ReasonMissing {
+		res.Skew = received.Sub(created)
+	}
+
+	if res.Reason == "" {
+		return res, nil
+	}
+	switch c.Policy {
+	case PolicyReject:
+		return res, errors.Wrap(ErrRejected, res.Reason)
+	case PolicyClamp:
+		res.Time = received
+	default:
+		res.Suspect = true
+		// There is no time to flag, the receive time is the best we have
+		if res.Reason == ReasonMissing {
+			res.Time = received
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,38 @@
+package timecheck
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Check(t *testing.T) {
+	received := time.Now()
+	checker := Checker{Policy: PolicyFlag, MaxFuture: 5 * time.Minute, MaxAge: 24 * time.Hour}
+
+	res, err := checker.Check(received.Add(-time.Minute), received)
+	if err != nil || res.Suspect || res.Skew != time.Minute {
+		t.Fatalf("unexpected result for a valid time: %+v %v", res, err)
+	}
+
+	res, err = checker.Check(received.Add(time.Hour), received)
+	if err != nil || !res.Suspect || res.Reason != ReasonFuture {
+		t.Fatalf("expected a flagged future time: %+v %v", res, err)
+	}
+
+	res, err = checker.Check(time.Time{}, received)
+	if err != nil || !res.Suspect || !res.Time.Equal(received) {
+		t.Fatalf("expected the receive time for a missing time: %+v %v", res, err)
+	}
+
+	checker.Policy = PolicyClamp
+	res, err = checker.Check(received.Add(-48*time.Hour), received)
+	if err != nil || res.Suspect || res.Reason != ReasonTooOld || !res.Time.Equal(received) {
+		t.Fatalf("expected a clamped time: %+v %v", res, err)
+	}
+
+	checker.Policy = PolicyReject
+	_, err = checker.Check(received.Add(time.Hour), received)
+	if err == nil {
+		t.Fatal("expected the time to be rejected")
+	}
+}
@@ -0,0 +1,219 @@
+package uplink
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/event"
+	"github.com/johnsudaar/ruche/fragment"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/johnsudaar/ruche/timecheck"
+	"github.com/pkg/errors"
+)
+
+// Input is the body of the callback sent by the network for every uplink
+type Input struct {
+	StreamID string    `json:"streamId"`
+	Model    string    `json:"model"`
+	Created  time.Time `json:"created"`
+	Location Location  `json:"location"`
+	Value    Value     `json:"value"`
+	// Radio metadata, only set when the network supplies them
+	SeqNumber *uint32  `json:"seqNumber"`
+	RSSI      *float64 `json:"rssi"`
+	SNR       *float64 `json:"snr"`
+	Station   string   `json:"station"`
+	Gateway   string   `json:"gateway"`
+	// Ack is set by the network when the device waits for a downlink
+	Ack bool `json:"ack"`
+}
+
+type Location struct {
+	Provider string  `json:"provider"`
+	Alt      float64 `json:"alt"`
+	Accuracy float64 `json:"accuracy"`
+	Lon      float64 `json:"lon"`
+	Lat      float64 `json:"lat"`
+}
+
+type Value struct {
+	Payload string `json:"payload"`
+}
+
+// Point is a point to store in a measurement
+type Point struct {
+	Measurement string
+	Values      map[string]interface{}
+	Tags        map[string]string
+}
+
+// At returns the point to store for a reading taken at t
+func (p Point) At(t time.Time) sink.Point {
+	return sink.Point{Measurement: p.Measurement, Values: p.Values, Tags: p.Tags, Time: t}
+}
+
+// Event returns the event sent in the payload. Only the payloads of the
+// models sending ASCII event frames are classified, the others are decoded.
+func Event(model string, payload []byte) (event.Event, bool) {
+	if !decoder.SendsTextEvents(model) {
+		return event.Event{}, false
+	}
+	return event.Classify(payload)
+}
+
+// Points decodes a measurement frame into the points to store. The webhook
+// and the reprocess command must produce the same points, hence this shared
+// path.
+func Points(body Input, payload []byte) ([]Point, error) {
+	values := make(map[string]interface{})
+	tags := make(map[string]string)
+	values["location_alt"] = body.Location.Alt
+	values["location_accuracy"] = body.Location.Accuracy
+	values["location_lon"] = body.Location.Lon
+	values["location_lat"] = body.Location.Lat
+
+	tags["stream_id"] = body.StreamID
+	tags["model"] = body.Model
+	tags["location_provider"] = body.Location.Provider
+
+	d := decoder.Get(body.Model)
+	if multi, ok := d.(decoder.MultiDecoder); ok {
+		readings, err := multi.DecodeReadings(payload)
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to decode payload")
+		}
+		points := make([]Point, 0, len(readings))
+		for _, r := range readings {
+			pointTags := make(map[string]string)
+			for k, v := range tags {
+				pointTags[k] = v
+			}
+			for k, v := range r.Tags {
+				pointTags[k] = v
+			}
+			point := Point{Measurement: r.Measurement, Values: r.Values, Tags: pointTags}
+			tagApiary(body.StreamID, &point)
+			err := coerce(body.Model, &point)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, point)
+		}
+		return points, nil
+	}
+
+	values, err := d.Decode(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to decode payload")
+	}
+
+	point := Point{
+		Measurement: decoder.MeasurementOf(d),
+		Values:      values,
+		Tags:        tags,
+	}
+	tagApiary(body.StreamID, &point)
+	err = coerce(body.Model, &point)
+	if err != nil {
+		return nil, err
+	}
+	return []Point{point}, nil
+}
+
+// FieldPoints returns the point of fields posted directly by a device
+func FieldPoints(streamID, model string, values map[string]interface{}) ([]Point, error) {
+	point := Point{
+		Measurement: decoder.MeasurementRaw,
+		Values:      values,
+		Tags: map[string]string{
+			"stream_id": streamID,
+			"model":     model,
+		},
+	}
+	tagApiary(streamID, &point)
+	err := coerce(model, &point)
+	if err != nil {
+		return nil, err
+	}
+	return []Point{point}, nil
+}
+
+// tagApiary moves the rucher_id sent by the boards to the tags and adds the
+// apiary it is mapped to in the registry
+func tagApiary(streamID string, point *Point) {
+	var rucherID *int
+	if value, ok := point.Values["rucher_id"]; ok {
+		delete(point.Values, "rucher_id")
+		id, err := strconv.Atoi(fmt.Sprint(value))
+		if err == nil {
+			rucherID = &id
+			point.Tags["rucher_id"] = strconv.Itoa(id)
+		}
+	}
+
+	apiary, ok := registry.Get().ApiaryOf(streamID, rucherID)
+	if ok {
+		point.Tags["apiary"] = apiary.ID
+	}
+}
+
+// coerce writes the fields with the type set in the schema of the model
+func coerce(model string, point *Point) error {
+	schema, ok := decoder.SchemaOf(model)
+	if !ok {
+		return nil
+	}
+	if errs := schema.Coerce(point.Values); len(errs) > 0 {
+		return fmt.Errorf("invalid fields %v", errs)
+	}
+	return nil
+}
+
+// CheckTime applies the timestamp policy to the time sent by the network, the
+// returned input carries the time to store the reading at
+func CheckTime(body Input, received time.Time) (Input, timecheck.Result, error) {
+	config := config.Get()
+	checker := timecheck.Checker{
+		Policy:    timecheck.Policy(config.TimestampPolicy),
+		MaxFuture: config.TimestampMaxFuture,
+		MaxAge:    config.TimestampMaxAge,
+	}
+	res, err := checker.Check(body.Created, received)
+	if err != nil {
+		return body, res, err
+	}
+	body.Created = res.Time
+	return body, res, nil
+}
+
+// Reassemble buffers the fragments sent by the models configured as
+// fragmented. It returns false until the message is complete, the returned
+// input then carries the time of the first fragment.
+func Reassemble(buffer *fragment.Buffer, body Input, payload []byte) (Input, []byte, bool, error) {
+	if !isFragmented(body.Model) {
+		return body, payload, true, nil
+	}
+
+	msg, complete, err := buffer.Add(body.StreamID, payload, body.Created)
+	if err != nil {
+		return body, nil, false, errors.Wrap(err, "fail to reassemble fragment")
+	}
+	if !complete {
+		return body, nil, false, nil
+	}
+	body.Created = msg.Created
+	return body, msg.Payload, true, nil
+}
+
+func isFragmented(model string) bool {
+	for _, m := range config.Get().FragmentedModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package uplink
+
+import (
+	"testing"
+
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/event"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+)
+
+func Test_EventPrintableSoundFrame(t *testing.T) {
+	decoder.Register("hive-sound", decoder.DefaultSound)
+
+	// Every band is in the printable range: "(((( 222"
+	payload := []byte{40, 40, 40, 40, 32, 50, 50, 50}
+	_, ok := Event("hive-sound", payload)
+	if ok {
+		t.Fatal("sound frame classified as an event")
+	}
+	points, err := Points(Input{StreamID: "1A2B3C", Model: "hive-sound"}, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].Measurement != decoder.MeasurementSound || points[0].Values["band_100_162"] != 40.0 {
+		t.Fatalf("unexpected points %+v", points)
+	}
+
+	ev, ok := Event(decoder.DefaultModel, []byte("Restart"))
+	if !ok || ev.Type != event.TypeRestart {
+		t.Fatalf("expected a restart event, got %+v", ev)
+	}
+}
+
+func Test_TagApiary(t *testing.T) {
+	registrytest.Use(t, registry.Registry{
+		Apiaries: []registry.Apiary{{ID: "chenes"}, {ID: "tilleuls"}},
+		Devices: []registry.Device{
+			{StreamID: "relay", Apiary: "chenes", RucherIDs: map[string]string{"2": "tilleuls"}},
+		},
+	})
+
+	examples := map[string]struct {
+		StreamID string
+		RucherID interface{}
+		Tags     map[string]string
+	}{
+		"mapped rucher_id": {
+			StreamID: "relay", RucherID: 2.0,
+			Tags: map[string]string{"rucher_id": "2", "apiary": "tilleuls"},
+		},
+		"unmapped rucher_id": {
+			StreamID: "relay", RucherID: 5.0,
+			Tags: map[string]string{"rucher_id": "5", "apiary": "chenes"},
+		},
+		"no rucher_id": {
+			StreamID: "relay",
+			Tags:     map[string]string{"apiary": "chenes"},
+		},
+		"unknown device": {
+			StreamID: "unknown", RucherID: 2.0,
+			Tags: map[string]string{"rucher_id": "2"},
+		},
+	}
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			point := Point{Values: map[string]interface{}{"temp": 20.8}, Tags: map[string]string{}}
+			if example.RucherID != nil {
+				point.Values["rucher_id"] = example.RucherID
+			}
+			tagApiary(example.StreamID, &point)
+
+			if _, ok := point.Values["rucher_id"]; ok {
+				t.Fatalf("expected rucher_id to be moved to the tags, got %+v", point.Values)
+			}
+			if len(point.Tags) != len(example.Tags) {
+				t.Fatalf("expected tags %v, got %v", example.Tags, point.Tags)
+			}
+			for k, v := range example.Tags {
+				if point.Tags[k] != v {
+					t.Fatalf("expected tags %v, got %v", example.Tags, point.Tags)
+				}
+			}
+		})
+	}
+}
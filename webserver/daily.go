@@ -0,0 +1,23 @@
+package webserver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/johnsudaar/ruche/nectar"
+	"github.com/pkg/errors"
+)
+
+func GetDailyWeight(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	from, to, err := timeRange(req, 30*24*time.Hour)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+
+	daily, err := nectar.Get(params["device_id"], from, to)
+	if err != nil {
+		return errors.Wrap(err, "fail to get daily weight changes")
+	}
+	return writeJSON(resp, http.StatusOK, daily)
+}
@@ -0,0 +1,59 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/johnsudaar/ruche/downlink"
+	"github.com/pkg/errors"
+)
+
+func ListDownlinks(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	return writeJSON(resp, http.StatusOK, downlinkQueue.List(params["device_id"]))
+}
+
+func CreateDownlink(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	var cmd downlink.Command
+	err := json.NewDecoder(req.Body).Decode(&cmd)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return errors.Wrap(err, "fail to decode body")
+	}
+
+	d, err := downlinkQueue.Push(params["device_id"], cmd)
+	if _, ok := err.(*downlink.SaveError); ok {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		return errors.Wrap(err, "fail to queue downlink")
+	}
+
+	return writeJSON(resp, http.StatusCreated, d)
+}
+
+func CancelDownlink(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return errors.Wrap(err, "invalid downlink id")
+	}
+
+	d, err := downlinkQueue.Cancel(params["device_id"], id)
+	if err == downlink.ErrNotFound {
+		resp.WriteHeader(http.StatusNotFound)
+		return err
+	}
+	if _, ok := err.(*downlink.SaveError); ok {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusConflict)
+		return errors.Wrap(err, "fail to cancel downlink")
+	}
+
+	return writeJSON(resp, http.StatusOK, d)
+}
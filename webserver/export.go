@@ -0,0 +1,62 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/johnsudaar/ruche/downlink"
+	"github.com/johnsudaar/ruche/export"
+	"github.com/pkg/errors"
+)
+
+type bundleFunc func(ctx context.Context, w io.Writer, id string, from, to time.Time, downlinks *downlink.Queue) (export.Manifest, error)
+
+// ExportApiary sends the ZIP bundle of the data of an apiary
+func ExportApiary(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	return sendBundle(resp, req, params["apiary_id"], export.Bundle)
+}
+
+// ExportDevice sends the ZIP bundle of the data of a hive
+func ExportDevice(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	return sendBundle(resp, req, params["device_id"], export.BundleDevice)
+}
+
+// sendBundle writes the bundle to a temporary file first so that a failure is
+// reported with an error status instead of a truncated archive
+func sendBundle(resp http.ResponseWriter, req *http.Request, id string, bundle bundleFunc) error {
+	from, to, err := timeRange(req, 365*24*time.Hour)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "ruche-export-*.zip")
+	if err != nil {
+		return errors.Wrap(err, "fail to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = bundle(req.Context(), tmp, id, from, to, downlinkQueue)
+	if err == export.ErrUnknownApiary || err == export.ErrUnknownDevice {
+		resp.WriteHeader(http.StatusNotFound)
+		return err
+	}
+	if err != nil {
+		return errors.Wrapf(err, "fail to export %v", id)
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "fail to read export")
+	}
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.zip"`, id, to.Format("20060102")))
+	resp.WriteHeader(http.StatusOK)
+	_, err = io.Copy(resp, tmp)
+	return err
+}
@@ -0,0 +1,31 @@
+package webserver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/johnsudaar/ruche/flight"
+	"github.com/pkg/errors"
+)
+
+func GetFlightActivity(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	from, to, err := timeRange(req, 7*24*time.Hour)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+	period := req.URL.Query().Get("period")
+	if period == "" {
+		period = flight.PeriodDay
+	}
+	if period != flight.PeriodDay && period != flight.PeriodHour {
+		resp.WriteHeader(http.StatusBadRequest)
+		return errors.New("period must be hour or day")
+	}
+
+	activity, err := flight.Get(params["device_id"], period, from, to)
+	if err != nil {
+		return errors.Wrap(err, "fail to get flight activity")
+	}
+	return writeJSON(resp, http.StatusOK, activity)
+}
@@ -0,0 +1,21 @@
+package webserver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/johnsudaar/ruche/forecast"
+	"github.com/pkg/errors"
+)
+
+func GetForecast(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	f, err := forecast.Get(params["device_id"], req.URL.Query().Get("apiary"), time.Now())
+	if err == forecast.ErrNotEnoughData {
+		resp.WriteHeader(http.StatusNotFound)
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "fail to forecast food stores")
+	}
+	return writeJSON(resp, http.StatusOK, f)
+}
@@ -0,0 +1,99 @@
+package webserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/johnsudaar/ruche/uplink"
+	"github.com/pkg/errors"
+)
+
+// IngestInput is the body posted by the devices sending named fields
+type IngestInput struct {
+	Created *time.Time             `json:"created"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+// Ingest stores the fields posted by a Wi-Fi or cellular device. The device is
+// authenticated by the bearer token set in the registry and its fields are
+// validated against the schema of its model.
+func Ingest(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	ctx := req.Context()
+	log := logger.Get(ctx)
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	device, ok := registry.Get().DeviceByToken(token)
+	if !ok {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return errors.New("invalid device token")
+	}
+	log = log.WithField("stream_id", device.StreamID)
+
+	rawBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		return errors.Wrap(err, "fail to read body")
+	}
+	archiveRequest(ctx, req, rawBody)
+
+	var body IngestInput
+	err = json.Unmarshal(rawBody, &body)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return errors.Wrap(err, "fail to decode body")
+	}
+	if len(body.Fields) == 0 {
+		resp.WriteHeader(http.StatusBadRequest)
+		return errors.New("no fields")
+	}
+
+	schema, ok := decoder.SchemaOf(device.Model)
+	if !ok {
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		return errors.Errorf("no schema for model %q", device.Model)
+	}
+	if errs := schema.Validate(body.Fields); len(errs) > 0 {
+		log.WithField("errors", errs).Info("Invalid fields")
+		return writeJSON(resp, http.StatusUnprocessableEntity, map[string]interface{}{"errors": errs})
+	}
+
+	created := time.Now()
+	suspect := false
+	if body.Created != nil {
+		checked, res, err := uplink.CheckTime(uplink.Input{Created: *body.Created}, created)
+		if err != nil {
+			resp.WriteHeader(http.StatusUnprocessableEntity)
+			return errors.Wrap(err, "invalid created time")
+		}
+		created = checked.Created
+		suspect = res.Suspect
+	}
+
+	fieldPoints, err := uplink.FieldPoints(device.StreamID, device.Model, body.Fields)
+	if err != nil {
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		return err
+	}
+	var points []sink.Point
+	for _, point := range fieldPoints {
+		if suspect {
+			point.Values["time_suspect"] = true
+		}
+		log.Info(point.Values)
+		points = append(points, point.At(created))
+	}
+	err = sink.Write(ctx, points)
+	if err != nil {
+		return errors.Wrap(err, "fail to write points")
+	}
+	recordMetrics(device.StreamID, points)
+
+	resp.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,41 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/registry/registrytest"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/sirupsen/logrus"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write(ctx context.Context, points []sink.Point) error {
+	return errors.New("influx is down")
+}
+
+func Test_IngestWriteFailure(t *testing.T) {
+	registrytest.Use(t, registry.Registry{Devices: []registry.Device{{StreamID: "esp32", Model: "esp32-scale", Token: "secret"}}})
+	decoder.RegisterSchema("esp32-scale", decoder.Schema{"mass_r1": {Type: decoder.TypeFloat}})
+	sink.Use(failingSink{})
+	defer sink.Use()
+
+	router := newRouter(logrus.New(), config.Config{APIUsername: "admin", APIPassword: "admin"})
+	req := httptest.NewRequest("POST", "/ingest", strings.NewReader(`{"fields": {"mass_r1": 12.5}}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	// The device is not asked for the API credentials and retries on 5xx
+	if resp.Code != http.StatusInternalServerError {
+		t.Fatalf("expected a 500 status, got %v: %v", resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,44 @@
+package webserver
+
+import (
+	"net/http"
+
+	"github.com/johnsudaar/ruche/metrics"
+	"github.com/johnsudaar/ruche/registry"
+	"github.com/johnsudaar/ruche/sink"
+)
+
+var latestValues = metrics.NewStore()
+
+// Metrics exposes the latest value of every field for Prometheus
+func Metrics(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := latestValues.WriteTo(resp)
+	return err
+}
+
+// recordMetrics keeps the values of the points stored for a device, labelled
+// with its apiary and hive from the registry. It must be called once the
+// points are written.
+func recordMetrics(streamID string, points []sink.Point) {
+	labels := map[string]string{"stream_id": streamID}
+	if device, ok := registry.Get().Device(streamID); ok {
+		if device.Hive != "" {
+			labels["hive"] = device.Hive
+		}
+		if device.Apiary != "" {
+			labels["apiary"] = device.Apiary
+		}
+	}
+
+	for _, point := range points {
+		tags := make(map[string]string)
+		for k, v := range point.Tags {
+			if k == "stream_id" || k == "model" || k == "location_provider" {
+				continue
+			}
+			tags[k] = v
+		}
+		latestValues.Record(streamID, labels, point.Measurement, point.Values, tags, point.Time)
+	}
+}
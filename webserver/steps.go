@@ -0,0 +1,74 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/johnsudaar/ruche/step"
+	"github.com/pkg/errors"
+)
+
+// StepClassification is the body of a step classification
+type StepClassification struct {
+	Type string `json:"type"`
+}
+
+func ListSteps(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	from, to, err := timeRange(req, 30*24*time.Hour)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+
+	events, err := step.List(params["device_id"], from, to)
+	if err != nil {
+		return errors.Wrap(err, "fail to list steps")
+	}
+	return writeJSON(resp, http.StatusOK, events)
+}
+
+func ClassifyStep(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	var body StepClassification
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return errors.Wrap(err, "fail to decode body")
+	}
+
+	e, err := step.Classify(params["device_id"], params["id"], body.Type)
+	if err == step.ErrNotFound {
+		resp.WriteHeader(http.StatusNotFound)
+		return err
+	}
+	if err == step.ErrInvalidType {
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "fail to classify step")
+	}
+	return writeJSON(resp, http.StatusOK, e)
+}
+
+func GetProduction(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	apiary := req.URL.Query().Get("apiary")
+	season, err := step.CurrentSeason(params["device_id"], apiary, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "fail to get current season")
+	}
+	if v := req.URL.Query().Get("season"); v != "" {
+		season, err = strconv.Atoi(v)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return errors.Wrap(err, "invalid season")
+		}
+	}
+
+	production, err := step.GetProduction(params["device_id"], apiary, season)
+	if err != nil {
+		return errors.Wrap(err, "fail to get production")
+	}
+	return writeJSON(resp, http.StatusOK, production)
+}
@@ -0,0 +1,32 @@
+package webserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/johnsudaar/ruche/bulk"
+	"github.com/pkg/errors"
+)
+
+// UploadReadings imports the file logged on the SD card of a device, the file
+// is the request body and its format is set by the format query parameter
+func UploadReadings(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
+	format := req.URL.Query().Get("format")
+	if format != "" && format != bulk.FormatHex && format != bulk.FormatCSV {
+		resp.WriteHeader(http.StatusBadRequest)
+		return errors.New("format must be hex or csv")
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return errors.Wrap(err, "fail to read body")
+	}
+	archiveRequest(req.Context(), req, body)
+
+	report, err := bulk.Import(req.Context(), params["device_id"], bytes.NewReader(body), format)
+	if err != nil {
+		return errors.Wrap(err, "fail to import readings")
+	}
+	return writeJSON(resp, http.StatusOK, report)
+}
@@ -4,49 +4,86 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/johnsudaar/ruche/alert"
+	"github.com/johnsudaar/ruche/archive"
 	"github.com/johnsudaar/ruche/config"
-	"github.com/johnsudaar/ruche/influx"
+	"github.com/johnsudaar/ruche/decoder"
+	"github.com/johnsudaar/ruche/downlink"
+	"github.com/johnsudaar/ruche/event"
+	"github.com/johnsudaar/ruche/fragment"
+	"github.com/johnsudaar/ruche/link"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/johnsudaar/ruche/timecheck"
+	"github.com/johnsudaar/ruche/uplink"
 	"github.com/pkg/errors"
 
 	"github.com/Scalingo/go-utils/logger"
 )
 
-type Input struct {
-	StreamID string    `json:"streamId"`
-	Model    string    `json:"model"`
-	Created  time.Time `json:"created"`
-	Location Location  `json:"location"`
-	Value    Value     `json:"value"`
-}
-
-type Location struct {
-	Provider string  `json:"provider"`
-	Alt      float64 `json:"alt"`
-	Accuracy float64 `json:"accuracy"`
-	Lon      float64 `json:"lon"`
-	Lat      float64 `json:"lat"`
-}
-
-type Value struct {
-	Payload string `json:"payload"`
-}
+var (
+	linkTracker   *link.Tracker
+	downlinkQueue *downlink.Queue
+	eventTracker  *event.Tracker
+	// uplinkArchive is nil when archiving is disabled
+	uplinkArchive *archive.Writer
+	fragments     *fragment.Buffer
+)
 
 func Webhook(resp http.ResponseWriter, req *http.Request, params map[string]string) error {
 	ctx := req.Context()
 	log := logger.Get(ctx)
-	config := config.Get()
 
-	var body Input
-	err := json.NewDecoder(req.Body).Decode(&body)
+	rawBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.WithError(err).Error("fail to read body")
+		return errors.Wrap(err, "fail to read body")
+	}
+	archiveRequest(ctx, req, rawBody)
+
+	var body uplink.Input
+	err = json.Unmarshal(rawBody, &body)
 	if err != nil {
 		log.WithError(err).Error("fail to decode body")
 		return errors.Wrap(err, "fail to decode body")
 	}
 
+	// Any uplink proves the previous downlink has been received
+	received := time.Now()
+	delivered, err := downlinkQueue.Confirm(body.StreamID, received)
+	if err != nil {
+		log.WithError(err).Error("fail to save delivered downlinks")
+	}
+	for _, d := range delivered {
+		log.WithField("downlink_id", d.ID).Info("Downlink delivered")
+	}
+
+	body, timeCheck, err := uplink.CheckTime(body, received)
+	if err != nil {
+		log.WithError(err).WithField("created", body.Created).Warn("Uplink rejected")
+		// The skew of the rejected readings is tracked as well
+		clock := clockPoint(body.StreamID, timeCheck, received)
+		clock.Values["rejected"] = true
+		err = sink.Write(ctx, []sink.Point{clock})
+		if err != nil {
+			log.WithError(err).Error("fail to write clock point")
+		}
+		// The device waits for its downlink whatever the time of the reading
+		if body.Ack {
+			return respondDownlink(ctx, resp, body)
+		}
+		return nil
+	}
+	if timeCheck.Reason != "" {
+		log.WithField("reason", timeCheck.Reason).WithField("created", body.Created).Warn("Suspect uplink time")
+	}
+
 	// 00ed0730110000390116000000000000000000
 
 	log.Infof("Decoding %v", body.Value.Payload)
@@ -56,81 +93,212 @@ func Webhook(resp http.ResponseWriter, req *http.Request, params map[string]stri
 		return errors.Wrap(err, "fail to decode payload (hex)")
 	}
 
-	valueStr := string(valueBytes)
-
-	if valueStr == "Restart" {
-		log.Info("Restart: Ignoring...")
-		return nil
+	// points are the points to store, metered those exposed on /metrics
+	var points, metered []sink.Point
+	measured, valueBytes, complete, err := uplink.Reassemble(fragments, body, valueBytes)
+	if err != nil {
+		log.WithError(err).Error("fail to reassemble payload")
+		return errors.Wrap(err, "fail to reassemble payload")
 	}
 
-	values := make(map[string]interface{})
-	tags := make(map[string]string)
-	values["location_alt"] = body.Location.Alt
-	values["location_accuracy"] = body.Location.Accuracy
-	values["location_lon"] = body.Location.Lon
-	values["location_lat"] = body.Location.Lat
-
-	values = parsePayload(valueBytes)
-	tags["stream_id"] = body.StreamID
-	tags["model"] = body.Model
-	tags["location_provider"] = body.Location.Provider
-	log.Info(values)
-	log.Info(tags)
+	if !complete {
+		log.Info("Fragment buffered, waiting for the rest of the message")
+	} else if ev, ok := uplink.Event(measured.Model, valueBytes); ok {
+		points = append(points, addEvent(ctx, measured, ev))
+	} else {
+		decoded, err := uplink.Points(measured, valueBytes)
+		if err != nil {
+			log.WithError(err).Error("fail to decode payload")
+			return errors.Wrap(err, "fail to decode payload")
+		}
+		for _, point := range decoded {
+			if timeCheck.Suspect {
+				point.Values["time_suspect"] = true
+			}
+			log.Info(point.Values)
+			log.Info(point.Tags)
+			log.Infof("Add %v", point.Measurement)
 
-	bp, err := influx.Start(config.InfluxUrl)
-	if err != nil {
-		log.WithError(err).Error("fail to open influx connection")
-		return errors.Wrap(err, "fail to open influx connection")
+			points = append(points, point.At(measured.Created))
+			metered = append(metered, point.At(measured.Created))
+		}
 	}
-	log.Info("Add")
 
-	err = influx.Add("raw", values, tags, bp, body.Created)
-	if err != nil {
-		log.WithError(err).Error("fail to add batch point")
-		return errors.Wrap(err, "fail to add batch point")
+	radioValues, radioTags := radioPoint(body)
+	if len(radioValues) > 0 {
+		log.Info(radioValues)
+		radio := uplink.Point{Measurement: "radio", Values: radioValues, Tags: radioTags}
+		points = append(points, radio.At(body.Created))
+		metered = append(metered, radio.At(body.Created))
 	}
+
+	points = append(points, clockPoint(body.StreamID, timeCheck, received))
 	log.Info("Write")
 
-	err = influx.Write(config.InfluxUrl, bp)
+	err = sink.Write(ctx, points)
 	if err != nil {
 		log.WithError(err).Error("fail to write points")
 		return errors.Wrap(err, "fail to write points")
 	}
+	recordMetrics(body.StreamID, metered)
 	log.Info("Done")
 
+	if body.Ack {
+		return respondDownlink(ctx, resp, body)
+	}
+
 	return nil
 }
 
-func checkErr(ctx context.Context, err error, value string) error {
+// respondDownlink answers a bidirectional callback with the next pending
+// downlink of the device, using the Sigfox callback response format
+func respondDownlink(ctx context.Context, resp http.ResponseWriter, body uplink.Input) error {
 	log := logger.Get(ctx)
-	log.WithError(err).WithField("field", value).Error(err.Error())
-	return err
+
+	encoder, ok := decoder.Get(body.Model).(decoder.DownlinkEncoder)
+	if !ok {
+		log.WithField("model", body.Model).Info("Model does not support downlinks")
+		resp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	d, data, err := downlinkQueue.Send(body.StreamID, encoder.EncodeDownlink)
+	if err != nil {
+		log.WithError(err).Error("fail to encode downlink")
+		return errors.Wrap(err, "fail to encode downlink")
+	}
+	if d == nil {
+		resp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	log.WithField("downlink_id", d.ID).Infof("Sending downlink %x", data)
+	return writeJSON(resp, http.StatusOK, map[string]interface{}{
+		body.StreamID: map[string]string{
+			"downlinkData": hex.EncodeToString(data),
+		},
+	})
 }
 
-func getValue(payload string, start, end int) string {
-	return strings.Trim(payload[start:end], "\x00 ")
+// archiveRequest keeps the request body verbatim, a failure must not prevent
+// the uplink from being processed
+func archiveRequest(ctx context.Context, req *http.Request, body []byte) {
+	if uplinkArchive == nil {
+		return
+	}
+
+	sourceIP := req.Header.Get("X-Forwarded-For")
+	if sourceIP != "" {
+		sourceIP = strings.TrimSpace(strings.Split(sourceIP, ",")[0])
+	} else {
+		sourceIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+
+	err := uplinkArchive.Append(archive.Record{
+		ReceivedAt: time.Now(),
+		SourceIP:   sourceIP,
+		Route:      req.URL.Path,
+		Body:       string(body),
+	})
+	if err != nil {
+		logger.Get(ctx).WithError(err).Error("fail to archive request")
+	}
 }
 
-func getUInt16(value []byte) uint16 {
-	res := uint16(value[1])<<8 | uint16(value[0])
+// addEvent stores a non-measurement frame in the device_events measurement
+// and raises an alert when the device keeps rebooting
+func addEvent(ctx context.Context, body uplink.Input, ev event.Event) sink.Point {
+	log := logger.Get(ctx).WithField("event", ev.Type)
+	config := config.Get()
+	log.Infof("Event: %v", ev.Message)
 
-	return res
+	count, reboots := eventTracker.Record(body.StreamID, ev, time.Now())
+	values := map[string]interface{}{
+		"message": ev.Message,
+		"count":   float64(count),
+	}
+	if ev.Detail != "" {
+		values["detail"] = ev.Detail
+	}
+	tags := map[string]string{
+		"stream_id": body.StreamID,
+		"type":      ev.Type,
+	}
+
+	if ev.IsReboot() && config.RebootAlertCount > 0 && reboots == config.RebootAlertCount {
+		err := alert.Raise(ctx, alert.Alert{
+			Device:  body.StreamID,
+			Type:    "reboot_loop",
+			Message: fmt.Sprintf("device rebooted %v times in %v", reboots, config.RebootAlertWindow),
+			Time:    body.Created,
+		})
+		if err != nil {
+			log.WithError(err).Error("fail to raise reboot alert")
+		}
+	}
+	return sink.Point{Measurement: "device_events", Values: values, Tags: tags, Time: body.Created}
+}
+
+// clockPoint tracks the skew between the device clock and the server
+func clockPoint(streamID string, res timecheck.Result, received time.Time) sink.Point {
+	return sink.Point{
+		Measurement: "clock",
+		Values:      clockValues(res),
+		Tags:        map[string]string{"stream_id": streamID},
+		Time:        received,
+	}
 }
 
-func parsePayload(payload []byte) map[string]interface{} {
+func clockValues(res timecheck.Result) map[string]interface{} {
+	values := map[string]interface{}{
+		"suspect": res.Reason != "",
+	}
+	if res.Reason != "" {
+		values["reason"] = res.Reason
+	}
+	if res.Reason != timecheck.ReasonMissing {
+		values["skew"] = res.Skew.Seconds()
+	}
+	return values
+}
+
+func radioPoint(body uplink.Input) (map[string]interface{}, map[string]string) {
 	values := make(map[string]interface{})
+	tags := make(map[string]string)
+	tags["stream_id"] = body.StreamID
+	if body.Station != "" {
+		tags["station"] = body.Station
+	}
+	if body.Gateway != "" {
+		tags["gateway"] = body.Gateway
+	}
+
+	if body.RSSI != nil {
+		values["rssi"] = *body.RSSI
+	}
+	if body.SNR != nil {
+		values["snr"] = *body.SNR
+	}
+	if body.SeqNumber != nil {
+		stats := linkTracker.Observe(body.StreamID, *body.SeqNumber)
+		values["seq_number"] = float64(stats.SeqNumber)
+		values["seq_gap"] = float64(stats.Gap)
+		values["received"] = float64(stats.Received)
+		values["lost"] = float64(stats.Lost)
+		values["loss_rate"] = stats.LossRate()
+		values["counter_reset"] = stats.Reset
+		values["duplicate"] = stats.Duplicate
+	}
 
-	values["rucher_id"] = payload[0]
+	return values, tags
+}
 
-	values["temp"] = float64(getUInt16(payload[1:3])) / 100.0
-	values["hum"] = float64(getUInt16(payload[3:5])) / 100.0
-	values["lum"] = float64(getUInt16(payload[5:7]))
-	values["bat_tension"] = float64(getUInt16(payload[7:9])) / 100.0
-	values["sol_tension"] = float64(getUInt16(payload[9:11])) / 100.0
-	values["mass_r1"] = float64(getUInt16(payload[11:13])) / 100.0
-	values["mass_r2"] = float64(getUInt16(payload[13:15])) / 100.0
-	values["mass_r3"] = float64(getUInt16(payload[15:17])) / 100.0
-	values["mass_r4"] = float64(getUInt16(payload[17:19])) / 100.0
+func checkErr(ctx context.Context, err error, value string) error {
+	log := logger.Get(ctx)
+	log.WithError(err).WithField("field", value).Error(err.Error())
+	return err
+}
 
-	return values
+func getValue(payload string, start, end int) string {
+	return strings.Trim(payload[start:end], "\x00 ")
 }
@@ -1,14 +1,115 @@
 package webserver
 
 import (
-	"encoding/hex"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/config/configtest"
+	"github.com/johnsudaar/ruche/downlink"
+	"github.com/johnsudaar/ruche/event"
+	"github.com/johnsudaar/ruche/fragment"
+	"github.com/johnsudaar/ruche/link"
+	"github.com/johnsudaar/ruche/sink"
+	"github.com/sirupsen/logrus"
 )
 
-func Test_Parser(t *testing.T) {
-	payload, _ := hex.DecodeString("002008301100003a01150038f010e8044340e8")
-	values := parsePayload(payload)
+type recordingSink struct {
+	points []sink.Point
+}
+
+func (s *recordingSink) Write(ctx context.Context, points []sink.Point) error {
+	s.points = append(s.points, points...)
+	return nil
+}
+
+func Test_WebhookDownlink(t *testing.T) {
+	configtest.Setenv(t, map[string]string{"TIMESTAMP_POLICY": "reject"})
+	linkTracker = link.NewTracker(4096)
+	eventTracker = event.NewTracker(time.Hour)
+	fragments = fragment.NewBuffer(time.Minute)
+
+	examples := map[string]struct {
+		Created  time.Time
+		Ack      bool
+		Queued   bool
+		Rejected bool
+		Code     int
+		Downlink string
+	}{
+		"uplink waiting for a downlink": {
+			Created: time.Now(), Ack: true, Queued: true,
+			Code: http.StatusOK, Downlink: "010f000000000000",
+		},
+		"rejected uplink waiting for a downlink": {
+			Created: time.Now().Add(-30 * 24 * time.Hour), Ack: true, Queued: true, Rejected: true,
+			Code: http.StatusOK, Downlink: "010f000000000000",
+		},
+		"nothing to send": {
+			Created: time.Now(), Ack: true,
+			Code: http.StatusNoContent,
+		},
+		"uplink not waiting for a downlink": {
+			Created: time.Now(), Queued: true,
+			Code: http.StatusOK,
+		},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			downlinkQueue = downlink.NewQueue()
+			if example.Queued {
+				_, err := downlinkQueue.Push("1A2B3C", downlink.Command{Type: downlink.CommandSetInterval, Interval: 15})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			recorder := &recordingSink{}
+			sink.Use(recorder)
+			defer sink.Use()
+
+			body := fmt.Sprintf(`{"streamId": "1A2B3C", "model": "hive", "created": %q, "ack": %v, "value": {"payload": "002008301100003a01150038f010e8044340e8"}}`,
+				example.Created.Format(time.RFC3339), example.Ack)
+			router := newRouter(logrus.New(), config.Get())
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("POST", "/webhooks", strings.NewReader(body)))
+
+			if resp.Code != example.Code {
+				t.Fatalf("expected status %v, got %v: %v", example.Code, resp.Code, resp.Body.String())
+			}
+			if example.Downlink != "" {
+				var res map[string]map[string]string
+				err := json.Unmarshal(resp.Body.Bytes(), &res)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res["1A2B3C"]["downlinkData"] != example.Downlink {
+					t.Fatalf("expected downlink %v, got %v", example.Downlink, resp.Body.String())
+				}
+			}
+
+			if example.Rejected {
+				// Only the clock point of a rejected uplink is stored
+				if len(recorder.points) != 1 || recorder.points[0].Measurement != "clock" {
+					t.Fatalf("expected a clock point, got %+v", recorder.points)
+				}
+				values := recorder.points[0].Values
+				if values["reason"] != "too_old" || values["rejected"] != true || values["skew"] == nil {
+					t.Fatalf("unexpected clock values %+v", values)
+				}
+			}
 
-	fmt.Printf("%+v\n", values)
+			downlinks := downlinkQueue.List("1A2B3C")
+			sent := len(downlinks) > 0 && downlinks[0].Status == downlink.StatusSent
+			if sent != (example.Downlink != "") {
+				t.Fatalf("unexpected downlinks %+v", downlinks)
+			}
+		})
+	}
 }
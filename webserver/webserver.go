@@ -2,23 +2,50 @@ package webserver
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	handlers "github.com/Scalingo/go-handlers"
 	muxhandlers "github.com/gorilla/handlers"
 
 	"github.com/Scalingo/go-utils/logger"
+	"github.com/johnsudaar/ruche/archive"
 	"github.com/johnsudaar/ruche/config"
+	"github.com/johnsudaar/ruche/downlink"
+	"github.com/johnsudaar/ruche/event"
+	"github.com/johnsudaar/ruche/fragment"
+	"github.com/johnsudaar/ruche/link"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func Start(ctx context.Context) {
 	log := logger.Get(ctx)
-	router := handlers.NewRouter(log)
-
 	config := config.Get()
+	linkTracker = link.NewTracker(config.SeqNumberModulus)
+	downlinkQueue = downlink.NewQueue()
+	if config.DownlinkStateFile != "" {
+		var err error
+		downlinkQueue, err = downlink.Open(config.DownlinkStateFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	eventTracker = event.NewTracker(config.RebootAlertWindow)
+	fragments = fragment.NewBuffer(config.FragmentTimeout)
+	if config.ArchiveDir != "" {
+		var err error
+		uplinkArchive, err = archive.NewWriter(config.ArchiveDir, config.ArchiveMaxSize)
+		if err != nil {
+			panic(err)
+		}
+		defer uplinkArchive.Close()
+	}
+
+	router := newRouter(log, config)
 
-	router.HandleFunc("/webhooks", Webhook)
 	log.WithField("port", config.Port).Info("Starting web server")
 
 	headersOk := muxhandlers.AllowedHeaders([]string{"X-Requested-With", "Origin", "Content-Type", "Accept", "Authorization"})
@@ -30,3 +57,62 @@ func Start(ctx context.Context) {
 		panic(err)
 	}
 }
+
+func newRouter(log logrus.FieldLogger, config config.Config) *handlers.Router {
+	router := handlers.NewRouter(log)
+
+	router.HandleFunc("/webhooks", Webhook)
+
+	// Middlewares only apply to the routes registered after them
+	router.Use(handlers.ErrorMiddleware)
+	// The devices are authenticated by their own token, a failed write must
+	// be answered with an error status for them to retry
+	router.HandleFunc("/ingest", Ingest).Methods("POST")
+	if config.APIUsername != "" {
+		router.Use(handlers.AuthMiddleware(func(user, password string) bool {
+			return user == config.APIUsername && password == config.APIPassword
+		}))
+	}
+	router.HandleFunc("/metrics", Metrics).Methods("GET")
+	router.HandleFunc("/api/v1/devices/{device_id}/downlinks", ListDownlinks).Methods("GET")
+	router.HandleFunc("/api/v1/devices/{device_id}/downlinks", CreateDownlink).Methods("POST")
+	router.HandleFunc("/api/v1/devices/{device_id}/downlinks/{id}", CancelDownlink).Methods("DELETE")
+	router.HandleFunc("/api/v1/devices/{device_id}/flight", GetFlightActivity).Methods("GET")
+	router.HandleFunc("/api/v1/devices/{device_id}/daily", GetDailyWeight).Methods("GET")
+	router.HandleFunc("/api/v1/devices/{device_id}/steps", ListSteps).Methods("GET")
+	router.HandleFunc("/api/v1/devices/{device_id}/steps/{id}", ClassifyStep).Methods("PUT")
+	router.HandleFunc("/api/v1/devices/{device_id}/production", GetProduction).Methods("GET")
+	router.HandleFunc("/api/v1/devices/{device_id}/forecast", GetForecast).Methods("GET")
+	router.HandleFunc("/api/v1/devices/{device_id}/uploads", UploadReadings).Methods("POST")
+	router.HandleFunc("/api/v1/devices/{device_id}/export", ExportDevice).Methods("GET")
+	router.HandleFunc("/api/v1/apiaries/{apiary_id}/export", ExportApiary).Methods("GET")
+	return router
+}
+
+func writeJSON(resp http.ResponseWriter, status int, value interface{}) error {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	return json.NewEncoder(resp).Encode(value)
+}
+
+// timeRange reads the from and to query parameters (RFC3339), the range
+// defaults to the last period
+func timeRange(req *http.Request, period time.Duration) (time.Time, time.Time, error) {
+	to := time.Now()
+	from := to.Add(-period)
+	var err error
+	if v := req.URL.Query().Get("to"); v != "" {
+		to, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, errors.Wrap(err, "invalid to")
+		}
+		from = to.Add(-period)
+	}
+	if v := req.URL.Query().Get("from"); v != "" {
+		from, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, errors.Wrap(err, "invalid from")
+		}
+	}
+	return from, to, nil
+}